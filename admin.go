@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/digest"
+)
+
+// copiesPath where the admin api shows the copies going on
+const copiesPath = "/api/copies"
+
+// adminAPI syncs jobs and copies images on demand, e.g. for release tooling once a build is
+// approved, and shows what the jobs are doing
+//
+//	GET    /api/jobs             every job with how its last sync went
+//	GET    /api/jobs/<job>       one of them
+//	POST   /api/jobs/<job>/sync  starts a sync of the job, unless one is running
+//	DELETE /api/jobs/<job>/sync  cancels the sync running
+//	POST   /api/jobs/<job>/copy  queues a copy of {"repository": "team/app", "tag": "1.0"}
+//	       /api/jobs/<job>/dead-letters/...  the events the job gave up on, see deadLetterAPI
+//	GET    /api/copies           the copies running or waiting for a worker and the events queued by each job
+type adminAPI struct {
+	servers []server
+	workers *Workers
+}
+
+// JobStatus a job and how its syncs and copies have gone
+type JobStatus struct {
+	Job         string         `json:"job"`
+	Source      string         `json:"source"`
+	Poll        string         `json:"poll,omitempty"`
+	Sync        SyncRun        `json:"sync"`
+	Targets     []TargetStatus `json:"targets"`
+	Queued      int            `json:"queued"`
+	DeadLetters int            `json:"dead_letters"`
+}
+
+// CopyRequest an image to copy on demand, at the digest when given so a tag that has
+// moved on since the build was approved isn't copied instead
+type CopyRequest struct {
+	Repository string        `json:"repository"`
+	Tag        string        `json:"tag"`
+	Digest     digest.Digest `json:"digest,omitempty"`
+}
+
+// CopiesStatus the copies going on in every job
+type CopiesStatus struct {
+	Copies []WorkerCopy `json:"copies"`
+	Queued []JobQueue   `json:"queued"`
+}
+
+// JobQueue the events a job has queued
+type JobQueue struct {
+	Job    string         `json:"job"`
+	Events []PendingEvent `json:"events"`
+}
+
+// registerAdminAPI serves the admin api on the mux.  It can copy anything the jobs can, so it is
+// only served with a token or user to check, the addresses allowed being optional.
+func registerAdminAPI(mux *http.ServeMux, auth WebhookAuth, servers []server, workers *Workers) error {
+	if auth.Token == "" && auth.User == "" {
+		if !auth.empty() {
+			return fmt.Errorf("the admin api needs a token or a user as well as the addresses allowed")
+		}
+		log.Infof("No admin api, it needs --admin-token or --admin-user")
+		return nil
+	}
+	guard, err := newWebhookGuard("admin", auth)
+	if err != nil {
+		return err
+	}
+	guard.subject = "admin request"
+	api := adminAPI{servers: servers, workers: workers}
+	mux.Handle(strings.TrimSuffix(apiPrefix, "/"), guard.wrap(api.jobs()))
+	mux.Handle(apiPrefix, guard.wrap(api.jobs()))
+	mux.Handle(copiesPath, guard.wrap(api.copies()))
+	log.Infof("Admin api on %s and %s", apiPrefix, copiesPath)
+	return nil
+}
+
+// server the job called name
+func (a adminAPI) server(name string) (server, bool) {
+	for _, s := range a.servers {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return server{}, false
+}
+
+func (a adminAPI) jobs() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, strings.TrimSuffix(apiPrefix, "/")), "/"), "/")
+		if parts[0] == "" {
+			if r.Method != "GET" {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			statuses := make([]JobStatus, 0, len(a.servers))
+			for _, s := range a.servers {
+				statuses = append(statuses, jobStatus(s))
+			}
+			writeJSON(w, http.StatusOK, statuses)
+			return
+		}
+		s, ok := a.server(parts[0])
+		if ok && len(parts) > 1 && parts[1] == "dead-letters" {
+			deadLetterAPI(jobAPIPath(s.name, "dead-letters"), s.queue)(w, r)
+			return
+		}
+		if !ok || len(parts) > 2 || (len(parts) == 2 && parts[1] != "sync" && parts[1] != "copy") {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case len(parts) == 1 && r.Method == "GET":
+			writeJSON(w, http.StatusOK, jobStatus(s))
+		case len(parts) == 2 && parts[1] == "sync" && r.Method == "POST":
+			stop, started := s.syncs.start()
+			if !started {
+				http.Error(w, fmt.Sprintf("a sync of job %s is already running", s.name), http.StatusConflict)
+				return
+			}
+			log.Infof("Syncing job %s as asked by %s", s.name, r.RemoteAddr)
+			go s.runSync(stop)
+			writeJSON(w, http.StatusAccepted, jobStatus(s))
+		case len(parts) == 2 && parts[1] == "sync" && r.Method == "DELETE":
+			if !s.syncs.cancel() {
+				http.Error(w, fmt.Sprintf("no sync of job %s is running", s.name), http.StatusConflict)
+				return
+			}
+			log.Infof("Cancelling the sync of job %s as asked by %s", s.name, r.RemoteAddr)
+			writeJSON(w, http.StatusAccepted, jobStatus(s))
+		case len(parts) == 2 && parts[1] == "copy" && r.Method == "POST":
+			copyImage(w, r, s)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// copyImage queues a copy of the image asked for, like a notification of it being pushed
+// would, so it is retried and kept on disk the same way
+func copyImage(w http.ResponseWriter, r *http.Request, s server) {
+	var request CopyRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, fmt.Sprintf("bad copy request : %s", err), http.StatusBadRequest)
+		return
+	}
+	if request.Repository == "" || request.Tag == "" {
+		http.Error(w, "a copy needs a repository and a tag", http.StatusBadRequest)
+		return
+	}
+	if request.Digest != "" {
+		if err := request.Digest.Validate(); err != nil {
+			http.Error(w, fmt.Sprintf("bad digest %s : %s", request.Digest, err), http.StatusBadRequest)
+			return
+		}
+	}
+	evt := RegistryEvent{
+		Action: "push",
+		Target: RegistryTarget{Repository: request.Repository, Tag: request.Tag},
+		Digest: request.Digest,
+	}
+	// the job would only ignore it later, so say so now
+	matches, err := s.filter.matchesEvent(evt, s.source)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("couldn't tell if job %s copies %s : %s", s.name, evt, err), http.StatusBadGateway)
+		return
+	}
+	if !matches {
+		http.Error(w, fmt.Sprintf("job %s doesn't copy %s:%s", s.name, request.Repository, request.Tag),
+			http.StatusUnprocessableEntity)
+		return
+	}
+	if err = s.queue.Handle(evt); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Infof("Job %s will copy %s as asked by %s", s.name, imageRef(evt.Target, evt.Digest), r.RemoteAddr)
+	writeJSON(w, http.StatusAccepted, request)
+}
+
+func (a adminAPI) copies() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		status := CopiesStatus{Copies: a.workers.Copies(), Queued: make([]JobQueue, 0, len(a.servers))}
+		for _, s := range a.servers {
+			status.Queued = append(status.Queued, JobQueue{Job: s.name, Events: s.queue.Queued()})
+		}
+		writeJSON(w, http.StatusOK, status)
+	}
+}
+
+// jobStatus how the job has been doing
+func jobStatus(s server) JobStatus {
+	status := JobStatus{
+		Job:         s.name,
+		Source:      s.source.URL(),
+		Sync:        s.syncs.last(),
+		Targets:     s.handler.Status(),
+		Queued:      s.queue.Pending(),
+		DeadLetters: len(s.queue.DeadLetters()),
+	}
+	if s.frequency > 0 {
+		status.Poll = s.frequency.String()
+	}
+	return status
+}
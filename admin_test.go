@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// adminJob a job copying team/* from the source to the target, served with the admin api on the mux
+func adminJob(t *testing.T, source, target *fakeRegistry, workers *Workers) (server, *http.ServeMux) {
+	request := ServerRequest{
+		name:          "release",
+		source:        source.info(),
+		targets:       []RegistryInfo{target.info()},
+		engine:        "registry",
+		filterOptions: FilterOptions{Include: PatternLists{Repositories: []string{"team/*"}}},
+		resourcePath:  "/release",
+	}
+	s, err := request.newServer(workers, QueueOptions{Workers: 1, Attempts: 1})
+	if err != nil {
+		t.Fatalf("newServer() error = %v", err)
+	}
+	mux := http.NewServeMux()
+	s.start(mux)
+	if err = registerAdminAPI(mux, WebhookAuth{Token: "s3cret"}, []server{s}, workers); err != nil {
+		t.Fatalf("registerAdminAPI() error = %v", err)
+	}
+	return s, mux
+}
+
+// copiedTags the tags of the repository the registry has, looked up with the lock held
+// as the copies may still be going on
+func copiedTags(f *fakeRegistry, repo string, tags ...string) []string {
+	copied := []string{}
+	for _, tag := range tags {
+		if _, ok := f.manifest(repo, tag); ok {
+			copied = append(copied, tag)
+		}
+	}
+	return copied
+}
+
+// adminCall calls the api with the token
+func adminCall(mux http.Handler, method, path, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer s3cret")
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestAdminAPI(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	source.addImage("team/app", "1.0", "base")
+	source.addImage("team/app", "2.0", "base", "app")
+	source.addImage("other/app", "1.0", "base")
+	s, mux := adminJob(t, source, target, NewWorkers(2, 0))
+	defer s.queue.Stop()
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/jobs", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("without the token got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+
+	copies := []struct {
+		path, body string
+		wantStatus int
+	}{
+		{"/api/jobs/release/copy", `{"repository": "team/app", "tag": "1.0"}`, http.StatusAccepted},
+		{"/api/jobs/release/copy", `{"repository": "other/app", "tag": "1.0"}`, http.StatusUnprocessableEntity},
+		{"/api/jobs/release/copy", `{"repository": "team/app"}`, http.StatusBadRequest},
+		{"/api/jobs/release/copy", `{"repository": "team/app", "tag": "1.0", "digest": "sha256:abc"}`, http.StatusBadRequest},
+		{"/api/jobs/release/copy", `team/app:1.0`, http.StatusBadRequest},
+		{"/api/jobs/nightly/copy", `{"repository": "team/app", "tag": "1.0"}`, http.StatusNotFound},
+	}
+	for _, tt := range copies {
+		if w := adminCall(mux, "POST", tt.path, tt.body); w.Code != tt.wantStatus {
+			t.Errorf("copy of %s got %d, want %d : %s", tt.body, w.Code, tt.wantStatus, w.Body.String())
+		}
+	}
+	waitFor(t, "the copy", func() bool { return len(copiedTags(target, "team/app", "1.0")) == 1 })
+
+	if w := adminCall(mux, "DELETE", "/api/jobs/release/sync", ""); w.Code != http.StatusConflict {
+		t.Errorf("cancel with no sync running got %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := adminCall(mux, "POST", "/api/jobs/release/sync", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("sync got %d : %s", w.Code, w.Body.String())
+	}
+	waitFor(t, "the sync", func() bool { return !s.syncs.last().Running })
+	if got := copiedTags(target, "team/app", "1.0", "2.0"); len(got) != 2 {
+		t.Errorf("target has tags %v after the sync, want both", got)
+	}
+	if got := copiedTags(target, "other/app", "1.0"); len(got) != 0 {
+		t.Errorf("target has other/app tags %v, want none", got)
+	}
+
+	w = adminCall(mux, "GET", "/api/jobs", "")
+	var jobs []JobStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &jobs); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("list got %d %s : %v", w.Code, w.Body.String(), err)
+	}
+	if len(jobs) != 1 || jobs[0].Job != "release" || jobs[0].Sync.Finished.IsZero() || jobs[0].Sync.LastError != "" ||
+		len(jobs[0].Targets) != 1 || jobs[0].Targets[0].Copied != 2 {
+		t.Errorf("jobs = %+v", jobs)
+	}
+	if w := adminCall(mux, "GET", "/api/jobs/release", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"job":"release"`) {
+		t.Errorf("get got %d %s", w.Code, w.Body.String())
+	}
+	if w := adminCall(mux, "PUT", "/api/jobs/release/sync", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("put got %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if w := adminCall(mux, "GET", "/api/jobs/release/dead-letters", ""); w.Code != http.StatusOK || w.Body.String() != "[]\n" {
+		t.Errorf("dead letters got %d %s", w.Code, w.Body.String())
+	}
+	if w := adminCall(mux, "POST", "/api/jobs/release/dead-letters/retry", ""); w.Code != http.StatusAccepted {
+		t.Errorf("retry of the dead letters got %d", w.Code)
+	}
+	// the job takes notifications from anyone but its dead letters are only for admins
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", "/api/jobs/release/dead-letters", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("dead letters without the token got %d, want %d", w.Code, http.StatusUnauthorized)
+	}
+}
+
+// blockingPusher pushes with next once released, saying when each push starts
+type blockingPusher struct {
+	next    pusher
+	started chan string
+	release chan bool
+}
+
+func (b blockingPusher) Push(name string) error {
+	b.started <- name
+	<-b.release
+	return b.next.Push(name)
+}
+
+func TestAdminCancelSync(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	for _, tag := range []string{"1.0", "2.0", "3.0"} {
+		source.addImage("team/app", tag, "base", tag)
+	}
+	// one copy at a time, so the others wait for the first
+	s, mux := adminJob(t, source, target, NewWorkers(1, 0))
+	defer s.queue.Stop()
+	blocking := blockingPusher{next: s.handler.handlers[0].target.pusher, started: make(chan string, 3), release: make(chan bool)}
+	s.handler.handlers[0].target.pusher = blocking
+
+	if w := adminCall(mux, "POST", "/api/jobs/release/sync", ""); w.Code != http.StatusAccepted {
+		t.Fatalf("sync got %d : %s", w.Code, w.Body.String())
+	}
+	<-blocking.started
+	w := adminCall(mux, "GET", "/api/copies", "")
+	var status CopiesStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("copies got %d %s : %v", w.Code, w.Body.String(), err)
+	}
+	if len(status.Copies) != 1 || status.Copies[0].Image.Repository != "team/app" || status.Copies[0].Started.IsZero() ||
+		len(status.Queued) != 1 || status.Queued[0].Job != "release" {
+		t.Errorf("copies = %+v", status)
+	}
+	if w := adminCall(mux, "POST", "/api/jobs/release/sync", ""); w.Code != http.StatusConflict {
+		t.Errorf("second sync got %d, want %d", w.Code, http.StatusConflict)
+	}
+	if w := adminCall(mux, "DELETE", "/api/jobs/release/sync", ""); w.Code != http.StatusAccepted {
+		t.Errorf("cancel got %d : %s", w.Code, w.Body.String())
+	}
+	close(blocking.release)
+	waitFor(t, "the sync to stop", func() bool { return !s.syncs.last().Running })
+
+	if got := copiedTags(target, "team/app", "1.0", "2.0", "3.0"); len(got) != 1 {
+		t.Errorf("target has %v, want just the copy that was running", got)
+	}
+	if run := s.syncs.last(); run.LastError != errSyncCancelled.Error() {
+		t.Errorf("last sync = %+v, want it cancelled", run)
+	}
+	if got := len(s.handler.workers.Copies()); got != 0 {
+		t.Errorf("%d copies left", got)
+	}
+}
+
+func TestRegisterAdminAPI(t *testing.T) {
+	mux := http.NewServeMux()
+	if err := registerAdminAPI(mux, WebhookAuth{}, nil, NewWorkers(1, 0)); err != nil {
+		t.Fatalf("registerAdminAPI() error = %v", err)
+	}
+	for _, path := range []string{"/api/jobs", "/api/jobs/release/dead-letters"} {
+		if w := adminCall(mux, "GET", path, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s without credentials got %d, want no api", path, w.Code)
+		}
+	}
+	if err := registerAdminAPI(mux, WebhookAuth{Allow: []string{"10.0.0.0/8"}}, nil, NewWorkers(1, 0)); err == nil {
+		t.Error("registerAdminAPI() with only the addresses allowed should fail")
+	}
+}
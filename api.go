@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// apiPrefix where the http api of the jobs lives, /api/jobs/<job>/...
+const apiPrefix = "/api/jobs/"
+
+// jobAPIPath the path of part of the api of a job
+func jobAPIPath(job, part string) string {
+	return apiPrefix + job + "/" + part
+}
+
+// writeJSON sends the value as the response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Warnf("Couldn't write response : %s", err)
+	}
+}
+
+// deadLetterAPI looks at and retries the events a job gave up on, served under prefix
+//
+//	GET    <prefix>             every dead letter
+//	POST   <prefix>/retry       queues them all again
+//	GET    <prefix>/<id>        one of them
+//	POST   <prefix>/<id>/retry  queues it again
+//	DELETE <prefix>/<id>        drops it
+func deadLetterAPI(prefix string, queue *EventQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/"), "/")
+		switch {
+		case parts[0] == "" && r.Method == "GET":
+			writeJSON(w, http.StatusOK, queue.DeadLetters())
+			return
+		case parts[0] == "retry" && len(parts) == 1 && r.Method == "POST":
+			retried := 0
+			for _, e := range queue.DeadLetters() {
+				if err := queue.Retry(e.ID); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				retried++
+			}
+			writeJSON(w, http.StatusAccepted, map[string]int{"retried": retried})
+			return
+		}
+		id, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil || len(parts) > 2 || (len(parts) == 2 && parts[1] != "retry") {
+			http.NotFound(w, r)
+			return
+		}
+		letter, ok := queue.DeadLetter(id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case len(parts) == 1 && r.Method == "GET":
+			writeJSON(w, http.StatusOK, letter)
+		case len(parts) == 1 && r.Method == "DELETE":
+			if err = queue.Discard(id); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 2 && r.Method == "POST":
+			if err = queue.Retry(id); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
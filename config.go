@@ -0,0 +1,280 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+// JobConfig a sync job as written in the jobs section of registryrsync.yml
+//
+//	jobs:
+//	  - name: staging-to-prod
+//	    source:
+//	      url: staging.example.com
+//	    target:
+//	      url: prod.example.com
+//	      user: promoter
+//	      password: secret
+//	    targets:
+//	      - url: prod-eu.example.com
+//	      - url: prod-asia.example.com
+//	    namespaces: [team1, team2]
+//	    tag-regex: ^\d+\.\d+\.\d+$
+//	    semver: ">=2.3, <3"
+//	    newest: 5
+//	    include:
+//	      repositories: [team1/**]
+//	    exclude:
+//	      repositories: [team1/experimental/**]
+//	      tags: ["*-debug", "regex:^tmp"]
+//	    labels: [org.opencontainers.image.revision, com.genesys.approved=true]
+//	    max-age: 30d
+//	    rewrite:
+//	      - prefix: staging/
+//	        to: prod/
+//	      - regex: ^library/(.*)$
+//	        to: $1
+//	    tags:
+//	      - match: (\d+\.\d+\.\d+)-rc\d+
+//	        to: [$1, "promoted-{{.Date}}"]
+//	    platforms: [linux/amd64, linux/arm64]
+//	    deletes: ignore
+//	    copy-untagged: true
+//	    dedupe-window: 5m
+//	    webhook:
+//	      token: s3cret
+//	      allow: [10.0.0.0/8]
+//	    notify:
+//	      - url: https://deploy.example.com/promoted
+//	        hmac-secret: s3cret
+//	      - url: https://hooks.slack.com/services/T000/B000/XXXX
+//	        template: slack
+//	    poll: 10m
+//	    path: /staging
+type JobConfig struct {
+	Name    string
+	Source  RegistryConfig
+	Target  RegistryConfig
+	Targets []RegistryConfig // more registries to copy to as well as Target
+	// FilterOptions namespaces, tag-regex, include, exclude and so on at the same level as the rest
+	FilterOptions `mapstructure:",squash"`
+	Engine        string
+	Poll          time.Duration
+	Path          string
+	Prune         bool
+	// Deletes what to do when told an image was deleted from the source, see EventPolicy
+	Deletes string
+	// CopyUntagged copy manifests pushed without a tag by their digest, see EventPolicy
+	CopyUntagged bool `mapstructure:"copy-untagged"`
+	// DedupeWindow defaults to a minute when not given, see EventPolicy
+	DedupeWindow *time.Duration `mapstructure:"dedupe-window"`
+	// PruneMax defaults to the same as the --prune-max flag when not given
+	PruneMax *int `mapstructure:"prune-max"`
+	Rewrite  []RewriteConfig
+	Tags     []TagRuleConfig
+	// Platforms copied from multi-arch images, all of them when not given
+	Platforms []string
+	// Webhook who may send the job notifications
+	Webhook WebhookAuth
+	// Notify where the result of every copy is posted
+	Notify []OutboundWebhook
+}
+
+// TagRuleConfig a rule giving the tags matching a regex new tags in the target
+type TagRuleConfig struct {
+	Match string
+	To    []string
+}
+
+// RewriteConfig a rule renaming repositories in the target, either a prefix or a regex
+type RewriteConfig struct {
+	Prefix *string
+	Regex  *string
+	To     string
+}
+
+func (r RewriteConfig) rule() (RepositoryRule, error) {
+	switch {
+	case r.Prefix != nil && r.Regex != nil:
+		return nil, fmt.Errorf("rewrite rule has both a prefix and a regex")
+	case r.Prefix != nil:
+		return PrefixRule{*r.Prefix, r.To}, nil
+	case r.Regex != nil:
+		return NewRegexRule(*r.Regex, r.To)
+	}
+	return nil, fmt.Errorf("rewrite rule needs a prefix or a regex")
+}
+
+// RegistryConfig how a job connects to a registry
+type RegistryConfig struct {
+	URL      string
+	User     string
+	Password string
+	Insecure bool
+	Attempts int
+	// Workers the most copies at once to this registry, only used for targets
+	Workers int
+}
+
+func (r RegistryConfig) info() RegistryInfo {
+	info := RegistryInfo{
+		address:    r.URL,
+		username:   r.User,
+		password:   r.Password,
+		isInsecure: r.Insecure,
+		retry:      DefaultRetryPolicy,
+	}
+	if r.Attempts > 0 {
+		info.retry.Attempts = r.Attempts
+	}
+	return info
+}
+
+// decodeConfig decodes part of the config file, allowing durations like 5m and
+// lists written as a single string, and failing on any keys we don't know about
+// so typos don't go unnoticed
+func decodeConfig(raw interface{}, result interface{}) error {
+	decoder, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook: mapstructure.ComposeDecodeHookFunc(
+			mapstructure.StringToTimeDurationHookFunc(),
+			mapstructure.StringToSliceHookFunc(","),
+		),
+		WeaklyTypedInput: true,
+		ErrorUnused:      true,
+		Result:           result,
+	})
+	if err != nil {
+		return err
+	}
+	return decoder.Decode(raw)
+}
+
+// reservedPath true for what is served besides the notifications of the jobs
+func reservedPath(path string) bool {
+	switch path {
+	case livenessPath, readinessPath, metricsPath:
+		return true
+	}
+	return path == "/api" || strings.HasPrefix(path, "/api/")
+}
+
+// loadJobs turns the jobs section of the config into jobs, checking they make sense together
+func loadJobs(raw interface{}) ([]ServerRequest, error) {
+	var configs []JobConfig
+	if err := decodeConfig(raw, &configs); err != nil {
+		return nil, fmt.Errorf("couldn't read jobs : %s", err)
+	}
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("no jobs given")
+	}
+	names := make(map[string]bool)
+	paths := make(map[string]string)
+	requests := make([]ServerRequest, 0, len(configs))
+	for n, config := range configs {
+		if config.Name == "" {
+			return nil, fmt.Errorf("job %d has no name", n+1)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("there is more than one job called %s", config.Name)
+		}
+		names[config.Name] = true
+		targetConfigs := config.Targets
+		if config.Target != (RegistryConfig{}) {
+			targetConfigs = append([]RegistryConfig{config.Target}, targetConfigs...)
+		}
+		if config.Source.URL == "" || len(targetConfigs) == 0 {
+			return nil, fmt.Errorf("job %s needs a source and at least one target url", config.Name)
+		}
+		targets := make([]RegistryInfo, 0, len(targetConfigs))
+		limits := make(map[string]int)
+		for _, target := range targetConfigs {
+			if target.URL == "" {
+				return nil, fmt.Errorf("job %s has a target without a url", config.Name)
+			}
+			if _, ok := limits[target.URL]; ok {
+				return nil, fmt.Errorf("job %s has %s as a target more than once", config.Name, target.URL)
+			}
+			limits[target.URL] = target.Workers
+			targets = append(targets, target.info())
+		}
+		path := config.Path
+		if path == "" {
+			path = "/" + config.Name
+		}
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		routes := []string{path}
+		for _, decoder := range PayloadDecoders {
+			routes = append(routes, decoderPath(path, decoder))
+		}
+		for _, route := range routes {
+			if reservedPath(route) {
+				return nil, fmt.Errorf("job %s can't listen on %s, it is taken by the health checks, metrics or api", config.Name, route)
+			}
+			if other, ok := paths[route]; ok {
+				return nil, fmt.Errorf("jobs %s and %s both listen on %s", other, config.Name, route)
+			}
+		}
+		for _, route := range routes {
+			paths[route] = config.Name
+		}
+		var mapping ImageMapping
+		for _, rewrite := range config.Rewrite {
+			rule, err := rewrite.rule()
+			if err != nil {
+				return nil, fmt.Errorf("job %s : %s", config.Name, err)
+			}
+			mapping.Repositories = append(mapping.Repositories, rule)
+		}
+		for _, tags := range config.Tags {
+			rule, err := NewTagRule(tags.Match, tags.To...)
+			if err != nil {
+				return nil, fmt.Errorf("job %s : %s", config.Name, err)
+			}
+			mapping.Tags = append(mapping.Tags, rule)
+		}
+		pruneMax := defaultPruneMax
+		if config.PruneMax != nil {
+			pruneMax = *config.PruneMax
+		}
+		source := config.Source.info()
+		platforms, err := ParsePlatforms(config.Platforms)
+		if err != nil {
+			return nil, fmt.Errorf("job %s : %s", config.Name, err)
+		}
+		source.platforms = platforms
+		events := EventPolicy{Deletes: config.Deletes, CopyUntagged: config.CopyUntagged, DedupeWindow: defaultDedupeWindow}
+		if config.DedupeWindow != nil {
+			events.DedupeWindow = *config.DedupeWindow
+		}
+		if err = events.validate(); err != nil {
+			return nil, fmt.Errorf("job %s : %s", config.Name, err)
+		}
+		if _, err = newWebhookGuard(config.Name, config.Webhook); err != nil {
+			return nil, fmt.Errorf("job %s : %s", config.Name, err)
+		}
+		if _, err = NewNotifier(config.Name, config.Notify); err != nil {
+			return nil, fmt.Errorf("job %s : %s", config.Name, err)
+		}
+		requests = append(requests, ServerRequest{
+			name:          config.Name,
+			source:        source,
+			targets:       targets,
+			targetLimits:  limits,
+			filterOptions: config.FilterOptions,
+			engine:        config.Engine,
+			prune:         PruneOptions{config.Prune, pruneMax},
+			events:        events,
+			webhook:       config.Webhook,
+			notify:        config.Notify,
+			mapping:       mapping,
+			frequency:     config.Poll,
+			resourcePath:  path,
+		})
+	}
+	return requests, nil
+}
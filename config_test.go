@@ -0,0 +1,326 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+func yamlConfig(t *testing.T, text string) interface{} {
+	var raw map[string]interface{}
+	if err := yaml.Unmarshal([]byte(strings.Replace(text, "\t", "  ", -1)), &raw); err != nil {
+		t.Fatalf("bad yaml in test %s", err)
+	}
+	return raw["jobs"]
+}
+
+func TestLoadJobs(t *testing.T) {
+	raw := yamlConfig(t, `
+jobs:
+	- name: staging-to-prod
+	  source:
+	    url: staging:5000
+	  target:
+	    url: prod:5000
+	    user: promoter
+	    password: secret
+	    attempts: 5
+	    workers: 2
+	  namespaces: [team1, team2]
+	  tag-regex: ^\d+$
+	  poll: 10m
+	  prune: true
+	- name: hub
+	  source:
+	    url: registry-1.docker.io
+	  target:
+	    url: mirror:5000
+	  path: mirror
+	  prune-max: 0
+	  dedupe-window: 0s
+	  webhook:
+	    token: s3cret
+	    hmac-secret: key
+	    allow: 10.0.0.0/8
+	  notify:
+	    - url: https://deploy.example.com/promoted
+	      hmac-secret: key
+	      attempts: 5
+	    - url: https://hooks.slack.com/services/T000/B000/XXXX
+	      template: slack
+`)
+	requests, err := loadJobs(raw)
+	if err != nil {
+		t.Fatalf("loadJobs() error = %v", err)
+	}
+	if len(requests) != 2 {
+		t.Fatalf("loadJobs() gave %d jobs, want 2", len(requests))
+	}
+	staging := requests[0]
+	if staging.name != "staging-to-prod" || staging.resourcePath != "/staging-to-prod" ||
+		staging.frequency != 10*time.Minute || staging.filterOptions.TagRegex != `^\d+$` ||
+		len(staging.filterOptions.Namespaces) != 2 || staging.targetLimits["prod:5000"] != 2 {
+		t.Errorf("staging job = %+v", staging)
+	}
+	if len(staging.targets) != 1 {
+		t.Fatalf("staging targets = %+v, want one", staging.targets)
+	}
+	if target := staging.targets[0]; target.address != "prod:5000" || target.username != "promoter" ||
+		target.password != "secret" || target.retry.Attempts != 5 {
+		t.Errorf("staging target = %+v", target)
+	}
+	if staging.source.retry != DefaultRetryPolicy {
+		t.Errorf("staging source retry = %+v, want the default", staging.source.retry)
+	}
+	if staging.prune != (PruneOptions{true, defaultPruneMax}) {
+		t.Errorf("staging prune = %+v", staging.prune)
+	}
+	hub := requests[1]
+	if hub.resourcePath != "/mirror" || hub.prune != (PruneOptions{false, 0}) {
+		t.Errorf("hub job = %+v", hub)
+	}
+	if staging.events.DedupeWindow != defaultDedupeWindow || hub.events.DedupeWindow != 0 {
+		t.Errorf("dedupe windows %s and %s, want the default and none", staging.events.DedupeWindow, hub.events.DedupeWindow)
+	}
+	if want := (WebhookAuth{Token: "s3cret", Secret: "key", Allow: []string{"10.0.0.0/8"}}); !reflect.DeepEqual(hub.webhook, want) {
+		t.Errorf("hub webhook = %+v, want %+v", hub.webhook, want)
+	}
+	if want := []OutboundWebhook{
+		{URL: "https://deploy.example.com/promoted", Secret: "key", Attempts: 5},
+		{URL: "https://hooks.slack.com/services/T000/B000/XXXX", Template: "slack"},
+	}; !reflect.DeepEqual(hub.notify, want) {
+		t.Errorf("hub notify = %+v, want %+v", hub.notify, want)
+	}
+}
+
+func TestLoadJobsSeveralTargets(t *testing.T) {
+	raw := yamlConfig(t, `
+jobs:
+	- name: regions
+	  source:
+	    url: staging:5000
+	  target:
+	    url: eu:5000
+	  targets:
+	    - url: us:5000
+	      workers: 3
+	    - url: asia:5000
+`)
+	requests, err := loadJobs(raw)
+	if err != nil {
+		t.Fatalf("loadJobs() error = %v", err)
+	}
+	var addresses []string
+	for _, target := range requests[0].targets {
+		addresses = append(addresses, target.address)
+	}
+	if strings.Join(addresses, ",") != "eu:5000,us:5000,asia:5000" {
+		t.Errorf("targets = %v", addresses)
+	}
+	if requests[0].targetLimits["us:5000"] != 3 {
+		t.Errorf("target limits = %v", requests[0].targetLimits)
+	}
+}
+
+func TestLoadJobsRewrite(t *testing.T) {
+	raw := yamlConfig(t, `
+jobs:
+	- name: promote
+	  source: {url: a}
+	  target: {url: b}
+	  rewrite:
+	    - prefix: staging/
+	      to: prod/
+	    - regex: ^library/(.*)$
+	      to: $1
+	  tags:
+	    - match: (.*)-rc\d+
+	      to: [$1, "promoted-{{.Date}}"]
+	    - match: latest
+	      to: stable
+`)
+	requests, err := loadJobs(raw)
+	if err != nil {
+		t.Fatalf("loadJobs() error = %v", err)
+	}
+	mapping := requests[0].mapping
+	for repository, want := range map[string]string{"staging/app": "prod/app", "library/alpine": "alpine", "team/app": "team/app"} {
+		if got := mapping.Repositories.Rewrite(repository); got != want {
+			t.Errorf("Rewrite(%s) = %s, want %s", repository, got, want)
+		}
+	}
+	if m, _ := mapping.mapImage(RegistryTarget{"team/app", "latest"}, ""); len(m.tags) != 1 || m.tags[0] != "stable" {
+		t.Errorf("tags of latest = %v, want stable", m.tags)
+	}
+	if m, _ := mapping.mapImage(RegistryTarget{"team/app", "1.0-rc1"}, ""); len(m.tags) != 1 || len(m.stamps) != 1 {
+		t.Errorf("tags of 1.0-rc1 = %v %v, want a tag and a stamp", m.tags, m.stamps)
+	}
+}
+
+func TestLoadJobsErrors(t *testing.T) {
+	tests := []struct {
+		name, config, wantErr string
+	}{
+		{"no jobs", "jobs: []", "no jobs"},
+		{"no name", `
+jobs:
+	- source: {url: a}
+	  target: {url: b}`, "no name"},
+		{"same name", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}}
+	- {name: one, source: {url: a}, target: {url: c}}`, "more than one job called one"},
+		{"same path", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}, path: /hook}
+	- {name: two, source: {url: a}, target: {url: c}, path: /hook}`, "both listen on /hook"},
+		{"path of a decoder of another job", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}, path: /}
+	- {name: harbor, source: {url: a}, target: {url: c}}`, "both listen on /harbor"},
+		{"same decoder paths", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}, path: /hook}
+	- {name: two, source: {url: a}, target: {url: c}, path: /hook/}`, "both listen on /hook/distribution"},
+		{"health check path", `
+jobs:
+	- {name: healthz, source: {url: a}, target: {url: b}}`, "can't listen on /healthz"},
+		{"metrics path", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}, path: metrics}`, "can't listen on /metrics"},
+		{"api path", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}, path: /api/hooks}`, "can't listen on /api/hooks"},
+		{"no target", `
+jobs:
+	- {name: one, source: {url: a}}`, "at least one target"},
+		{"same target", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}, targets: [{url: b}]}`, "b as a target more than once"},
+		{"target without url", `
+jobs:
+	- {name: one, source: {url: a}, targets: [{user: me}]}`, "target without a url"},
+		{"rewrite without a kind", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}, rewrite: [{to: x}]}`, "needs a prefix or a regex"},
+		{"bad platform", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}, platforms: [arm64]}`, "platform arm64 should look like"},
+		{"bad delete policy", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}, deletes: always}`, "unknown delete policy always"},
+		{"bad webhook network", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}, webhook: {token: x, allow: [10.0.0.0/33]}}`, "bad network 10.0.0.0/33"},
+		{"bad notify template", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}, notify: [{url: "http://c", template: "{{.Source"}]}`, "bad template for outbound webhook http://c"},
+		{"typo", `
+jobs:
+	- {name: one, source: {url: a}, target: {url: b}, tag-regexp: x}`, "tag-regexp"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadJobs(yamlConfig(t, tt.config))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadJobs() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadJobsIncludeExclude(t *testing.T) {
+	raw := yamlConfig(t, `
+jobs:
+	- name: prod
+	  source: {url: a}
+	  target: {url: b}
+	  namespace-regex: ^prod/
+	  include:
+	    repositories: prod/**
+	  exclude:
+	    repositories: [prod/experimental/*]
+	    tags: ["*-debug", "regex:^tmp"]
+`)
+	requests, err := loadJobs(raw)
+	if err != nil {
+		t.Fatalf("loadJobs() error = %v", err)
+	}
+	filter, err := requests[0].filter()
+	if err != nil {
+		t.Fatalf("filter() error = %v", err)
+	}
+	for repository, want := range map[string]bool{"prod/app": true, "prod/team/app": true,
+		"prod/experimental/app": false, "staging/app": false} {
+		if got := filter.repoFilter.Matches(repository); got != want {
+			t.Errorf("repository %s matches = %v, want %v", repository, got, want)
+		}
+	}
+	for tag, want := range map[string]bool{"1.0": true, "1.0-debug": false, "tmp-1": false} {
+		if got := filter.tagFilter.Matches(tag); got != want {
+			t.Errorf("tag %s matches = %v, want %v", tag, got, want)
+		}
+	}
+}
+
+func TestFlagRequestNamespaceRegex(t *testing.T) {
+	defer viper.Reset()
+	if err := bindFlags(RootCmd, viperFlags); err != nil {
+		t.Fatalf("bindFlags() error = %v", err)
+	}
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.SetEnvPrefix("rr")
+	viper.AutomaticEnv()
+	os.Setenv("RR_NAMESPACE_REGEX", "^team/")
+	defer os.Unsetenv("RR_NAMESPACE_REGEX")
+
+	request, err := flagRequest()
+	if err != nil {
+		t.Fatalf("flagRequest() error = %v", err)
+	}
+	if got := request.filterOptions.NamespaceRegex; got != "^team/" {
+		t.Errorf("namespace regex = %q, want the one from the environment", got)
+	}
+}
+
+func TestReadFlags(t *testing.T) {
+	defer viper.Reset()
+	defer func(workers, targetWorkers, listen int, engine string) {
+		workerCount, targetWorkerCount, port, copyEngine = workers, targetWorkers, listen, engine
+	}(workerCount, targetWorkerCount, port, copyEngine)
+	viper.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	viper.SetEnvPrefix("rr")
+	viper.AutomaticEnv()
+	viper.SetConfigType("yaml")
+	config := "workers: 7\ntarget-workers: 2\nengine: registry\n"
+	if err := viper.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("RR_PORT", "9090")
+	defer os.Unsetenv("RR_PORT")
+
+	if err := readFlags(RootCmd); err != nil {
+		t.Fatalf("readFlags(RootCmd) error = %v", err)
+	}
+	if workerCount != 7 || targetWorkerCount != 2 || copyEngine != "registry" || port != 9090 {
+		t.Errorf("workers %d, target workers %d, engine %s, port %d, want them from the config and environment",
+			workerCount, targetWorkerCount, copyEngine, port)
+	}
+
+	os.Setenv("RR_WORKERS", "3")
+	defer os.Unsetenv("RR_WORKERS")
+	if err := readFlags(RootCmd); err != nil {
+		t.Fatalf("readFlags(RootCmd) error = %v", err)
+	}
+	if workerCount != 3 {
+		t.Errorf("workers %d, want RR_WORKERS over the config file", workerCount)
+	}
+	if err := bindFlags(RootCmd, []string{"no-such-flag"}); err == nil {
+		t.Error("binding a flag that doesn't exist should fail")
+	}
+}
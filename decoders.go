@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// PayloadDecoder turns the body of a notification in one format into events
+type PayloadDecoder interface {
+	// Name of the format, which is also the path under the job to force it
+	Name() string
+	// Detect true if the top level fields of the body look like the format
+	Detect(fields map[string]json.RawMessage) bool
+	Decode(body []byte) ([]RegistryEvent, error)
+}
+
+// PayloadDecoders every format we understand, in the order they are tried when detecting
+var PayloadDecoders = []PayloadDecoder{
+	distributionDecoder{},
+	harborDecoder{},
+	quayDecoder{},
+	dockerHubDecoder{},
+}
+
+// detectingDecoder decodes with whichever decoder recognises the body
+type detectingDecoder []PayloadDecoder
+
+func (d detectingDecoder) Name() string {
+	return "detect"
+}
+
+func (d detectingDecoder) Detect(fields map[string]json.RawMessage) bool {
+	return d.decoder(fields) != nil
+}
+
+func (d detectingDecoder) Decode(body []byte) ([]RegistryEvent, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	decoder := d.decoder(fields)
+	if decoder == nil {
+		return nil, fmt.Errorf("not a notification format we know")
+	}
+	return decoder.Decode(body)
+}
+
+func (d detectingDecoder) decoder(fields map[string]json.RawMessage) PayloadDecoder {
+	for _, decoder := range d {
+		if decoder.Detect(fields) {
+			return decoder
+		}
+	}
+	return nil
+}
+
+// hasFields true if all the fields are there
+func hasFields(fields map[string]json.RawMessage, names ...string) bool {
+	for _, name := range names {
+		if _, ok := fields[name]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// distributionDecoder the {"events": [...]} envelope of docker distribution, which GitLab
+// and most other registries built on it send too
+type distributionDecoder struct{}
+
+func (distributionDecoder) Name() string {
+	return "distribution"
+}
+
+func (distributionDecoder) Detect(fields map[string]json.RawMessage) bool {
+	return hasFields(fields, "events")
+}
+
+func (distributionDecoder) Decode(body []byte) ([]RegistryEvent, error) {
+	var envelope Envelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+	events := make([]RegistryEvent, 0, len(envelope.Events))
+	for _, event := range envelope.Events {
+		events = append(events, event.registryEvent())
+	}
+	return events, nil
+}
+
+// harborDecoder the default webhook payload of Harbor 2, e.g.
+//
+//	{"type": "PUSH_ARTIFACT", "occur_at": 1680501893, "operator": "admin",
+//	 "event_data": {"resources": [{"digest": "sha256:...", "tag": "1.0", "resource_url": "harbor/library/app:1.0"}],
+//	                "repository": {"name": "app", "namespace": "library", "repo_full_name": "library/app"}}}
+type harborDecoder struct{}
+
+type harborPayload struct {
+	Type      string
+	OccurAt   int64 `json:"occur_at"`
+	Operator  string
+	EventData struct {
+		Resources []struct {
+			Digest      digest.Digest
+			Tag         string
+			ResourceURL string `json:"resource_url"`
+		}
+		Repository struct {
+			RepoFullName string `json:"repo_full_name"`
+		}
+	} `json:"event_data"`
+}
+
+// harborActions the harbor event types that mean something to us
+var harborActions = map[string]string{
+	"PUSH_ARTIFACT":   "push",
+	"DELETE_ARTIFACT": "delete",
+	"PULL_ARTIFACT":   "pull",
+}
+
+func (harborDecoder) Name() string {
+	return "harbor"
+}
+
+func (harborDecoder) Detect(fields map[string]json.RawMessage) bool {
+	return hasFields(fields, "type", "event_data")
+}
+
+func (harborDecoder) Decode(body []byte) ([]RegistryEvent, error) {
+	var payload harborPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	action, ok := harborActions[payload.Type]
+	if !ok {
+		// scans, quotas and the like, which get ignored
+		action = strings.ToLower(payload.Type)
+	}
+	events := make([]RegistryEvent, 0, len(payload.EventData.Resources))
+	for _, resource := range payload.EventData.Resources {
+		events = append(events, Event{
+			Action:    action,
+			Timestamp: time.Unix(payload.OccurAt, 0),
+			Target: EventTarget{
+				Repository: payload.EventData.Repository.RepoFullName,
+				Tag:        resource.Tag,
+				Digest:     resource.Digest,
+				URL:        resource.ResourceURL,
+			},
+			Actor: ActorRecord{Name: payload.Operator},
+		}.registryEvent())
+	}
+	return events, nil
+}
+
+// quayDecoder the repository push notification of Quay, which has the tags but not the digest, e.g.
+//
+//	{"repository": "team/app", "namespace": "team", "name": "app",
+//	 "docker_url": "quay.io/team/app", "updated_tags": ["1.0", "latest"]}
+type quayDecoder struct{}
+
+type quayPayload struct {
+	Repository  string
+	DockerURL   string   `json:"docker_url"`
+	UpdatedTags []string `json:"updated_tags"`
+}
+
+func (quayDecoder) Name() string {
+	return "quay"
+}
+
+func (quayDecoder) Detect(fields map[string]json.RawMessage) bool {
+	return hasFields(fields, "updated_tags", "repository")
+}
+
+func (quayDecoder) Decode(body []byte) ([]RegistryEvent, error) {
+	var payload quayPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	events := make([]RegistryEvent, 0, len(payload.UpdatedTags))
+	for _, tag := range payload.UpdatedTags {
+		events = append(events, Event{
+			Action: "push",
+			Target: EventTarget{Repository: payload.Repository, Tag: tag, URL: payload.DockerURL + ":" + tag},
+		}.registryEvent())
+	}
+	return events, nil
+}
+
+// dockerHubDecoder the webhook payload of Docker Hub, one tag without a digest, e.g.
+//
+//	{"callback_url": "https://registry.hub.docker.com/u/team/app/hook/.../",
+//	 "push_data": {"pushed_at": 1417566161, "pusher": "ci", "tag": "1.0"},
+//	 "repository": {"repo_name": "team/app", "name": "app", "namespace": "team"}}
+type dockerHubDecoder struct{}
+
+type dockerHubPayload struct {
+	PushData struct {
+		PushedAt int64 `json:"pushed_at"`
+		Pusher   string
+		Tag      string
+	} `json:"push_data"`
+	Repository struct {
+		RepoName string `json:"repo_name"`
+	}
+}
+
+func (dockerHubDecoder) Name() string {
+	return "dockerhub"
+}
+
+func (dockerHubDecoder) Detect(fields map[string]json.RawMessage) bool {
+	return hasFields(fields, "push_data", "repository")
+}
+
+func (dockerHubDecoder) Decode(body []byte) ([]RegistryEvent, error) {
+	var payload dockerHubPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, err
+	}
+	repository := payload.Repository.RepoName
+	if repository == "" || payload.PushData.Tag == "" {
+		return nil, fmt.Errorf("push without a repository and tag")
+	}
+	if !strings.Contains(repository, "/") {
+		// official images live in the library namespace
+		repository = "library/" + repository
+	}
+	return []RegistryEvent{Event{
+		Action:    "push",
+		Timestamp: time.Unix(payload.PushData.PushedAt, 0),
+		Target:    EventTarget{Repository: repository, Tag: payload.PushData.Tag},
+		Actor:     ActorRecord{Name: payload.PushData.Pusher},
+	}.registryEvent()}, nil
+}
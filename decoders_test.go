@@ -0,0 +1,155 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+)
+
+// eventsOf the action, target and digest of each event, which is what the formats have in common
+func eventsOf(events []RegistryEvent) []string {
+	summary := make([]string, 0, len(events))
+	for _, evt := range events {
+		summary = append(summary, evt.String())
+	}
+	return summary
+}
+
+func TestPayloadDecoders(t *testing.T) {
+	tests := []struct {
+		fixture string
+		decoder PayloadDecoder
+		want    []string
+		// check what else the format tells us ends up in the notification
+		check func(n *Event) bool
+	}{{
+		"distribution.json",
+		distributionDecoder{},
+		[]string{
+			"push hello-world:latest@sha256:fea8895f450959fa676bcc1df0611ea93823a735a01205fd8622846041d0c7cf",
+			"delete hello-world:@sha256:0a1b2c3d4e5f60718293a4b5c6d7e8f90a1b2c3d4e5f60718293a4b5c6d7e8f9",
+		},
+		func(n *Event) bool { return n.ID != "" && n.Source.InstanceID != "" && !n.Timestamp.IsZero() },
+	}, {
+		// GitLab's registry is docker distribution, the layers pushed being reported as well
+		"gitlab.json",
+		distributionDecoder{},
+		[]string{
+			"push platform/build/app:@sha256:466a35e3983f6754e415e39e04a1cecc941a613d17e29b61d62525a5166ac055",
+			"push platform/build/app:1.4.2@sha256:acf682741df07ac1a017d26e9e71f60916a488157cf1e94d04e70e9a52eb158f",
+			"delete platform/build/app:@sha256:43c85dec0b6cd26b7ee035292e04e11eff38e2c643c22f7b7c30d4ea1b620d3c",
+		},
+		func(n *Event) bool {
+			return n.Actor.Name == "gitlab-ci-token" && n.Request.Host == "registry.gitlab.example.com" && n.Source.InstanceID != ""
+		},
+	}, {
+		"harbor.json",
+		harborDecoder{},
+		[]string{"push library/app:1.0@sha256:954b378c375d852eb3c63ab88978f640b4348b01c1b3456a024a81536dafbbf4"},
+		func(n *Event) bool { return n.Actor.Name == "admin" && n.Timestamp.Unix() == 1680501893 },
+	}, {
+		"quay.json",
+		quayDecoder{},
+		[]string{"push team/app:1.0", "push team/app:latest"},
+		func(n *Event) bool { return strings.HasPrefix(n.Target.URL, "quay.io/team/app:") },
+	}, {
+		"dockerhub.json",
+		dockerHubDecoder{},
+		[]string{"push team/app:1.0"},
+		func(n *Event) bool { return n.Actor.Name == "ci" && n.Timestamp.Unix() == 1417566161 },
+	}}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			body, err := ioutil.ReadFile(filepath.Join("testdata", "notifications", tt.fixture))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, decoder := range []PayloadDecoder{tt.decoder, detectingDecoder(PayloadDecoders)} {
+				events, err := decoder.Decode(body)
+				if err != nil {
+					t.Fatalf("%s Decode() error = %v", decoder.Name(), err)
+				}
+				if got := eventsOf(events); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+					t.Errorf("%s decoded %q, want %q", decoder.Name(), got, tt.want)
+				}
+				for _, evt := range events {
+					if evt.Notification == nil || !tt.check(evt.Notification) {
+						t.Errorf("%s lost what the notification said for %s : %+v", decoder.Name(), evt, evt.Notification)
+					}
+				}
+			}
+		})
+	}
+}
+
+// fixtureFormats the decoder of each fixture not named after its decoder
+var fixtureFormats = map[string]string{"gitlab.json": "distribution"}
+
+func TestPayloadDecodersIgnoreOtherFormats(t *testing.T) {
+	fixtures, _ := filepath.Glob(filepath.Join("testdata", "notifications", "*.json"))
+	formats := make(map[string]string)
+	for _, fixture := range fixtures {
+		format, ok := fixtureFormats[filepath.Base(fixture)]
+		if !ok {
+			format = strings.TrimSuffix(filepath.Base(fixture), ".json")
+		}
+		formats[fixture] = format
+	}
+	for _, decoder := range PayloadDecoders {
+		found := false
+		for _, format := range formats {
+			found = found || format == decoder.Name()
+		}
+		if !found {
+			t.Errorf("no fixture for the %s decoder", decoder.Name())
+		}
+	}
+	for _, fixture := range fixtures {
+		body, _ := ioutil.ReadFile(fixture)
+		for _, decoder := range PayloadDecoders {
+			handler := &RecorderHandler{}
+			w := httptest.NewRecorder()
+			payloadHandler(handler, decoder).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(string(body))))
+			matches := formats[fixture] == decoder.Name()
+			if matches && (w.Code != http.StatusOK || len(handler.events) == 0) {
+				t.Errorf("%s of %s got status %d and events %v", decoder.Name(), fixture, w.Code, handler.events)
+			}
+			// decoding as the wrong format mustn't make up images to copy
+			for _, evt := range handler.events {
+				if !matches && evt.Action == "push" && evt.Target.Repository != "" {
+					t.Errorf("%s made up %s from %s", decoder.Name(), evt, fixture)
+				}
+			}
+		}
+	}
+}
+
+func TestDetectingDecoderUnknownPayload(t *testing.T) {
+	for _, body := range []string{`{"hello": "world"}`, `not json`, `[]`} {
+		w := httptest.NewRecorder()
+		registryEventHandler(&RecorderHandler{}).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s got status %d, want %d", body, w.Code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestDockerHubOfficialImage(t *testing.T) {
+	events, err := dockerHubDecoder{}.Decode([]byte(`{"push_data": {"tag": "3.18"}, "repository": {"repo_name": "alpine"}}`))
+	if err != nil || len(events) != 1 || events[0].Target != (RegistryTarget{"library/alpine", "3.18"}) || events[0].Digest != digest.Digest("") {
+		t.Errorf("got %v error %v, want a push of library/alpine:3.18", events, err)
+	}
+}
+
+func TestDecoderPath(t *testing.T) {
+	for path, want := range map[string]string{"/": "/harbor", "/staging": "/staging/harbor", "/staging/": "/staging/harbor"} {
+		if got := decoderPath(path, harborDecoder{}); got != want {
+			t.Errorf("decoderPath(%s) = %s, want %s", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// EventPolicy how a job acts on the notifications it gets
+type EventPolicy struct {
+	// Deletes is prune, the default, to delete from the targets what is deleted from the
+	// source when pruning is on, or ignore to never delete because of a notification
+	Deletes string
+	// CopyUntagged copies manifests pushed without a tag by their digest, which needs the
+	// registry engine.  Usually they are the platforms of a multi-arch image, copied anyway
+	// when the index is tagged.
+	CopyUntagged bool
+	// DedupeWindow how long events are remembered so repeats of them are dropped, 0 to keep them
+	DedupeWindow time.Duration
+}
+
+// defaultDedupeWindow long enough for a registry retrying a notification, and for the same
+// push being reported more than once
+const defaultDedupeWindow = time.Minute
+
+// validate checks the policy only has values we know about
+func (p EventPolicy) validate() error {
+	switch p.Deletes {
+	case "", "prune", "ignore":
+		return nil
+	}
+	return fmt.Errorf("unknown delete policy %s, expected prune or ignore", p.Deletes)
+}
+
+// eventSummaryInterval how often the counts of events are logged
+const eventSummaryInterval = time.Minute
+
+// EventDispatcher acts on each notification according to its action.  Pushes of a tag, and of
+// untagged manifests if the policy says so, are copied, deletes go by the policy and everything else, like the pulls a registry reports
+// for every image it serves, is dropped without touching the registries.  What happens to
+// the events is counted and logged every so often.  Repeats of an event, with the same id
+// or about the same manifest, are dropped for a while after it.
+type EventDispatcher struct {
+	name    string
+	handler RegistryEventHandler
+	policy  EventPolicy
+	recent  *recentEvents
+
+	mu sync.Mutex
+	// counts by action and outcome since the last summary
+	counts     map[eventOutcome]int
+	lastLogged time.Time
+}
+
+type eventOutcome struct {
+	action, outcome string
+}
+
+// NewEventDispatcher hands the events worth acting on for the job to the handler
+func NewEventDispatcher(name string, handler RegistryEventHandler, policy EventPolicy) *EventDispatcher {
+	return &EventDispatcher{
+		name:       name,
+		handler:    handler,
+		policy:     policy,
+		recent:     &recentEvents{window: policy.DedupeWindow, seen: make(map[string]time.Time)},
+		counts:     make(map[eventOutcome]int),
+		lastLogged: now(),
+	}
+}
+
+// knownActions the actions counted by name, anything else the sender makes up is counted as other
+// so it can't grow the metrics and summaries without end
+var knownActions = map[string]bool{"push": true, "delete": true, "pull": true, "mount": true}
+
+// countedAction the action as it is counted
+func countedAction(action string) string {
+	if knownActions[action] {
+		return action
+	}
+	return "other"
+}
+
+// Handle acts on the event if its action calls for it
+func (d *EventDispatcher) Handle(evt RegistryEvent) error {
+	action := countedAction(evt.Action)
+	eventsReceived.add(1, d.name, action)
+	var err error
+	outcome := d.dispatch(evt, &err)
+	d.count(action, outcome)
+	return err
+}
+
+func (d *EventDispatcher) dispatch(evt RegistryEvent, err *error) string {
+	switch evt.Action {
+	case "push":
+		if evt.Target.Tag == "" && !d.copiesUntagged(evt) {
+			// Usually a platform of a multi-arch image, copied with the index when it is tagged
+			log.Debugf("Ignoring push of %s without a tag", evt.Target.Repository)
+			return "untagged"
+		}
+	case "delete":
+		if d.policy.Deletes == "ignore" {
+			log.Debugf("Ignoring delete of %s:%s", evt.Target.Repository, evt.Target.Tag)
+			return "ignored"
+		}
+	case "pull", "mount":
+		return "ignored"
+	default:
+		log.Debugf("Ignoring %s event for %s:%s", evt.Action, evt.Target.Repository, evt.Target.Tag)
+		return "ignored"
+	}
+	if d.recent.repeat(evt) {
+		log.Debugf("Ignoring repeat of %s", evt)
+		return "duplicate"
+	}
+	if *err = d.handler.Handle(evt); *err != nil {
+		// the registry will send it again, which mustn't count as a repeat
+		d.recent.forget(evt)
+		return "failed"
+	}
+	return "handled"
+}
+
+// copiesUntagged true for a push of a manifest by digest when the policy is to copy those.
+// Pushes of layers don't have a tag either.
+func (d *EventDispatcher) copiesUntagged(evt RegistryEvent) bool {
+	return d.policy.CopyUntagged && evt.Digest != "" && evt.Notification != nil &&
+		isManifest(evt.Notification.Target.MediaType)
+}
+
+// recentEvents what events have been seen lately, to tell when one is a repeat
+type recentEvents struct {
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// keys oldest first with when they were seen, to forget them once they are out of the window.
+	// A key forgotten and seen again is in twice, the entry with the time in seen being the one that counts.
+	keys []seenKey
+}
+
+type seenKey struct {
+	key string
+	at  time.Time
+}
+
+// repeat true if the event has the id of one seen within the window, or is the same action on
+// the same manifest as one was.  Only the first time an event is seen starts the window.
+func (r *recentEvents) repeat(evt RegistryEvent) bool {
+	if r.window <= 0 {
+		return false
+	}
+	keys := eventKeys(evt)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.keys) > 0 && now().Sub(r.keys[0].at) >= r.window {
+		if oldest := r.keys[0]; r.seen[oldest.key] == oldest.at {
+			delete(r.seen, oldest.key)
+		}
+		r.keys = r.keys[1:]
+	}
+	for _, key := range keys {
+		if _, ok := r.seen[key]; ok {
+			return true
+		}
+	}
+	at := now()
+	for _, key := range keys {
+		r.seen[key] = at
+		r.keys = append(r.keys, seenKey{key, at})
+	}
+	return false
+}
+
+// forget the event so it isn't taken as a repeat when it comes again.  Its keys stay in order
+// until they are out of the window, when they are passed over as they aren't seen any more.
+func (r *recentEvents) forget(evt RegistryEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, key := range eventKeys(evt) {
+		delete(r.seen, key)
+	}
+}
+
+// eventKeys what makes two events the same.  Without a digest, like the pushes Quay and Docker Hub
+// report, a tag pushed again straight after isn't the same manifest, so only the id counts.
+func eventKeys(evt RegistryEvent) (keys []string) {
+	if evt.Digest != "" {
+		keys = append(keys, fmt.Sprintf("%s %s:%s@%s", evt.Action, evt.Target.Repository, evt.Target.Tag, evt.Digest))
+	}
+	if evt.Notification != nil && evt.Notification.ID != "" {
+		keys = append(keys, "id "+evt.Notification.ID)
+	}
+	return keys
+}
+
+func (d *EventDispatcher) count(action, outcome string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.counts[eventOutcome{action, outcome}]++
+	if since := now().Sub(d.lastLogged); since >= eventSummaryInterval {
+		log.Infof("Job %s events in the last %s : %s", d.name, since.Round(time.Second), d.summary())
+		d.counts = make(map[eventOutcome]int)
+		d.lastLogged = now()
+	}
+}
+
+// summary the counts like "push handled 3, pull ignored 120", sorted so it reads the same each time
+func (d *EventDispatcher) summary() string {
+	parts := make([]string, 0, len(d.counts))
+	for key, n := range d.counts {
+		parts = append(parts, fmt.Sprintf("%s %s %d", key.action, key.outcome, n))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// erroringRecorder records events, failing them with err when it is set
+type erroringRecorder struct {
+	RecorderHandler
+	err error
+}
+
+func (e *erroringRecorder) Handle(event RegistryEvent) error {
+	e.RecorderHandler.Handle(event)
+	return e.err
+}
+
+func TestEventDispatcher(t *testing.T) {
+	push := RegistryEvent{Action: "push", Target: RegistryTarget{"app", "1.0"}}
+	untagged := RegistryEvent{Action: "push", Target: RegistryTarget{"app", ""}}
+	pull := RegistryEvent{Action: "pull", Target: RegistryTarget{"app", "1.0"}}
+	mount := RegistryEvent{Action: "mount", Target: RegistryTarget{"app", ""}}
+	remove := RegistryEvent{Action: "delete", Target: RegistryTarget{"app", "1.0"}}
+	other := RegistryEvent{Action: "something", Target: RegistryTarget{"app", "1.0"}}
+	byDigest := RegistryEvent{Action: "push", Target: RegistryTarget{"app", ""}, Digest: "sha256:aaaa",
+		Notification: &Event{Target: EventTarget{MediaType: mediaTypeOCIManifest}}}
+	layer := RegistryEvent{Action: "push", Target: RegistryTarget{"app", ""}, Digest: "sha256:bbbb",
+		Notification: &Event{Target: EventTarget{MediaType: "application/octet-stream"}}}
+	tests := []struct {
+		name   string
+		policy EventPolicy
+		events []RegistryEvent
+		want   []RegistryEvent
+	}{
+		{"default", EventPolicy{}, []RegistryEvent{pull, push, untagged, byDigest, mount, remove, other}, []RegistryEvent{push, remove}},
+		{"copy untagged", EventPolicy{CopyUntagged: true}, []RegistryEvent{push, untagged, byDigest, layer}, []RegistryEvent{push, byDigest}},
+		{"prune deletes", EventPolicy{Deletes: "prune"}, []RegistryEvent{remove}, []RegistryEvent{remove}},
+		{"ignore deletes", EventPolicy{Deletes: "ignore"}, []RegistryEvent{push, remove}, []RegistryEvent{push}},
+	}
+	for _, tt := range tests {
+		handler := &RecorderHandler{}
+		d := NewEventDispatcher("job", handler, tt.policy)
+		for _, evt := range tt.events {
+			if err := d.Handle(evt); err != nil {
+				t.Errorf("%s: Handle(%v) error = %v", tt.name, evt, err)
+			}
+		}
+		if !reflect.DeepEqual(handler.events, tt.want) {
+			t.Errorf("%s: handled %v, want %v", tt.name, handler.events, tt.want)
+		}
+	}
+}
+
+func TestEventDispatcherCounts(t *testing.T) {
+	defer func(saved func() time.Time) { now = saved }(now)
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	handler := &erroringRecorder{}
+	d := NewEventDispatcher("job", handler, EventPolicy{})
+	for i := 0; i < 3; i++ {
+		d.Handle(RegistryEvent{Action: "pull", Target: RegistryTarget{"app", "1.0"}})
+	}
+	d.Handle(RegistryEvent{Action: "push", Target: RegistryTarget{"app", "1.0"}})
+	handler.err = errors.New("registry down")
+	if err := d.Handle(RegistryEvent{Action: "push", Target: RegistryTarget{"app", "1.1"}}); err == nil {
+		t.Error("Handle() should give back the error of the handler")
+	}
+	d.Handle(RegistryEvent{Action: "push", Target: RegistryTarget{"app", ""}})
+	if got, want := d.summary(), "pull ignored 3, push failed 1, push handled 1, push untagged 1"; got != want {
+		t.Errorf("summary() = %s, want %s", got, want)
+	}
+	// the counts start again once they are logged
+	now = func() time.Time { return start.Add(eventSummaryInterval) }
+	d.Handle(RegistryEvent{Action: "pull", Target: RegistryTarget{"app", "1.0"}})
+	if got := d.summary(); got != "" {
+		t.Errorf("summary() = %s after logging, want nothing", got)
+	}
+}
+
+func TestEventDispatcherDropsRepeats(t *testing.T) {
+	defer func(saved func() time.Time) { now = saved }(now)
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	now = func() time.Time { return start }
+	notified := func(id, tag, dgst string) RegistryEvent {
+		return RegistryEvent{Action: "push", Target: RegistryTarget{"app", tag}, Digest: digest.Digest(dgst),
+			Notification: &Event{ID: id}}
+	}
+	first := notified("1", "1.0", "sha256:aaaa")
+	handler := &erroringRecorder{}
+	d := NewEventDispatcher("job", handler, EventPolicy{DedupeWindow: time.Minute})
+	d.Handle(first)
+	// the registry sending it again, and the same push reported with a new id
+	d.Handle(notified("1", "1.0", "sha256:aaaa"))
+	d.Handle(notified("2", "1.0", "sha256:aaaa"))
+	// a new manifest for the tag and another tag of the same manifest aren't repeats
+	moved := notified("3", "1.0", "sha256:bbbb")
+	d.Handle(moved)
+	other := notified("4", "latest", "sha256:aaaa")
+	d.Handle(other)
+	if want := []RegistryEvent{first, moved, other}; !reflect.DeepEqual(handler.events, want) {
+		t.Errorf("handled %v, want %v", handler.events, want)
+	}
+	if got, want := d.summary(), "push duplicate 2, push handled 3"; got != want {
+		t.Errorf("summary() = %s, want %s", got, want)
+	}
+	// once the window has passed it is copied again
+	now = func() time.Time { return start.Add(time.Minute) }
+	d.Handle(notified("5", "1.0", "sha256:aaaa"))
+	if len(handler.events) != 4 {
+		t.Errorf("event after the window was dropped, handled %v", handler.events)
+	}
+	// one that couldn't be queued isn't a repeat when the registry sends it again
+	handler.err = errors.New("disk full")
+	failed := notified("6", "2.0", "sha256:cccc")
+	d.Handle(failed)
+	handler.err = nil
+	d.Handle(failed)
+	if got := handler.events[len(handler.events)-1]; !reflect.DeepEqual(got, failed) || len(handler.events) != 6 {
+		t.Errorf("resent event wasn't handled, handled %v", handler.events)
+	}
+}
+
+func TestRecentEventsForget(t *testing.T) {
+	defer func(saved func() time.Time) { now = saved }(now)
+	start := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	at := func(seconds int) { now = func() time.Time { return start.Add(time.Duration(seconds) * time.Second) } }
+	r := &recentEvents{window: time.Minute, seen: make(map[string]time.Time)}
+	push := func(tag, dgst string) RegistryEvent {
+		return RegistryEvent{Action: "push", Target: RegistryTarget{"app", tag}, Digest: digest.Digest(dgst)}
+	}
+	earlier, first, second := push("0.9", "sha256:9999"), push("1.0", "sha256:aaaa"), push("2.0", "sha256:bbbb")
+	at(0)
+	r.repeat(earlier)
+	at(5)
+	r.repeat(first)
+	at(10)
+	r.repeat(second)
+	r.forget(first)
+	at(20)
+	if r.repeat(first) {
+		t.Error("forgotten event taken as a repeat")
+	}
+	// what was kept of the first before it was forgotten doesn't hold up the second going out of the window
+	at(75)
+	if r.repeat(second) {
+		t.Error("event taken as a repeat once out of the window")
+	}
+	if !r.repeat(first) {
+		t.Error("event seen again after being forgotten isn't a repeat within its window")
+	}
+	if len(r.keys) != 2 || len(r.seen) != 2 {
+		t.Errorf("keys %v and seen %v, want one of each event", r.keys, r.seen)
+	}
+}
+
+func TestEventPolicyValidate(t *testing.T) {
+	for deletes, wantErr := range map[string]bool{"": false, "prune": false, "ignore": false, "always": true} {
+		if err := (EventPolicy{Deletes: deletes}).validate(); (err != nil) != wantErr {
+			t.Errorf("validate(%s) error = %v, wantErr %v", deletes, err, wantErr)
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os/exec"
 	"strings"
+	"sync"
 
 	log "github.com/Sirupsen/logrus"
 )
@@ -15,8 +16,8 @@ var DockerHubRegistry = RegistryInfo{}
 // registries.  Note that if there is no address specified in the
 // source it is treated at the docker hub registry
 func NewDockerCLIHandler(source, target RegistryInfo, filter DockerImageFilter) (handler ImageHandler, err error) {
-	s := dockerRegistryCLI{source}
-	t := dockerRegistryCLI{target}
+	s := dockerRegistryCLI{reg: source}
+	t := dockerRegistryCLI{reg: target}
 	err = s.login()
 	if err != nil {
 		return
@@ -33,8 +34,46 @@ func NewDockerCLIHandler(source, target RegistryInfo, filter DockerImageFilter)
 	return
 }
 
+// NewDockerCLIFanOut like NewDockerCLIHandler but for several targets, each image is
+// only pulled once however many targets it is pushed to.  A target we can't log in to
+// yet is logged in to again before pushing so it doesn't stop the others starting.
+func NewDockerCLIFanOut(source RegistryInfo, targets []RegistryInfo, filter DockerImageFilter) (FanOutHandler, error) {
+	s := dockerRegistryCLI{reg: source}
+	if err := s.login(); err != nil {
+		return FanOutHandler{}, err
+	}
+	handlers := make([]ImageHandler, 0, len(targets))
+	for _, target := range targets {
+		t := &dockerRegistryCLI{reg: target}
+		if err := t.login(); err != nil {
+			log.Warnf("Couldn't log in to target %s, will try again when pushing", target.Address())
+			t.loginFailed = true
+		}
+		handlers = append(handlers, ImageHandler{
+			source: regSource{&s, s.reg},
+			tagger: t,
+			target: regTarget{t, t.reg},
+			filter: filter,
+		})
+	}
+	return newFanOutHandler(handlers), nil
+}
+
+// cliError a docker command that failed, with what it said about why
+type cliError struct {
+	err    error
+	output string
+}
+
+func (c cliError) Error() string {
+	return fmt.Sprintf("%s : %s", c.err, strings.TrimSpace(c.output))
+}
+
 type dockerRegistryCLI struct {
 	reg RegistryInfo
+
+	mu          sync.Mutex
+	loginFailed bool
 }
 
 func (d *dockerRegistryCLI) login() error {
@@ -53,6 +92,20 @@ func (d *dockerRegistryCLI) login() error {
 	return nil
 }
 
+// retryLogin logs in again if it failed before
+func (d *dockerRegistryCLI) retryLogin() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.loginFailed {
+		return nil
+	}
+	if err := d.login(); err != nil {
+		return err
+	}
+	d.loginFailed = false
+	return nil
+}
+
 type dockerCli struct {
 	regInfo RegistryInfo
 }
@@ -61,6 +114,9 @@ func (d *dockerRegistryCLI) Push(name string) error {
 
 	log.Debugf(">>Push (%s) to %s", name, d.reg.address)
 	defer log.Debug("<<Pull")
+	if err := d.retryLogin(); err != nil {
+		return err
+	}
 	targetAddr := d.reg.address
 	var remoteName string
 	if strings.Index(name, targetAddr) != 0 {
@@ -70,13 +126,15 @@ func (d *dockerRegistryCLI) Push(name string) error {
 	} else {
 		remoteName = name
 	}
-	pushCmd := exec.Command("docker", "push", remoteName)
-	data, err := pushCmd.CombinedOutput()
-	if err != nil {
-		log.Warnf("Error pushing %s:%s  Output %s", pushCmd.Args, err, string(data))
-		return err
-	}
-	return nil
+	return d.reg.retry.Do("pushing "+remoteName, func() error {
+		pushCmd := exec.Command("docker", "push", remoteName)
+		data, err := pushCmd.CombinedOutput()
+		if err != nil {
+			log.Warnf("Error pushing %s:%s  Output %s", pushCmd.Args, err, string(data))
+			return cliError{err, string(data)}
+		}
+		return nil
+	})
 }
 
 func (d *dockerRegistryCLI) Pull(name string) error {
@@ -90,15 +148,15 @@ func (d *dockerRegistryCLI) Pull(name string) error {
 	} else {
 		remoteName = name
 	}
-	pullCmd := exec.Command("docker", "pull", remoteName)
-	data, err := pullCmd.CombinedOutput()
-	if err != nil {
-		log.Warnf("Error pull %s:%s  Output %s", pullCmd.Args, err, string(data))
-		return err
-	}
-	log.Debugf(">>Pull (%s)", name)
-
-	return nil
+	return d.reg.retry.Do("pulling "+remoteName, func() error {
+		pullCmd := exec.Command("docker", "pull", remoteName)
+		data, err := pullCmd.CombinedOutput()
+		if err != nil {
+			log.Warnf("Error pull %s:%s  Output %s", pullCmd.Args, err, string(data))
+			return cliError{err, string(data)}
+		}
+		return nil
+	})
 }
 
 func (d *dockerRegistryCLI) Tag(name, tag string) error {
@@ -44,7 +44,7 @@ func TestFilteringOfARegistry(t *testing.T) {
 		So(err, ShouldBeNil)
 
 		Convey("We can push images and retrieve", func() {
-			allimageFilter := DockerImageFilter{matchEverything{}, matchEverything{}}
+			allimageFilter := DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}}
 			imageHandler, err := NewDockerCLIHandler(DockerHubRegistry, regInfo, allimageFilter)
 			So(err, ShouldBeNil)
 			err = imageHandler.PullTagPush("alpine", "latest")
@@ -93,7 +93,7 @@ func TestFilteringOfARegistry(t *testing.T) {
 				reg2, err := regInfo2.GetRegistry()
 				So(err, ShouldBeNil)
 				err = Consolidate(reg1, reg2,
-					DockerImageFilter{NewNamespaceFilter("mynamespace"), matchEverything{}}, imageHandler)
+					DockerImageFilter{repoFilter: NewNamespaceFilter("mynamespace"), tagFilter: matchEverything{}}, imageHandler)
 				So(err, ShouldBeNil)
 				matches, err = GetMatchingImages(registry, allimageFilter)
 				So(err, ShouldBeNil)
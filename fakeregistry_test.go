@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+// fakeRegistry an in memory docker registry speaking just enough of the
+// v2 api for the registry copy tests
+type fakeRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	manifests map[string]map[string]fakeManifest
+	blobs     map[string]map[digest.Digest][]byte
+	uploads   int
+	downloads int
+	uploadID  int
+}
+
+type fakeManifest struct {
+	mediaType string
+	payload   []byte
+}
+
+func newFakeRegistry() *fakeRegistry {
+	f := &fakeRegistry{
+		manifests: make(map[string]map[string]fakeManifest),
+		blobs:     make(map[string]map[digest.Digest][]byte),
+	}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	return f
+}
+
+func (f *fakeRegistry) info() RegistryInfo {
+	return RegistryInfo{address: f.URL}
+}
+
+// addBlob stores content in a repository, returning its descriptor
+func (f *fakeRegistry) addBlob(repo string, content []byte, mediaType string) distribution.Descriptor {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dgst := digest.FromBytes(content)
+	if f.blobs[repo] == nil {
+		f.blobs[repo] = make(map[digest.Digest][]byte)
+	}
+	f.blobs[repo][dgst] = content
+	return distribution.Descriptor{MediaType: mediaType, Size: int64(len(content)), Digest: dgst}
+}
+
+// addImage creates a schema2 image whose layers have the given contents
+func (f *fakeRegistry) addImage(repo, tag string, layers ...string) digest.Digest {
+	return f.addImageWithConfig(repo, tag, fmt.Sprintf(`{"image":"%s:%s"}`, repo, tag), layers...)
+}
+
+// addImageWithConfig like addImage with the config blob given
+func (f *fakeRegistry) addImageWithConfig(repo, tag, imageConfig string, layers ...string) digest.Digest {
+	config := f.addBlob(repo, []byte(imageConfig), schema2.MediaTypeConfig)
+	m := schema2.Manifest{Versioned: schema2.SchemaVersion, Config: config}
+	for _, l := range layers {
+		m.Layers = append(m.Layers, f.addBlob(repo, []byte(l), schema2.MediaTypeLayer))
+	}
+	payload, err := json.MarshalIndent(m, "", "   ")
+	if err != nil {
+		panic(err)
+	}
+	return f.addManifest(repo, tag, schema2.MediaTypeManifest, payload)
+}
+
+// addIndex creates a multi-arch image from images already in the repository, keyed by platform
+func (f *fakeRegistry) addIndex(repo, tag, mediaType string, images map[string]digest.Digest) digest.Digest {
+	var platforms []string
+	for platform := range images {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	index := manifestlist.ManifestList{Versioned: manifest.Versioned{SchemaVersion: 2, MediaType: mediaType}}
+	for _, platform := range platforms {
+		p, _ := ParsePlatform(platform)
+		m, _ := f.manifest(repo, images[platform].String())
+		index.Manifests = append(index.Manifests, manifestlist.ManifestDescriptor{
+			Descriptor: distribution.Descriptor{MediaType: m.mediaType, Size: int64(len(m.payload)), Digest: images[platform]},
+			Platform:   manifestlist.PlatformSpec{OS: p.OS, Architecture: p.Architecture, Variant: p.Variant},
+		})
+	}
+	payload, err := json.MarshalIndent(index, "", "   ")
+	if err != nil {
+		panic(err)
+	}
+	return f.addManifest(repo, tag, mediaType, payload)
+}
+
+func (f *fakeRegistry) addManifest(repo, tag, mediaType string, payload []byte) digest.Digest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	dgst := digest.FromBytes(payload)
+	if f.manifests[repo] == nil {
+		f.manifests[repo] = make(map[string]fakeManifest)
+	}
+	m := fakeManifest{mediaType, payload}
+	f.manifests[repo][dgst.String()] = m
+	if tag != "" {
+		f.manifests[repo][tag] = m
+	}
+	return dgst
+}
+
+func (f *fakeRegistry) manifest(repo, ref string) (fakeManifest, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	m, ok := f.manifests[repo][ref]
+	return m, ok
+}
+
+func (f *fakeRegistry) hasBlob(repo string, dgst digest.Digest) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.blobs[repo][dgst]
+	return ok
+}
+
+func (f *fakeRegistry) tags(repo string) []string {
+	tags := []string{}
+	for ref := range f.manifests[repo] {
+		if !strings.Contains(ref, ":") {
+			tags = append(tags, ref)
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (f *fakeRegistry) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := strings.TrimPrefix(r.URL.Path, "/v2/")
+	switch {
+	case path == "":
+		w.WriteHeader(http.StatusOK)
+	case path == "_catalog":
+		repos := []string{}
+		for repo := range f.manifests {
+			if len(f.tags(repo)) > 0 {
+				repos = append(repos, repo)
+			}
+		}
+		sort.Strings(repos)
+		json.NewEncoder(w).Encode(map[string][]string{"repositories": repos})
+	case strings.HasSuffix(path, "/tags/list"):
+		repo := strings.TrimSuffix(path, "/tags/list")
+		json.NewEncoder(w).Encode(map[string]interface{}{"name": repo, "tags": f.tags(repo)})
+	case strings.Contains(path, "/manifests/"):
+		parts := strings.SplitN(path, "/manifests/", 2)
+		f.serveManifest(w, r, parts[0], parts[1])
+	case strings.Contains(path, "/blobs/uploads/"):
+		parts := strings.SplitN(path, "/blobs/uploads/", 2)
+		f.serveUpload(w, r, parts[0], parts[1])
+	case strings.Contains(path, "/blobs/"):
+		parts := strings.SplitN(path, "/blobs/", 2)
+		content, ok := f.blobs[parts[0]][digest.Digest(parts[1])]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		if r.Method == "GET" {
+			f.downloads++
+			w.Write(content)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (f *fakeRegistry) serveManifest(w http.ResponseWriter, r *http.Request, repo, ref string) {
+	switch r.Method {
+	case "GET", "HEAD":
+		m, ok := f.manifests[repo][ref]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.payload).String())
+		if r.Method == "GET" {
+			w.Write(m.payload)
+		}
+	case "PUT":
+		payload, _ := ioutil.ReadAll(r.Body)
+		var versioned manifest.Versioned
+		json.Unmarshal(payload, &versioned)
+		if versioned.MediaType == schema2.MediaTypeManifest {
+			var m schema2.Manifest
+			json.Unmarshal(payload, &m)
+			for _, blob := range append([]distribution.Descriptor{m.Config}, m.Layers...) {
+				if _, ok := f.blobs[repo][blob.Digest]; !ok {
+					http.Error(w, "blob unknown "+blob.Digest.String(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		if isIndex(versioned.MediaType) {
+			var index manifestlist.ManifestList
+			json.Unmarshal(payload, &index)
+			for _, child := range index.Manifests {
+				if _, ok := f.manifests[repo][child.Digest.String()]; !ok {
+					http.Error(w, "manifest unknown "+child.Digest.String(), http.StatusBadRequest)
+					return
+				}
+			}
+		}
+		if f.manifests[repo] == nil {
+			f.manifests[repo] = make(map[string]fakeManifest)
+		}
+		m := fakeManifest{r.Header.Get("Content-Type"), payload}
+		dgst := digest.FromBytes(payload)
+		f.manifests[repo][dgst.String()] = m
+		f.manifests[repo][ref] = m
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	case "DELETE":
+		m, ok := f.manifests[repo][ref]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		for key, other := range f.manifests[repo] {
+			if string(other.payload) == string(m.payload) {
+				delete(f.manifests[repo], key)
+			}
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+func (f *fakeRegistry) serveUpload(w http.ResponseWriter, r *http.Request, repo, id string) {
+	switch r.Method {
+	case "POST":
+		f.uploadID++
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/%d", repo, f.uploadID))
+		w.WriteHeader(http.StatusAccepted)
+	case "PUT":
+		content, _ := ioutil.ReadAll(r.Body)
+		dgst := digest.Digest(r.URL.Query().Get("digest"))
+		if digest.FromBytes(content) != dgst {
+			http.Error(w, "digest invalid", http.StatusBadRequest)
+			return
+		}
+		if f.blobs[repo] == nil {
+			f.blobs[repo] = make(map[digest.Digest][]byte)
+		}
+		f.blobs[repo][dgst] = content
+		f.uploads++
+		w.WriteHeader(http.StatusCreated)
+	}
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/digest"
+)
+
+// FanOutHandler copies images from one source to several targets.  Each image is
+// pulled once and pushed to every target that needs it, with the result for each
+// target tracked separately so one that is down doesn't hold up the others.
+type FanOutHandler struct {
+	// handlers one for each target, all sharing the same source
+	handlers []ImageHandler
+	workers  *Workers
+	status   *fanOutStatus
+	// job the name of the job, for the metrics
+	job string
+	// notifier told how each copy to each target went, nil for no one
+	notifier *Notifier
+	// synced counts the images copied to each target by the sync going on, nil outside of one
+	synced *syncProgress
+}
+
+// TargetStatus how copying to a single target has been going
+type TargetStatus struct {
+	Address     string    `json:"address"`
+	Copied      int       `json:"copied"`
+	Failed      int       `json:"failed"`
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at"`
+}
+
+type fanOutStatus struct {
+	mu      sync.Mutex
+	targets map[string]*TargetStatus
+}
+
+// syncProgress the images copied to each target so far by a sync
+type syncProgress struct {
+	mu     sync.Mutex
+	copied map[string]int
+	// stop closed when the sync is cancelled, nil when it can't be
+	stop <-chan struct{}
+}
+
+// errSyncCancelled what a sync that was cancelled gives back
+var errSyncCancelled = errors.New("sync cancelled")
+
+func (p *syncProgress) record(target string, err error) {
+	if p == nil || err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.copied[target]++
+}
+
+func (p *syncProgress) copiedTo(target string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.copied[target]
+}
+
+// cancelled true once the sync has been told to stop, never outside of a sync
+func (p *syncProgress) cancelled() bool {
+	if p == nil || p.stop == nil {
+		return false
+	}
+	select {
+	case <-p.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// multiPusher pushers that can push the same image to several targets better than one at a time
+type multiPusher interface {
+	PushAll(names []string) map[string]error
+}
+
+// reportingPusher multiPushers that can tell what each push copied
+type reportingPusher interface {
+	PushAllReporting(names []string) (map[string]error, map[string]pushReport)
+}
+
+func newFanOutHandler(handlers []ImageHandler) FanOutHandler {
+	status := &fanOutStatus{targets: make(map[string]*TargetStatus)}
+	for _, h := range handlers {
+		status.targets[h.target.Address()] = &TargetStatus{Address: h.target.Address()}
+	}
+	return FanOutHandler{handlers: handlers, status: status}
+}
+
+// setOptions sets the prune options, naming and workers for every target
+func (f *FanOutHandler) setOptions(prune PruneOptions, mapping ImageMapping, workers *Workers) {
+	f.workers = workers
+	for n := range f.handlers {
+		f.handlers[n].prune = prune
+		f.handlers[n].mapping = mapping
+		f.handlers[n].workers = workers
+	}
+}
+
+// Targets the addresses of the target registries
+func (f FanOutHandler) Targets() []string {
+	addresses := make([]string, 0, len(f.handlers))
+	for _, h := range f.handlers {
+		addresses = append(addresses, h.target.Address())
+	}
+	return addresses
+}
+
+// Status how each target has been doing, in the order they were given
+func (f FanOutHandler) Status() []TargetStatus {
+	f.status.mu.Lock()
+	defer f.status.mu.Unlock()
+	statuses := make([]TargetStatus, 0, len(f.handlers))
+	for _, h := range f.handlers {
+		statuses = append(statuses, *f.status.targets[h.target.Address()])
+	}
+	return statuses
+}
+
+func (s *fanOutStatus) record(target string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := s.targets[target]
+	if err == nil {
+		status.Copied++
+		return
+	}
+	status.Failed++
+	status.LastError = err.Error()
+	status.LastErrorAt = time.Now()
+}
+
+func (f FanOutHandler) Handle(evt RegistryEvent) error {
+	if !evt.pruned() {
+		matches, err := f.handlers[0].filter.matchesEvent(evt, f.handlers[0].source)
+		if err != nil {
+			log.Warnf("Couldn't tell if %s matches : %s", evt, err)
+			return err
+		}
+		if !matches {
+			log.Debugf("Ignoring change  %s", evt)
+			return nil
+		}
+	}
+	if evt.Action == "delete" {
+		return f.deleteAll(evt)
+	}
+	run := func() error {
+		// the sync may have been cancelled while waiting for a worker
+		if f.synced.cancelled() {
+			log.Debugf("Not copying %s, the sync was cancelled", evt)
+			return nil
+		}
+		return f.copy(evt.Target, evt.Digest)
+	}
+	if f.workers != nil {
+		var refs []string
+		for _, h := range f.handlers {
+			refs = append(refs, h.targetRefs(evt)...)
+		}
+		return f.workers.DoAll(f.Targets(), evt.Target, refs, run)
+	}
+	return run()
+}
+
+// HandleAll handles the events in parallel, as far as the workers allow for the busiest target
+func (f FanOutHandler) HandleAll(events []RegistryEvent) error {
+	concurrency := 1
+	if f.workers != nil {
+		concurrency = 0
+		for _, target := range f.Targets() {
+			limit := f.workers.Concurrency(target)
+			if limit > 0 && (concurrency == 0 || limit < concurrency) {
+				concurrency = limit
+			}
+		}
+	}
+	return runAll(f, events, concurrency)
+}
+
+func (f FanOutHandler) deleteAll(evt RegistryEvent) error {
+	failed := make(map[string]error)
+	for _, h := range f.handlers {
+		if err := h.Handle(evt); err != nil {
+			failed[h.target.Address()] = err
+		}
+	}
+	return targetErrors(failed, len(f.handlers))
+}
+
+// copy pulls the image once and pushes it to all the targets at the same time, the manifest
+// with the digest when it is given
+func (f FanOutHandler) copy(image RegistryTarget, dgst digest.Digest) error {
+	log.Infof(">>FanOut(%s) to %v", imageRef(image, dgst), f.Targets())
+	defer log.Infof("<<FanOut")
+	if image.Tag == "" && dgst == "" {
+		log.Warnf("Pushing image %s without specific tag. Using latest", image.Repository)
+		image.Tag = "latest"
+	}
+	start := now()
+	failed := make(map[string]error)
+	// the names pushed to each target and what pushing them copied
+	pushed := make(map[string][]string)
+	reports := make(map[string]pushReport)
+	defer func() {
+		copyDuration.observe(now().Sub(start).Seconds(), f.job)
+		for _, h := range f.handlers {
+			address := h.target.Address()
+			f.status.record(address, failed[address])
+			f.synced.record(address, failed[address])
+			result := f.result(address, imageRef(image, dgst), dgst, start, pushed[address], reports, failed[address])
+			recordCopy(f.job, result)
+			f.notifier.Notify(result)
+		}
+	}()
+	localImgName, err := f.handlers[0].pull(image, dgst)
+	if err != nil {
+		for _, h := range f.handlers {
+			failed[h.target.Address()] = err
+		}
+		return err
+	}
+	// let go of the pulled image when none of the targets could name it
+	defer f.handlers[0].discard(localImgName)
+
+	names := make(map[string]ImageHandler)
+	var remoteNames []string
+	for _, h := range f.handlers {
+		remoteImgNames, err := h.tag(localImgName, image, dgst)
+		if err != nil {
+			failed[h.target.Address()] = err
+			continue
+		}
+		for _, remoteImgName := range remoteImgNames {
+			names[remoteImgName] = h
+			remoteNames = append(remoteNames, remoteImgName)
+		}
+		pushed[h.target.Address()] = remoteImgNames
+	}
+
+	if reporting, ok := f.handlers[0].target.pusher.(reportingPusher); ok {
+		var errs map[string]error
+		errs, reports = reporting.PushAllReporting(remoteNames)
+		for name, err := range errs {
+			failed[names[name].target.Address()] = err
+		}
+	} else if multi, ok := f.handlers[0].target.pusher.(multiPusher); ok {
+		for name, err := range multi.PushAll(remoteNames) {
+			failed[names[name].target.Address()] = err
+		}
+	} else {
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, name := range remoteNames {
+			wg.Add(1)
+			go func(name string) {
+				defer wg.Done()
+				h := names[name]
+				if err := h.push(name); err != nil {
+					mu.Lock()
+					failed[h.target.Address()] = err
+					mu.Unlock()
+				}
+			}(name)
+		}
+		wg.Wait()
+	}
+	return targetErrors(failed, len(f.handlers))
+}
+
+// result how copying the image to the target went, from the reports of pushing its names
+func (f FanOutHandler) result(target, image string, dgst digest.Digest, start time.Time, names []string,
+	reports map[string]pushReport, err error) CopyResult {
+	result := CopyResult{
+		Job:      f.job,
+		Status:   "succeeded",
+		Source:   qualifiedName(f.handlers[0].source.Address(), image),
+		Registry: target,
+		Targets:  names,
+		Digest:   dgst,
+		Duration: now().Sub(start).Seconds(),
+		Time:     now(),
+	}
+	for _, name := range names {
+		report := reports[name]
+		result.Bytes += report.bytes
+		if report.digest != "" {
+			// what is in the target, which differs from the source when leaving out platforms
+			result.Digest = report.digest
+		}
+	}
+	if err != nil {
+		result.Status = "failed"
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// RSync brings every target in line with the source.  Each image is only pulled once for all the
+// targets missing it and a target that can't be reached is skipped rather than stopping the rest.
+// How long it took, what is still missing from each target and when it last worked are kept in the metrics.
+func (f FanOutHandler) RSync(filter DockerImageFilter) error {
+	return f.RSyncUntil(filter, nil)
+}
+
+// RSyncUntil like RSync but stops once stop is closed.  Copies already started are finished, the
+// rest of the images are left for the next sync and nothing is pruned.
+func (f FanOutHandler) RSyncUntil(filter DockerImageFilter, stop <-chan struct{}) (err error) {
+	start := now()
+	defer func() {
+		consolidateDuration.observe(now().Sub(start).Seconds(), f.job)
+		if err == nil {
+			lastSuccess.set(float64(now().Unix()), f.job)
+		}
+	}()
+	s, err := f.handlers[0].source.GetRegistry()
+	if err != nil {
+		log.Errorf("Couldn't connec to registry %s : %s", f.handlers[0].source.Address(), err)
+		return err
+	}
+	failed := make(map[string]error)
+	plans := make([]*SyncPlan, len(f.handlers))
+	// the targets needing each image, images in the order they were found
+	var images []RegistryTarget
+	needs := make(map[RegistryTarget][]int)
+	for n, h := range f.handlers {
+		t, err := h.target.GetRegistry()
+		if err == nil {
+			var plan SyncPlan
+			plan, err = Diff(s, t, filter, h.mapping, h.prune.Enabled)
+			plans[n] = &plan
+		}
+		if err != nil {
+			log.Errorf("Skipping target %s : %s", h.target.Address(), err)
+			failed[h.target.Address()] = err
+			f.status.record(h.target.Address(), err)
+			plans[n] = nil
+			continue
+		}
+		for _, evt := range copyEvents(*plans[n]) {
+			if _, ok := needs[evt.Target]; !ok {
+				images = append(images, evt.Target)
+			}
+			needs[evt.Target] = append(needs[evt.Target], n)
+		}
+	}
+
+	// Images needed by the same targets are copied together
+	groups := make(map[string][]RegistryEvent)
+	var keys []string
+	for _, image := range images {
+		key := fmt.Sprint(needs[image])
+		if _, ok := groups[key]; !ok {
+			keys = append(keys, key)
+		}
+		groups[key] = append(groups[key], RegistryEvent{Action: "missing", Target: image})
+	}
+	var copyErr error
+	synced := &syncProgress{copied: make(map[string]int), stop: stop}
+	for _, key := range keys {
+		if synced.cancelled() {
+			break
+		}
+		events := groups[key]
+		subset := f.subset(needs[events[0].Target])
+		subset.synced = synced
+		if err := subset.HandleAll(events); err != nil {
+			log.Errorf("Couldn't copy everything from %s : %s", f.handlers[0].source.Address(), err)
+			copyErr = err
+		}
+	}
+	for n, h := range f.handlers {
+		if plans[n] != nil {
+			missing := len(plans[n].Missing) + len(plans[n].Outdated) - synced.copiedTo(h.target.Address())
+			imagesMissing.set(float64(missing), f.job, h.target.Address())
+		}
+	}
+	if synced.cancelled() {
+		log.Warnf("Sync of %s to %v cancelled", f.handlers[0].source.Address(), f.Targets())
+		f.logStatus()
+		return errSyncCancelled
+	}
+
+	for n, h := range f.handlers {
+		if plans[n] == nil || !h.prune.Enabled {
+			continue
+		}
+		t, _ := h.target.GetRegistry()
+		if err := pruneExtra(h, *plans[n], h.prune, t); err != nil {
+			log.Errorf("Couldn't delete everything from %s : %s", h.target.Address(), err)
+			failed[h.target.Address()] = err
+		}
+	}
+	f.logStatus()
+	if len(failed) == 0 {
+		return copyErr
+	}
+	return targetErrors(failed, len(f.handlers))
+}
+
+// subset a handler for just some of the targets, sharing the status with this one
+func (f FanOutHandler) subset(targets []int) FanOutHandler {
+	handlers := make([]ImageHandler, 0, len(targets))
+	for _, n := range targets {
+		handlers = append(handlers, f.handlers[n])
+	}
+	return FanOutHandler{handlers: handlers, workers: f.workers, status: f.status, job: f.job, notifier: f.notifier}
+}
+
+func (f FanOutHandler) logStatus() {
+	for _, status := range f.Status() {
+		if status.LastError != "" {
+			log.Infof("Target %s: %d copied, %d failed, last error at %s : %s", status.Address, status.Copied,
+				status.Failed, status.LastErrorAt.Format(time.RFC3339), status.LastError)
+		} else {
+			log.Infof("Target %s: %d copied, %d failed", status.Address, status.Copied, status.Failed)
+		}
+	}
+}
+
+// targetErrors combines the errors from the targets that failed into one, permanent when
+// none of them is worth retrying
+func targetErrors(failed map[string]error, total int) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	targets := make([]string, 0, len(failed))
+	for target := range failed {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+	reasons := make([]string, 0, len(targets))
+	for _, target := range targets {
+		reasons = append(reasons, fmt.Sprintf("%s: %s", target, failed[target]))
+	}
+	err := fmt.Errorf("%d of %d targets failed (%s)", len(failed), total, strings.Join(reasons, "; "))
+	for _, target := range targets {
+		if isRetryable(failed[target]) {
+			return err
+		}
+	}
+	// trying again would only fail the same way
+	return permanent(err)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestFanOutCopiesOnce(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	eu := newFakeRegistry()
+	defer eu.Close()
+	us := newFakeRegistry()
+	defer us.Close()
+	source.addImage("team/app", "1.0", "base", "app")
+	// eu already has the base layer so only us needs it
+	eu.addBlob("team/app", []byte("base"), "")
+
+	handler, err := NewRegistryCopyFanOut(source.info(), []RegistryInfo{eu.info(), us.info()},
+		DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyFanOut() error = %v", err)
+	}
+	if err = handler.Handle(RegistryEvent{Action: "push", Target: RegistryTarget{"team/app", "1.0"}}); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	for name, target := range map[string]*fakeRegistry{"eu": eu, "us": us} {
+		if _, ok := target.manifest("team/app", "1.0"); !ok {
+			t.Errorf("image not copied to %s", name)
+		}
+	}
+	if source.downloads != 3 {
+		t.Errorf("expected each of the 3 blobs to be downloaded once, got %d downloads", source.downloads)
+	}
+	if eu.uploads != 2 || us.uploads != 3 {
+		t.Errorf("uploads eu = %d, us = %d want 2 and 3", eu.uploads, us.uploads)
+	}
+	for _, status := range handler.Status() {
+		if status.Copied != 1 || status.Failed != 0 {
+			t.Errorf("status = %+v, want one copy", status)
+		}
+	}
+}
+
+func TestFanOutUnreachableTarget(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	eu := newFakeRegistry()
+	defer eu.Close()
+	down := newFakeRegistry()
+	down.Close()
+	source.addImage("team/app", "1.0", "base")
+	source.addImage("team/app", "2.0", "base")
+	eu.addImage("team/app", "1.0", "base")
+
+	handler, err := NewRegistryCopyFanOut(source.info(), []RegistryInfo{down.info(), eu.info()},
+		DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyFanOut() error = %v", err)
+	}
+	err = handler.RSync(DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err == nil || !strings.Contains(err.Error(), "1 of 2 targets failed") {
+		t.Errorf("RSync() error = %v, want the unreachable target reported", err)
+	}
+	if _, ok := eu.manifest("team/app", "2.0"); !ok {
+		t.Error("image not copied to the reachable target")
+	}
+	status := handler.Status()
+	if status[0].Failed != 1 || status[0].LastError == "" {
+		t.Errorf("unreachable target status = %+v", status[0])
+	}
+	if status[1].Copied != 1 || status[1].Failed != 0 {
+		t.Errorf("reachable target status = %+v", status[1])
+	}
+}
+
+// recordingPusher remembers what was pushed, failing for names with the prefix
+type recordingPusher struct {
+	failPrefix string
+	pushed     *[]string
+}
+
+func (r recordingPusher) Push(name string) error {
+	if strings.HasPrefix(name, r.failPrefix) {
+		return errors.New("push failed")
+	}
+	*r.pushed = append(*r.pushed, name)
+	return nil
+}
+
+func TestFanOutPullsOnce(t *testing.T) {
+	pulls := 0
+	var pushed []string
+	pusher := recordingPusher{"bad/", &pushed}
+	var handlers []ImageHandler
+	for _, address := range []string{"good", "bad"} {
+		handlers = append(handlers, ImageHandler{
+			source: regSource{countingPuller{&pulls}, RegistryInfo{}},
+			tagger: noopTagger{},
+			target: regTarget{pusher, RegistryInfo{address: address}},
+			filter: DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}},
+		})
+	}
+	handler := newFanOutHandler(handlers)
+	handler.setOptions(PruneOptions{}, ImageMapping{}, NewWorkers(1, 1))
+
+	err := handler.Handle(RegistryEvent{Action: "push", Target: RegistryTarget{"team/app", "1.0"}})
+	if err == nil || !strings.Contains(err.Error(), "bad: push failed") {
+		t.Errorf("Handle() error = %v, want the bad target to fail", err)
+	}
+	if pulls != 1 {
+		t.Errorf("pulled %d times, want 1", pulls)
+	}
+	if len(pushed) != 1 || pushed[0] != "good/team/app:1.0" {
+		t.Errorf("pushed %v", pushed)
+	}
+}
+
+type countingPuller struct {
+	pulls *int
+}
+
+func (c countingPuller) Pull(name string) error {
+	*c.pulls++
+	return nil
+}
+
+type noopTagger struct{}
+
+func (noopTagger) Tag(name, tag string) error {
+	return nil
+}
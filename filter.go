@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// FilterOptions which repositories and tags a job copies.  Each option given narrows it down further.
+type FilterOptions struct {
+	// Namespaces the first part of the repository names to match, blank for all
+	Namespaces []string
+	// NamespaceRegex regular expression of repositories to match
+	NamespaceRegex string `mapstructure:"namespace-regex"`
+	TagRegex       string `mapstructure:"tag-regex"`
+	// Semver range of versions to match, see SemverFilter
+	Semver string
+	// Newest only the highest few versions in each repository, 0 for all
+	Newest int
+	// Include images have to match one of these patterns, when there are any
+	Include PatternLists
+	// Exclude images matching any of these patterns, even if included
+	Exclude PatternLists
+	// Labels the image config has to match, see ParseLabelMatcher
+	Labels []string
+	// MaxAge the oldest an image can be, like 720h or 30d
+	MaxAge string `mapstructure:"max-age"`
+	// CreatedAfter and CreatedBefore bound when images were created, as 2006-01-02 or in RFC 3339 format
+	CreatedAfter  string `mapstructure:"created-after"`
+	CreatedBefore string `mapstructure:"created-before"`
+}
+
+// PatternLists patterns for repositories and tags, see ParsePattern
+type PatternLists struct {
+	Repositories []string
+	Tags         []string
+}
+
+// newImageFilter builds the filter for the options
+func newImageFilter(options FilterOptions) (DockerImageFilter, error) {
+	var repoFilters []Filter
+	if len(options.Namespaces) > 0 {
+		repoFilters = append(repoFilters, NewNamespaceFilter(options.Namespaces...))
+	}
+	if options.NamespaceRegex != "" {
+		namespaceFilter, err := NewRegexTagFilter(options.NamespaceRegex)
+		if err != nil {
+			log.Errorf("Can't create filter from bad regular expression %s", options.NamespaceRegex)
+			return DockerImageFilter{}, err
+		}
+		repoFilters = append(repoFilters, namespaceFilter)
+	}
+	repoFilters, err := appendPatterns(repoFilters, options.Include.Repositories, options.Exclude.Repositories)
+	if err != nil {
+		return DockerImageFilter{}, err
+	}
+
+	tagRegexp := options.TagRegex
+	if tagRegexp == "" {
+		tagRegexp = ".*"
+	}
+	tagFilter, err := NewRegexTagFilter(tagRegexp)
+	if err != nil {
+		log.Errorf("Can't create filter from bad regular expression %s", tagRegexp)
+		return DockerImageFilter{}, err
+	}
+	tagFilters := []Filter{tagFilter}
+	if options.Semver != "" {
+		semver, err := NewSemverFilter(options.Semver)
+		if err != nil {
+			log.Error(err)
+			return DockerImageFilter{}, err
+		}
+		tagFilters = append(tagFilters, semver)
+	}
+	tagFilters, err = appendPatterns(tagFilters, options.Include.Tags, options.Exclude.Tags)
+	if err != nil {
+		return DockerImageFilter{}, err
+	}
+	filter := DockerImageFilter{repoFilter: And(repoFilters...), tagFilter: And(tagFilters...)}
+	if options.Newest > 0 {
+		filter.tagFilter = NewNewestFilter(options.Newest, filter.tagFilter)
+	}
+	filter.metadata, err = options.metadataFilter()
+	return filter, err
+}
+
+// metadataFilter nil unless there are options that need the image configs
+func (options FilterOptions) metadataFilter() (*MetadataFilter, error) {
+	if len(options.Labels) == 0 && options.MaxAge == "" && options.CreatedAfter == "" && options.CreatedBefore == "" {
+		return nil, nil
+	}
+	var labels []LabelMatcher
+	for _, text := range options.Labels {
+		label, err := ParseLabelMatcher(text)
+		if err != nil {
+			return nil, err
+		}
+		labels = append(labels, label)
+	}
+	var maxAge time.Duration
+	var after, before time.Time
+	var err error
+	if options.MaxAge != "" {
+		if maxAge, err = parseAge(options.MaxAge); err != nil {
+			return nil, fmt.Errorf("bad max age %s : %s", options.MaxAge, err)
+		}
+	}
+	if options.CreatedAfter != "" {
+		if after, err = parseDate(options.CreatedAfter); err != nil {
+			return nil, fmt.Errorf("bad created after date %s : %s", options.CreatedAfter, err)
+		}
+	}
+	if options.CreatedBefore != "" {
+		if before, err = parseDate(options.CreatedBefore); err != nil {
+			return nil, fmt.Errorf("bad created before date %s : %s", options.CreatedBefore, err)
+		}
+	}
+	return NewMetadataFilter(labels, maxAge, after, before), nil
+}
+
+// appendPatterns adds a filter for matching any of the included patterns and one for
+// not matching any of the excluded ones
+func appendPatterns(filters []Filter, include, exclude []string) ([]Filter, error) {
+	if len(include) > 0 {
+		f, err := parsePatterns(include)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, Or(f...))
+	}
+	if len(exclude) > 0 {
+		f, err := parsePatterns(exclude)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, Not(Or(f...)))
+	}
+	return filters, nil
+}
+
+func parsePatterns(patterns []string) ([]Filter, error) {
+	filters := make([]Filter, 0, len(patterns))
+	for _, pattern := range patterns {
+		f, err := ParsePattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filters = append(filters, f)
+	}
+	return filters, nil
+}
+
+// ParsePattern reads a glob like prod/** or *-debug, or a regular expression written as regex:<expression>.
+// A glob can also be written as glob:<pattern>.
+func ParsePattern(pattern string) (Filter, error) {
+	switch {
+	case strings.HasPrefix(pattern, "regex:"):
+		f, err := NewRegexTagFilter(strings.TrimPrefix(pattern, "regex:"))
+		if err != nil {
+			return nil, fmt.Errorf("bad regular expression in pattern %s : %s", pattern, err)
+		}
+		return f, nil
+	case strings.HasPrefix(pattern, "glob:"):
+		pattern = strings.TrimPrefix(pattern, "glob:")
+	}
+	f, err := NewGlobFilter(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("bad glob %s : %s", pattern, err)
+	}
+	return f, nil
+}
+
+// GlobFilter matches the whole of a name against a shell like pattern.  * matches anything
+// but a /, ** matches anything at all, ? matches a single character besides / and [a-z]
+// matches a character from a set.
+type GlobFilter struct {
+	pattern *regexp.Regexp
+}
+
+// NewGlobFilter e.g. prod/* for the repositories directly in prod or prod/** for all below it
+func NewGlobFilter(glob string) (*GlobFilter, error) {
+	var expr bytes.Buffer
+	expr.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				expr.WriteString(".*")
+				i++
+			} else {
+				expr.WriteString("[^/]*")
+			}
+		case '?':
+			expr.WriteString("[^/]")
+		case '[':
+			end := strings.Index(glob[i:], "]")
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in %s", glob)
+			}
+			set := glob[i+1 : i+end]
+			if strings.HasPrefix(set, "!") {
+				set = "^" + set[1:]
+			}
+			expr.WriteString("[" + strings.Replace(set, `\`, `\\`, -1) + "]")
+			i += end
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	pattern, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, err
+	}
+	return &GlobFilter{pattern}, nil
+}
+
+// Matches true if the whole name matches the glob
+func (g *GlobFilter) Matches(name string) bool {
+	return g.pattern.MatchString(name)
+}
+
+type allOf []Filter
+
+func (a allOf) Matches(str string) bool {
+	for _, f := range a {
+		if !f.Matches(str) {
+			return false
+		}
+	}
+	return true
+}
+
+type anyOf []Filter
+
+func (a anyOf) Matches(str string) bool {
+	for _, f := range a {
+		if f.Matches(str) {
+			return true
+		}
+	}
+	return false
+}
+
+type not struct {
+	Filter
+}
+
+func (n not) Matches(str string) bool {
+	return !n.Filter.Matches(str)
+}
+
+// And matches what every one of the filters does, with none it matches everything
+func And(filters ...Filter) Filter {
+	switch len(filters) {
+	case 0:
+		return matchEverything{}
+	case 1:
+		return filters[0]
+	}
+	return allOf(filters)
+}
+
+// Or matches what any of the filters does, with none it matches nothing
+func Or(filters ...Filter) Filter {
+	if len(filters) == 1 {
+		return filters[0]
+	}
+	return anyOf(filters)
+}
+
+// Not matches what the filter doesn't
+func Not(filter Filter) Filter {
+	return not{filter}
+}
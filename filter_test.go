@@ -0,0 +1,119 @@
+package main
+
+import "testing"
+
+func TestGlobFilter(t *testing.T) {
+	tests := []struct {
+		glob       string
+		matches    []string
+		notMatches []string
+	}{
+		{"prod/*", []string{"prod/app", "prod/"}, []string{"prod/team/app", "staging/prod/app", "prod"}},
+		{"prod/**", []string{"prod/app", "prod/team/app"}, []string{"production/app"}},
+		{"*-debug", []string{"1.0-debug"}, []string{"1.0-debug2", "debug"}},
+		{"1.?", []string{"1.0", "1.9"}, []string{"1.10", "1."}},
+		{"v[0-9].*", []string{"v1.0"}, []string{"va.0"}},
+		{"[!a-z]*", []string{"1.0"}, []string{"latest"}},
+		{"a.b+c", []string{"a.b+c"}, []string{"aXb+c", "a.bbc"}},
+	}
+	for _, tt := range tests {
+		f, err := NewGlobFilter(tt.glob)
+		if err != nil {
+			t.Errorf("NewGlobFilter(%s) error = %v", tt.glob, err)
+			continue
+		}
+		for _, name := range tt.matches {
+			if !f.Matches(name) {
+				t.Errorf("%s should match %s", tt.glob, name)
+			}
+		}
+		for _, name := range tt.notMatches {
+			if f.Matches(name) {
+				t.Errorf("%s shouldn't match %s", tt.glob, name)
+			}
+		}
+	}
+	if _, err := NewGlobFilter("v[0-9"); err == nil {
+		t.Error("NewGlobFilter with an unclosed [ should fail")
+	}
+}
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		name    string
+		want    bool
+		wantErr bool
+	}{
+		{"prod/*", "prod/app", true, false},
+		{"glob:prod/*", "prod/app", true, false},
+		{"regex:^prod/", "prod/team/app", true, false},
+		{"regex:debug", "1.0-debug-2", true, false},
+		{"regex:(", "", false, true},
+		{"[a-", "", false, true},
+	}
+	for _, tt := range tests {
+		f, err := ParsePattern(tt.pattern)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParsePattern(%s) error = %v, wantErr %v", tt.pattern, err, tt.wantErr)
+			continue
+		}
+		if err == nil && f.Matches(tt.name) != tt.want {
+			t.Errorf("%s matches %s = %v, want %v", tt.pattern, tt.name, !tt.want, tt.want)
+		}
+	}
+}
+
+func TestCombinedFilters(t *testing.T) {
+	prod, _ := NewGlobFilter("prod/**")
+	experimental, _ := NewGlobFilter("prod/experimental/*")
+	staging, _ := NewGlobFilter("staging/*")
+	tests := []struct {
+		name   string
+		filter Filter
+		want   map[string]bool
+	}{
+		{"and", And(prod, Not(experimental)),
+			map[string]bool{"prod/app": true, "prod/experimental/app": false, "staging/app": false}},
+		{"or", Or(prod, staging),
+			map[string]bool{"prod/app": true, "staging/app": true, "dev/app": false}},
+		{"empty and", And(), map[string]bool{"anything": true}},
+		{"empty or", Or(), map[string]bool{"anything": false}},
+	}
+	for _, tt := range tests {
+		for name, want := range tt.want {
+			if got := tt.filter.Matches(name); got != want {
+				t.Errorf("%s: Matches(%s) = %v, want %v", tt.name, name, got, want)
+			}
+		}
+	}
+}
+
+func TestNewImageFilter(t *testing.T) {
+	filter, err := newImageFilter(FilterOptions{
+		Namespaces: []string{"prod", "staging"},
+		TagRegex:   `^\d`,
+		Semver:     ">=1.0",
+		Newest:     1,
+		Exclude:    PatternLists{Repositories: []string{"staging/tmp-*"}, Tags: []string{"*-debug"}},
+	})
+	if err != nil {
+		t.Fatalf("newImageFilter() error = %v", err)
+	}
+	for repository, want := range map[string]bool{"prod/app": true, "staging/app": true, "staging/tmp-1": false, "dev/app": false} {
+		if got := filter.repoFilter.Matches(repository); got != want {
+			t.Errorf("repository %s matches = %v, want %v", repository, got, want)
+		}
+	}
+	newest := filter.tagFilter.(TagListFilter).FilterTags("prod/app", []string{"0.9", "1.1", "1.2-debug", "latest"})
+	if len(newest) != 1 || newest[0] != "1.1" {
+		t.Errorf("newest tags = %v, want [1.1]", newest)
+	}
+
+	for _, options := range []FilterOptions{{NamespaceRegex: "("}, {TagRegex: "("}, {Semver: "<*"},
+		{Include: PatternLists{Tags: []string{"regex:("}}}} {
+		if _, err := newImageFilter(options); err == nil {
+			t.Errorf("newImageFilter(%+v) should fail", options)
+		}
+	}
+}
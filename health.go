@@ -0,0 +1,209 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// defaultStallTimeout how long copying or polling may go without getting anywhere before
+// we are taken to be stuck, unless told otherwise
+const defaultStallTimeout = time.Hour
+
+// where the liveness and readiness checks are served
+const (
+	livenessPath  = "/healthz"
+	readinessPath = "/readyz"
+)
+
+// pingTimeout how long a registry has to answer when checking we are ready
+const pingTimeout = 5 * time.Second
+
+// healthChecks what /healthz and /readyz look at
+type healthChecks struct {
+	servers []server
+	workers *Workers
+	// stall how long work may go without getting anywhere
+	stall time.Duration
+}
+
+// Liveness whether the poll loops, queues and copies are getting anywhere, as /healthz shows it
+type Liveness struct {
+	Healthy bool          `json:"healthy"`
+	Workers WorkerHealth  `json:"workers"`
+	Jobs    []JobLiveness `json:"jobs"`
+}
+
+// WorkerHealth how the copies shared by all the jobs are getting on
+type WorkerHealth struct {
+	OK bool `json:"ok"`
+	WorkerProgress
+}
+
+// JobLiveness how a job is getting on, with how copying to each target has gone
+type JobLiveness struct {
+	Job     string         `json:"job"`
+	OK      bool           `json:"ok"`
+	Poll    PollHealth     `json:"poll"`
+	Queue   QueueHealth    `json:"queue"`
+	Targets []TargetStatus `json:"targets"`
+}
+
+// PollHealth the poll loop of a job, always ok when it doesn't poll
+type PollHealth struct {
+	OK        bool      `json:"ok"`
+	Every     string    `json:"every,omitempty"`
+	Running   bool      `json:"running"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// QueueHealth the notifications of a job waiting to be copied
+type QueueHealth struct {
+	OK         bool      `json:"ok"`
+	Pending    int       `json:"pending"`
+	Progressed time.Time `json:"progressed"`
+}
+
+// Readiness whether every registry answers with our credentials, as /readyz shows it
+type Readiness struct {
+	Ready      bool             `json:"ready"`
+	Registries []RegistryHealth `json:"registries"`
+}
+
+// RegistryHealth whether a registry of a job answered
+type RegistryHealth struct {
+	Job     string  `json:"job"`
+	Role    string  `json:"role"`
+	Address string  `json:"address"`
+	OK      bool    `json:"ok"`
+	Error   string  `json:"error,omitempty"`
+	Seconds float64 `json:"seconds"`
+}
+
+// liveness serves /healthz, failing with a 503 when something is stuck so it gets restarted
+func (h healthChecks) liveness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		live := h.live()
+		status := http.StatusOK
+		if !live.Healthy {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, live)
+	}
+}
+
+// readiness serves /readyz, failing with a 503 when a registry can't be used
+func (h healthChecks) readiness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ready := h.ready()
+		status := http.StatusOK
+		if !ready.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, ready)
+	}
+}
+
+// stuck true when there is work that hasn't got anywhere since progressed
+func (h healthChecks) stuck(busy bool, progressed time.Time) bool {
+	return busy && now().Sub(progressed) > h.stall
+}
+
+func (h healthChecks) live() Liveness {
+	progress := h.workers.Progress()
+	live := Liveness{
+		Workers: WorkerHealth{!h.stuck(progress.Busy+progress.Waiting > 0, progress.Progressed), progress},
+		Jobs:    make([]JobLiveness, 0, len(h.servers)),
+	}
+	live.Healthy = live.Workers.OK
+	for _, s := range h.servers {
+		job := JobLiveness{Job: s.name, Poll: s.pollHealth(h.stall), Targets: s.handler.Status()}
+		job.Queue.Pending, job.Queue.Progressed = s.queue.Progress()
+		job.Queue.OK = !h.stuck(job.Queue.Pending > 0, job.Queue.Progressed)
+		job.OK = job.Poll.OK && job.Queue.OK
+		live.Healthy = live.Healthy && job.OK
+		live.Jobs = append(live.Jobs, job)
+	}
+	return live
+}
+
+// pollHealth the poll loop is stuck when it hasn't started a sync for a poll and the stall timeout,
+// which covers a sync taking too long as well as the loop not running
+func (s server) pollHealth(stall time.Duration) PollHealth {
+	if s.frequency <= 0 {
+		return PollHealth{OK: true}
+	}
+	run := s.syncs.last()
+	health := PollHealth{
+		Every:     s.frequency.String(),
+		Running:   run.Running,
+		Started:   run.Started,
+		Finished:  run.Finished,
+		LastError: run.LastError,
+	}
+	last := run.Started
+	if last.IsZero() {
+		last = s.syncs.since
+	}
+	health.OK = now().Sub(last) <= s.frequency+stall
+	return health
+}
+
+// ready pings the source and targets of every job at the same time
+func (h healthChecks) ready() Readiness {
+	var registries []RegistryHealth
+	var infos []RegistryInfo
+	for _, s := range h.servers {
+		registries = append(registries, RegistryHealth{Job: s.name, Role: "source", Address: s.source.URL()})
+		infos = append(infos, s.source)
+		for _, target := range s.targets {
+			registries = append(registries, RegistryHealth{Job: s.name, Role: "target", Address: target.URL()})
+			infos = append(infos, target)
+		}
+	}
+	var wg sync.WaitGroup
+	for n := range registries {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			start := now()
+			err := infos[n].ping()
+			registries[n].Seconds = now().Sub(start).Seconds()
+			registries[n].OK = err == nil
+			if err != nil {
+				registries[n].Error = err.Error()
+			}
+		}(n)
+	}
+	wg.Wait()
+	ready := Readiness{Ready: true, Registries: registries}
+	for _, r := range registries {
+		ready.Ready = ready.Ready && r.OK
+	}
+	return ready
+}
+
+// ping checks the registry answers and takes our credentials, without the logging of connecting
+func (r RegistryInfo) ping() error {
+	url := strings.TrimSuffix(r.URL(), "/")
+	// a new client each time, so a registry that is back is seen straight away
+	transport := &http.Transport{Proxy: http.ProxyFromEnvironment, DisableKeepAlives: true}
+	if r.isInsecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	reg := &registry.Registry{
+		URL: url,
+		Client: &http.Client{
+			Transport: registry.WrapTransport(transport, url, r.username, r.password),
+			Timeout:   pingTimeout,
+		},
+		Logf: registry.Quiet,
+	}
+	return reg.Ping()
+}
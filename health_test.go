@@ -0,0 +1,107 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// healthOf fetches the handler, decoding the body into value and giving back the status
+func healthOf(t *testing.T, handler http.HandlerFunc, value interface{}) int {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), value); err != nil {
+		t.Fatalf("body %s : %s", w.Body.String(), err)
+	}
+	return w.Code
+}
+
+// testServer a job with just what the health checks look at
+func testServer(t *testing.T, name string, frequency time.Duration, source RegistryInfo, targets ...RegistryInfo) server {
+	queue, err := NewEventQueue(name, &RecorderHandler{}, QueueOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server{name: name, source: source, targets: targets, handler: newFanOutHandler(nil), queue: queue,
+		frequency: frequency, syncs: &syncStatus{since: now()}}
+}
+
+func TestReadiness(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	private := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "promoter" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer private.Close()
+	good := RegistryInfo{address: private.URL, username: "promoter", password: "secret"}
+	bad := RegistryInfo{address: private.URL, username: "promoter", password: "wrong"}
+
+	checks := healthChecks{servers: []server{testServer(t, "good", 0, source.info(), good)}, workers: NewWorkers(1, 0)}
+	var ready Readiness
+	if status := healthOf(t, checks.readiness(), &ready); status != http.StatusOK || !ready.Ready || len(ready.Registries) != 2 {
+		t.Errorf("got %d %+v, want ready", status, ready)
+	}
+
+	checks.servers = append(checks.servers, testServer(t, "bad", 0, source.info(), good, bad))
+	ready = Readiness{}
+	if status := healthOf(t, checks.readiness(), &ready); status != http.StatusServiceUnavailable || ready.Ready {
+		t.Errorf("got %d %+v, want not ready with the wrong password", status, ready)
+	}
+	if len(ready.Registries) != 5 {
+		t.Fatalf("registries = %+v, want the source and targets of both jobs", ready.Registries)
+	}
+	for n, want := range []bool{true, true, true, true, false} {
+		if r := ready.Registries[n]; r.OK != want || (r.Error == "") != want {
+			t.Errorf("registry %d = %+v, want ok %v", n, r, want)
+		}
+	}
+	if r := ready.Registries[4]; r.Job != "bad" || r.Role != "target" || r.Address != private.URL {
+		t.Errorf("failed registry = %+v", r)
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	stall := 20 * time.Millisecond
+	workers := NewWorkers(1, 0)
+	polling := testServer(t, "polling", 10*time.Millisecond, RegistryInfo{})
+	notified := testServer(t, "notified", 0, RegistryInfo{})
+	checks := healthChecks{servers: []server{polling, notified}, workers: workers, stall: stall}
+	var live Liveness
+	if status := healthOf(t, checks.liveness(), &live); status != http.StatusOK || !live.Healthy || len(live.Jobs) != 2 {
+		t.Fatalf("got %d %+v, want healthy", status, live)
+	}
+
+	// a copy that never finishes, a queue nothing takes events from and a poll loop that isn't polling
+	started, release := make(chan bool), make(chan bool)
+	go workers.Do("target", RegistryTarget{"app", "1.0"}, nil, func() error {
+		started <- true
+		<-release
+		return nil
+	})
+	<-started
+	notified.queue.Handle(RegistryEvent{Action: "push", Target: RegistryTarget{"app", "1.0"}})
+	time.Sleep(2 * stall)
+	live = Liveness{}
+	if status := healthOf(t, checks.liveness(), &live); status != http.StatusServiceUnavailable || live.Healthy {
+		t.Errorf("got %d, want unhealthy", status)
+	}
+	if live.Workers.OK || live.Workers.Busy != 1 || live.Jobs[0].Poll.OK || !live.Jobs[1].Poll.OK ||
+		live.Jobs[0].Queue.OK != true || live.Jobs[1].Queue.OK || live.Jobs[1].Queue.Pending != 1 {
+		t.Errorf("liveness = %+v", live)
+	}
+
+	close(release)
+	waitFor(t, "the copy to finish", func() bool { return workers.Progress().Busy == 0 })
+	polling.syncs.start()
+	notified.queue.Start()
+	defer notified.queue.Stop()
+	waitFor(t, "the queue to empty", func() bool { return notified.queue.Pending() == 0 })
+	live = Liveness{}
+	if status := healthOf(t, checks.liveness(), &live); status != http.StatusOK || !live.Jobs[0].Poll.Running {
+		t.Errorf("got %d %+v once things got going again, want healthy", status, live)
+	}
+}
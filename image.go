@@ -2,10 +2,13 @@ package main
 
 import (
 	"fmt"
+	"net/http"
 	"regexp"
+	"sort"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/digest"
 )
 
 // Repository string
@@ -19,6 +22,28 @@ type ImageIdentifier struct {
 // DockerImageFilter Selects particular images, useed with registries
 type DockerImageFilter struct {
 	repoFilter, tagFilter Filter
+	// metadata checks the config of each image as well, when not nil
+	metadata *MetadataFilter
+}
+
+// matchesEvent whether an event is about a matching image, reading its config from the
+// source if there is a metadata filter.  Deletes only go by the name as the image is gone.
+func (f DockerImageFilter) matchesEvent(evt RegistryEvent, source RegistryFactory) (bool, error) {
+	if !f.repoFilter.Matches(evt.Target.Repository) || !f.tagFilter.Matches(evt.Target.Tag) {
+		return false, nil
+	}
+	if f.metadata == nil || evt.Action == "delete" {
+		return true, nil
+	}
+	reg, err := source.GetRegistry()
+	if err != nil {
+		return false, err
+	}
+	image := evt.Target
+	if evt.Digest != "" {
+		image.Tag = evt.Digest.String()
+	}
+	return f.metadata.MatchesImage(reg, image)
 }
 
 // Filter generic string filter
@@ -35,6 +60,12 @@ type puller interface {
 type tagger interface {
 	Tag(string, string) error
 }
+
+// discarder taggers that hold on to what was pulled and tagged until it is pushed, and so
+// need telling about names that won't be pushed after all
+type discarder interface {
+	Discard(names ...string)
+}
 type regSource struct {
 	puller
 	RegistryFactory
@@ -44,54 +75,325 @@ type regTarget struct {
 	RegistryFactory
 }
 
+// PruneOptions controls removing images from the target that the source no longer has
+type PruneOptions struct {
+	Enabled bool
+	// MaxDeletes stops a single run deleting more than this many images, 0 for no limit
+	MaxDeletes int
+}
+
 // ImageHandler - knows how to pull, push and tag images
 type ImageHandler struct {
 	source regSource
 	target regTarget
 	tagger tagger
-	filter DockerImageFilter
+	filter  DockerImageFilter
+	prune   PruneOptions
+	workers *Workers
+	mapping ImageMapping
 }
 
 func (i ImageHandler) Handle(evt RegistryEvent) error {
-	if i.filter.repoFilter.Matches(evt.Target.Repository) &&
-		i.filter.tagFilter.Matches(evt.Target.Tag) {
-		return i.PullTagPush(evt.Target.Repository, evt.Target.Tag)
+	matches := evt.pruned()
+	if !matches {
+		var err error
+		if matches, err = i.filter.matchesEvent(evt, i.source); err != nil {
+			log.Warnf("Couldn't tell if %s matches : %s", evt, err)
+			return err
+		}
+	}
+	if matches {
+		if i.workers != nil {
+			return i.workers.Do(i.target.Address(), evt.Target, i.targetRefs(evt), func() error {
+				return i.apply(evt)
+			})
+		}
+		return i.apply(evt)
 	} else {
 		log.Debugf("Ignoring change  %s", evt)
 	}
 	return nil
 }
 
+// targetRefs the references the event changes in the target, by the names the image has there
+// so two source images given the same tag don't copy over each other at the same time
+func (i ImageHandler) targetRefs(evt RegistryEvent) []string {
+	target := i.target.Address()
+	if evt.pruned() {
+		return []string{targetRef(target, evt.Target)}
+	}
+	m, err := i.mapping.mapImage(evt.Target, evt.Digest.String())
+	if err != nil {
+		// the tags can't be worked out, e.g. without the digest they are named with
+		return []string{targetRef(target, RegistryTarget{m.repository, evt.Target.Tag})}
+	}
+	refs := make([]string, 0, len(m.tags))
+	for _, tag := range m.tags {
+		refs = append(refs, targetRef(target, RegistryTarget{m.repository, tag}))
+	}
+	return refs
+}
+
+// HandleAll handles the events in parallel, as far as the workers allow
+func (i ImageHandler) HandleAll(events []RegistryEvent) error {
+	concurrency := 1
+	if i.workers != nil {
+		concurrency = i.workers.Concurrency(i.target.Address())
+	}
+	return runAll(i, events, concurrency)
+}
+
+func (i ImageHandler) apply(evt RegistryEvent) error {
+	if evt.Action == "delete" {
+		if !i.prune.Enabled {
+			log.Debugf("Not deleting %s as pruning is off", evt)
+			return nil
+		}
+		if evt.pruned() {
+			// the sync looked up its digest and checked no other tag is the same manifest
+			return i.DeleteDigest(evt.Target.Repository, evt.Digest)
+		}
+		if evt.Target.Tag == "" && evt.Digest != "" {
+			// the whole manifest was deleted, which is the same one in the target whatever its tags
+			return i.DeleteDigest(i.mapping.Repositories.Rewrite(evt.Target.Repository), evt.Digest)
+		}
+		// deleted from the source so find its names in the target
+		if i.mapping.needsDigest() {
+			return permanent(fmt.Errorf("can't tell the tags of %s in the target once it is deleted from the source", evt.Target))
+		}
+		mapped, err := i.mapping.mapImage(evt.Target, "")
+		if err != nil {
+			return permanent(err)
+		}
+		return i.Delete(mapped.repository, mapped.tags...)
+	}
+	return i.pullTagPush(evt.Target, evt.Digest)
+}
+
 func (i ImageHandler) PullTagPush(imageName, version string) error {
+	return i.pullTagPush(RegistryTarget{imageName, version}, "")
+}
 
-	log.Infof(">>PullTagPush(%s:%s)", imageName, version)
+// pullTagPush copies the image, the manifest with the digest when it is given rather than
+// whatever the tag points at now.  Without a tag it is pushed by the digest alone.
+func (i ImageHandler) pullTagPush(image RegistryTarget, dgst digest.Digest) error {
+	log.Infof(">>PullTagPush(%s)", imageRef(image, dgst))
 	defer log.Infof("<<PullTagPush")
-	err := i.source.Pull(fmt.Sprintf("%s:%s", imageName, version))
+	if image.Tag == "" && dgst == "" {
+		log.Warnf("Pushing image %s without specific tag. Using latest", image.Repository)
+		image.Tag = "latest"
+	}
+	localImgName, err := i.pull(image, dgst)
 	if err != nil {
-		log.Warnf("Couldn't pull down %s : %s", imageName, err)
 		return err
 	}
-	if version == "" {
-		log.Warnf("Pushing image %s without specific tag. Using latest", imageName)
-		version = "latest"
+	remoteImgNames, err := i.tag(localImgName, image, dgst)
+	if err != nil {
+		i.discard(localImgName)
+		return err
 	}
-	var remoteImgName string
-	remoteImgName = fmt.Sprintf("%s/%s:%s", i.target.Address(), imageName, version)
-	log.Debugf("Taggin %s to %s", imageName, remoteImgName)
+	for n, remoteImgName := range remoteImgNames {
+		if err = i.push(remoteImgName); err != nil {
+			// the rest won't be pushed now
+			i.discard(append(append([]string(nil), remoteImgNames[n+1:]...), localImgName)...)
+			return err
+		}
+	}
+	return nil
+}
 
-	err = i.tagger.Tag(imageName, remoteImgName)
+// discard lets go of names that won't be pushed, the image pulled going once none of its tags are left
+func (i ImageHandler) discard(names ...string) {
+	if d, ok := i.tagger.(discarder); ok {
+		d.Discard(names...)
+	}
+}
+
+// imageRef names the image by its digest when it is known, otherwise by its tag
+func imageRef(image RegistryTarget, dgst digest.Digest) string {
+	if dgst != "" {
+		return fmt.Sprintf("%s@%s", image.Repository, dgst)
+	}
+	return fmt.Sprintf("%s:%s", image.Repository, image.Tag)
+}
+
+// pull fetches the image from the source, giving back its local name
+func (i ImageHandler) pull(image RegistryTarget, dgst digest.Digest) (string, error) {
+	localImgName := imageRef(image, dgst)
+	err := i.source.Pull(localImgName)
 	if err != nil {
-		log.Warnf("Couldn't pull down %s : %s", imageName, err)
-		return err
+		log.Warnf("Couldn't pull down %s : %s", localImgName, err)
 	}
-	err = i.target.Push(remoteImgName)
+	return localImgName, err
+}
+
+// tag names a pulled image for the target, giving back the names to push
+func (i ImageHandler) tag(localImgName string, image RegistryTarget, dgst digest.Digest) ([]string, error) {
+	if image.Tag == "" {
+		// an untagged manifest can only go to the target by its digest
+		remoteImgName := fmt.Sprintf("%s/%s@%s", i.target.Address(), i.mapping.Repositories.Rewrite(image.Repository), dgst)
+		log.Debugf("Taggin %s to %s", localImgName, remoteImgName)
+		if err := i.tagger.Tag(localImgName, remoteImgName); err != nil {
+			log.Warnf("Couldn't tag %s : %s", localImgName, err)
+			return nil, err
+		}
+		return []string{remoteImgName}, nil
+	}
+	var mappedDigest string
+	if i.mapping.needsDigest() {
+		reg, err := i.source.GetRegistry()
+		if err != nil {
+			return nil, err
+		}
+		// looked up even when the digest is known, as the one copied differs when leaving out platforms
+		reference := image.Tag
+		if dgst != "" {
+			reference = dgst.String()
+		}
+		d, err := reg.ManifestDigest(image.Repository, reference)
+		if err != nil {
+			log.Warnf("Couldn't get digest of %s to name it in the target : %s", localImgName, err)
+			return nil, err
+		}
+		mappedDigest = d.String()
+	}
+	mapped, err := i.mapping.mapImage(image, mappedDigest)
+	if err != nil {
+		log.Warnf("Couldn't name %s in the target : %s", localImgName, err)
+		return nil, err
+	}
+	var remoteImgNames []string
+	for _, remote := range mapped.targets() {
+		remoteImgName := fmt.Sprintf("%s/%s:%s", i.target.Address(), remote.Repository, remote.Tag)
+		log.Debugf("Taggin %s to %s", localImgName, remoteImgName)
+		if err = i.tagger.Tag(localImgName, remoteImgName); err != nil {
+			log.Warnf("Couldn't tag %s : %s", localImgName, err)
+			i.discard(remoteImgNames...)
+			return nil, err
+		}
+		remoteImgNames = append(remoteImgNames, remoteImgName)
+	}
+	return remoteImgNames, nil
+}
+
+func (i ImageHandler) push(remoteImgName string) error {
+	err := i.target.Push(remoteImgName)
 	if err != nil {
 		log.Warnf("Couldn't push %s : %s", remoteImgName, err)
+	}
+	return err
+}
+
+// Delete removes tags from the repository in the target.  As registries can only delete
+// whole manifests this refuses to when a tag that isn't being deleted is the same manifest.
+// Tags the target doesn't have are already gone.
+func (i ImageHandler) Delete(imageName string, versions ...string) error {
+	log.Infof(">>Delete(%s:%v)", imageName, versions)
+	defer log.Infof("<<Delete")
+	reg, err := i.target.GetRegistry()
+	if err != nil {
+		log.Errorf("Couldn't connec to registry %s : %s", i.target.Address(), err)
 		return err
 	}
+	digests, err := tagDigests(reg, imageName)
+	if err != nil {
+		log.Warnf("Couldn't look up the tags of %s to delete : %s", imageName, err)
+		return err
+	}
+	deleting := make(map[string]bool)
+	for _, version := range versions {
+		deleting[version] = true
+	}
+	for _, version := range versions {
+		dgst, ok := digests[version]
+		if !ok {
+			log.Debugf("No %s:%s to delete", imageName, version)
+			continue
+		}
+		if others := sharingManifest(digests, dgst, deleting); len(others) > 0 {
+			err = sharedManifestError{RegistryTarget{imageName, version}, dgst, others}
+			log.Warnf("%s", err)
+			return permanent(err)
+		}
+		if err = deleteTargetManifest(reg, imageName, dgst); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// DeleteDigest removes the manifest from the target, and with it every tag pointing at it.
+// A manifest the target doesn't have is already gone.
+func (i ImageHandler) DeleteDigest(imageName string, dgst digest.Digest) error {
+	log.Infof(">>DeleteDigest(%s@%s)", imageName, dgst)
+	defer log.Infof("<<DeleteDigest")
+	reg, err := i.target.GetRegistry()
+	if err != nil {
+		log.Errorf("Couldn't connec to registry %s : %s", i.target.Address(), err)
+		return err
+	}
+	return deleteTargetManifest(reg, imageName, dgst)
+}
+
+// deleteTargetManifest deletes the manifest unless the registry doesn't have it anymore
+func deleteTargetManifest(reg Registry, repository string, dgst digest.Digest) error {
+	err := reg.DeleteManifest(repository, dgst)
+	if statusCode(err) == http.StatusNotFound {
+		log.Debugf("No %s@%s to delete", repository, dgst)
+		return nil
+	}
+	if err != nil {
+		log.Warnf("Couldn't delete %s@%s : %s", repository, dgst, err)
+	}
+	return err
+}
+
+// tagDigests the digest of every tag in the repository
+func tagDigests(reg Registry, repository string) (map[string]digest.Digest, error) {
+	tags, err := reg.Tags(repository)
+	if err != nil {
+		return nil, err
+	}
+	digests := make(map[string]digest.Digest, len(tags))
+	for _, tag := range tags {
+		dgst, err := reg.ManifestDigest(repository, tag)
+		if statusCode(err) == http.StatusNotFound {
+			// deleted since the tags were listed
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		digests[tag] = dgst
+	}
+	return digests, nil
+}
+
+// sharingManifest the tags with the digest that aren't being deleted, sorted
+func sharingManifest(digests map[string]digest.Digest, dgst digest.Digest, deleting map[string]bool) []string {
+	var others []string
+	for tag, d := range digests {
+		if d == dgst && !deleting[tag] {
+			others = append(others, tag)
+		}
+	}
+	sort.Strings(others)
+	return others
+}
+
+// sharedManifestError a tag that can't be deleted as other tags are the same manifest, which
+// registries can only delete as a whole
+type sharedManifestError struct {
+	image  RegistryTarget
+	dgst   digest.Digest
+	others []string
+}
+
+func (e sharedManifestError) Error() string {
+	return fmt.Sprintf("not deleting %s:%s as it is the same manifest %s as %s", e.image.Repository, e.image.Tag,
+		e.dgst, strings.Join(e.others, ", "))
+}
+
 func (i ImageHandler) RSync(filter DockerImageFilter) error {
 	s, err := i.source.GetRegistry()
 	if err != nil {
@@ -103,7 +405,7 @@ func (i ImageHandler) RSync(filter DockerImageFilter) error {
 		log.Errorf("Couldn't connec to registry %s : %s", i.target, err)
 		return err
 	}
-	return Consolidate(s, t, filter, i)
+	return consolidate(s, t, filter, i.mapping, i, i.prune)
 }
 
 type matchEverything struct{}
@@ -149,35 +451,49 @@ func NewRegexTagFilter(regex string) (*RegexTagFilter, error) {
 	return &RegexTagFilter{pattern}, nil
 }
 
-//GetMatchingImages Finds the names and tags of all matching
+//GetMatchingImages Finds the names and tags of all matching.  A tag filter that is
+//a TagListFilter is given all the tags of each repository together, and the metadata
+//filter, if any, is given the images that are left
 func GetMatchingImages(reg Registry, filter DockerImageFilter) (RegistryTargets, error) {
+	matchingImages, _, err := matchingImages(reg, filter)
+	return matchingImages, err
+}
+
+// matchingImages the images matching the filter, and the ones left out as their config
+// couldn't be read to tell
+func matchingImages(reg Registry, filter DockerImageFilter) (matchingImages, unreadable RegistryTargets, err error) {
 	log.Debugf(">> GetMatchingImages(%+v, %+v)", reg, filter)
-	matchingImages := make([]RegistryTarget, 0, 10)
+	matchingImages = make([]RegistryTarget, 0, 10)
 	repos, err := reg.Repositories()
 	if err != nil {
 		fmt.Printf("cant get repositories from %s:%v. Got back %s", reg, err, repos)
-		return matchingImages, err
+		return matchingImages, nil, err
 	}
 	for _, repo := range repos {
 		if filter.repoFilter.Matches(repo) {
 			tags, err := reg.Tags(repo)
 			if err != nil {
-				log.Fatal("Unable to get tags", err)
-				return matchingImages, err
+				return matchingImages, nil, fmt.Errorf("couldn't get the tags of %s : %s", repo, err)
+			}
+			if listFilter, ok := filter.tagFilter.(TagListFilter); ok {
+				tags = listFilter.FilterTags(repo, tags)
 			}
 			for _, tag := range tags {
 				log.Debugf("Looking at tag %s", tag)
 				if filter.tagFilter.Matches(tag) {
 					matchingImages = append(matchingImages, RegistryTarget{repo, tag})
 				} else {
-					log.Debug("Ignoring image from repo %s with tag %s", repo, tag)
+					log.Debugf("Ignoring image from repo %s with tag %s", repo, tag)
 				}
 			}
 		} else {
 			log.Debugf("Ignoring repo %s", repo)
 		}
 	}
-	return matchingImages, nil
+	if filter.metadata != nil {
+		matchingImages, unreadable = filter.metadata.FilterImages(reg, matchingImages)
+	}
+	return matchingImages, unreadable, nil
 }
 
 // Finds all the images that aren't in the target but are in the source
@@ -195,26 +511,290 @@ func missingImages(source, target RegistryTargets) RegistryTargets {
 	return diffs
 }
 
-//Consolidate  finds the missing images in the target from the source and fires off events for those
+// Finds the images that are in both registries but whose tags point at different manifests,
+// i.e. the tag was moved on the source after it was copied.  Source digests already looked
+// up are in digests, which is filled in with any more that are needed.
+func outdatedImages(regSource, regTarget Registry, mapped []mappedImage, target RegistryTargets,
+	digests map[RegistryTarget]digest.Digest) RegistryTargets {
+	outdated := make([]RegistryTarget, 0)
+	vals := make(map[RegistryTarget]int)
+	for _, t := range target {
+		vals[t] = 1
+	}
+	for _, m := range mapped {
+		s := m.source
+		for _, tag := range m.tags {
+			t := RegistryTarget{m.repository, tag}
+			if _, ok := vals[t]; !ok {
+				continue
+			}
+			sourceDigest, ok := digests[s]
+			if !ok {
+				var err error
+				sourceDigest, err = regSource.ManifestDigest(s.Repository, s.Tag)
+				if err != nil {
+					log.Warnf("Couldn't get digest of %s:%s from source : %s", s.Repository, s.Tag, err)
+					break
+				}
+				digests[s] = sourceDigest
+			}
+			targetDigest, err := regTarget.ManifestDigest(t.Repository, t.Tag)
+			if err != nil {
+				log.Warnf("Couldn't get digest of %s:%s from target : %s", t.Repository, t.Tag, err)
+				continue
+			}
+			if sourceDigest != targetDigest {
+				log.Debugf("%s:%s is %s in the source but %s:%s is %s in the target", s.Repository, s.Tag,
+					sourceDigest, t.Repository, t.Tag, targetDigest)
+				outdated = append(outdated, s)
+				break
+			}
+		}
+	}
+	return outdated
+}
+
+//Consolidate  finds the missing and outdated images in the target from the source and fires off events for those
 func Consolidate(regSource, regTarget Registry, filter DockerImageFilter, handler RegistryEventHandler) error {
-	//This could easily take a while and we want to at the least log the time it took. In reality should probably
-	//push a metric somewhere
-	log.Infof(">>Consolidate(%s,%+v,%+v", regSource, regTarget, filter)
-	defer log.Info("<<Consolidate")
-	sourceImages, err := GetMatchingImages(regSource, filter)
+	return consolidate(regSource, regTarget, filter, ImageMapping{}, handler, PruneOptions{})
+}
+
+//ConsolidateAndPrune does the same as Consolidate but also fires off delete events
+//for the images in the target the source no longer has, unless there are more than maxDeletes
+func ConsolidateAndPrune(regSource, regTarget Registry, filter DockerImageFilter, handler RegistryEventHandler,
+	maxDeletes int) error {
+	return consolidate(regSource, regTarget, filter, ImageMapping{}, handler, PruneOptions{true, maxDeletes})
+}
+
+// SyncPlan what a sync between two registries would change in the target
+type SyncPlan struct {
+	// Missing images the source has and the target doesn't, named as in the source
+	Missing RegistryTargets
+	// Outdated images whose tag points at a different manifest in the target, named as in the source
+	Outdated RegistryTargets
+	// Extra images the target has that the source no longer does, named as in the target.
+	// Only worked out when pruning.
+	Extra RegistryTargets
+}
+
+// Diff works out what needs to change in the target to match the source without changing anything.
+// The mapping names the source images in the target to compare them.  An image is only missing if
+// one of its tags besides the date stamps is, so images aren't promoted again every day.
+// Nothing is pruned from a repository some source image couldn't be named in, nor the images
+// whose config couldn't be read to tell if they still match.
+func Diff(regSource, regTarget Registry, filter DockerImageFilter, mapping ImageMapping, prune bool) (plan SyncPlan, err error) {
+	sourceImages, unreadable, err := matchingImages(regSource, filter)
 	if err != nil {
 		log.Errorf("Couldn't get images from source repo %v : %v", regSource, err)
-		return err
+		return
 	}
-	targetImages, err := GetMatchingImages(regTarget, filter)
+	digests := make(map[RegistryTarget]digest.Digest)
+	mapped := make([]mappedImage, 0, len(sourceImages))
+	// unsure the target repositories of the source images that couldn't be named in the target,
+	// whose tags can't be told apart from the ones the source no longer has
+	unsure := make(repositorySet)
+	for _, image := range sourceImages {
+		m, d, err := nameInTarget(regSource, mapping, image)
+		if err != nil {
+			log.Warnf("Skipping %s:%s : %s", image.Repository, image.Tag, err)
+			unsure[m.repository] = true
+			continue
+		}
+		if d != "" {
+			digests[image] = d
+		}
+		mapped = append(mapped, m)
+	}
+	// kept the images that may still match or that lost to another image copied to the same
+	// name, which are neither copied nor pruned
+	mapped, kept := resolveCollisions(mapped)
+	for _, image := range unreadable {
+		m, _, err := nameInTarget(regSource, mapping, image)
+		if err != nil {
+			log.Warnf("Skipping %s:%s : %s", image.Repository, image.Tag, err)
+			unsure[m.repository] = true
+			continue
+		}
+		kept = append(kept, m)
+	}
+	targetFilter := filter
+	if !mapping.identity() {
+		// The filter is for source names so only look at the repositories they map to
+		repos := make(repositorySet)
+		for _, m := range mapped {
+			repos[m.repository] = true
+		}
+		targetFilter.repoFilter = repos
+		if len(mapping.Tags) > 0 {
+			targetFilter.tagFilter = matchEverything{}
+		}
+	}
+	targetImages, err := GetMatchingImages(regTarget, targetFilter)
 	if err != nil {
 		log.Errorf("Couldn't get images from target repo %s : %s", regTarget, err)
+		return
+	}
+	inTarget := make(map[RegistryTarget]bool)
+	for _, image := range targetImages {
+		inTarget[image] = true
+	}
+	plan.Missing = make(RegistryTargets, 0, len(sourceImages))
+	for _, m := range mapped {
+		for _, tag := range m.tags {
+			if !inTarget[RegistryTarget{m.repository, tag}] {
+				plan.Missing = append(plan.Missing, m.source)
+				break
+			}
+		}
+	}
+	plan.Outdated = outdatedImages(regSource, regTarget, mapped, targetImages, digests)
+	if prune {
+		// Anything the target has that the source doesn't, leaving the date stamps of what it does
+		kept = append(kept, mapped...)
+		wanted := make(RegistryTargets, 0, len(kept))
+		for _, m := range kept {
+			for _, tag := range m.tags {
+				wanted = append(wanted, RegistryTarget{m.repository, tag})
+			}
+		}
+		plan.Extra = make(RegistryTargets, 0)
+		for _, image := range missingImages(targetImages, wanted) {
+			if unsure[image.Repository] {
+				log.Warnf("Not pruning %s:%s as some images of the source couldn't be looked up", image.Repository, image.Tag)
+				continue
+			}
+			if !isStampOf(image, kept) {
+				plan.Extra = append(plan.Extra, image)
+			}
+		}
+	}
+	return
+}
+
+// nameInTarget maps the source image, with its digest when the mapping needs it.  On error the
+// mapped image still has the repository in the target.
+func nameInTarget(regSource Registry, mapping ImageMapping, image RegistryTarget) (mappedImage, digest.Digest, error) {
+	if !mapping.needsDigest() {
+		m, err := mapping.mapImage(image, "")
+		return m, "", err
+	}
+	d, err := regSource.ManifestDigest(image.Repository, image.Tag)
+	if err != nil {
+		m := mappedImage{source: image, repository: mapping.Repositories.Rewrite(image.Repository)}
+		return m, "", fmt.Errorf("couldn't get its digest from source : %s", err)
+	}
+	m, err := mapping.mapImage(image, d.String())
+	return m, d, err
+}
+
+// isStampOf true if the image in the target is the date stamp of one of the mapped images
+func isStampOf(image RegistryTarget, mapped []mappedImage) bool {
+	for _, m := range mapped {
+		if m.repository == image.Repository && m.isStamp(image.Tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// repositorySet filter matching just the repositories in it
+type repositorySet map[string]bool
+
+func (r repositorySet) Matches(repository string) bool {
+	return r[repository]
+}
+
+func consolidate(regSource, regTarget Registry, filter DockerImageFilter, mapping ImageMapping,
+	handler RegistryEventHandler, prune PruneOptions) error {
+	//This could easily take a while so log the time it took. Jobs sync through FanOutHandler.RSync,
+	//which keeps it in the registryrsync_consolidate_duration_seconds metric
+	log.Infof(">>Consolidate(%s,%+v,%+v", regSource, regTarget, filter)
+	start := now()
+	defer func() { log.Infof("<<Consolidate took %s", now().Sub(start)) }()
+	plan, err := Diff(regSource, regTarget, filter, mapping, prune.Enabled)
+	if err != nil {
 		return err
 	}
-	missingImages := missingImages(sourceImages, targetImages)
-	for _, image := range missingImages {
-		handler.Handle(RegistryEvent{"missing", image})
+	copyErr := handleAll(handler, copyEvents(plan))
+	if copyErr != nil {
+		log.Errorf("Couldn't copy everything to %s : %s", regTarget, copyErr)
+	}
+	if prune.Enabled {
+		if err = pruneExtra(handler, plan, prune, regTarget); err != nil {
+			log.Errorf("Couldn't delete everything from %s : %s", regTarget, err)
+			return err
+		}
+	}
+	return copyErr
+
+}
+
+// copyEvents the events to copy the missing and outdated images in the plan
+func copyEvents(plan SyncPlan) []RegistryEvent {
+	events := make([]RegistryEvent, 0, len(plan.Missing)+len(plan.Outdated))
+	for _, image := range plan.Missing {
+		events = append(events, RegistryEvent{Action: "missing", Target: image})
+	}
+	for _, image := range plan.Outdated {
+		events = append(events, RegistryEvent{Action: "outdated", Target: image})
+	}
+	return events
+}
+
+// pruneExtra deletes the extra images in the plan from the target.  The ones that can't be as
+// other tags are the same manifest fail the prune once the rest are deleted.
+func pruneExtra(handler RegistryEventHandler, plan SyncPlan, prune PruneOptions, regTarget Registry) error {
+	deletes, shared, err := deleteEvents(plan, prune, regTarget)
+	if err != nil {
+		return err
+	}
+	if err = handleAll(handler, deletes); err != nil {
+		return err
+	}
+	if len(shared) > 0 {
+		return fmt.Errorf("%d of %d images weren't deleted as other tags are the same manifest", len(shared),
+			len(plan.Extra))
 	}
 	return nil
+}
 
+// deleteEvents the events to delete the extra images in the plan by their digests, unless there
+// are more than the limit.  The digests are looked up once for each repository.  The images whose
+// manifest a tag that is staying has too are given back as shared, as deleting the manifest would
+// take that tag with it.
+func deleteEvents(plan SyncPlan, prune PruneOptions, regTarget Registry) (deletes []RegistryEvent,
+	shared []sharedManifestError, err error) {
+	if prune.MaxDeletes > 0 && len(plan.Extra) > prune.MaxDeletes {
+		log.Errorf("Refusing to delete %d images from %s, the limit is %d", len(plan.Extra),
+			regTarget, prune.MaxDeletes)
+		return nil, nil, fmt.Errorf("%d images to delete is more than the limit of %d", len(plan.Extra),
+			prune.MaxDeletes)
+	}
+	extra := make(map[string]map[string]bool)
+	digests := make(map[string]map[string]digest.Digest)
+	for _, image := range plan.Extra {
+		if extra[image.Repository] == nil {
+			extra[image.Repository] = make(map[string]bool)
+			if digests[image.Repository], err = tagDigests(regTarget, image.Repository); err != nil {
+				return nil, nil, fmt.Errorf("couldn't look up the tags of %s to delete : %s", image.Repository, err)
+			}
+		}
+		extra[image.Repository][image.Tag] = true
+	}
+	deletes = make([]RegistryEvent, 0, len(plan.Extra))
+	for _, image := range plan.Extra {
+		dgst, ok := digests[image.Repository][image.Tag]
+		if !ok {
+			log.Debugf("No %s:%s to delete", image.Repository, image.Tag)
+			continue
+		}
+		if others := sharingManifest(digests[image.Repository], dgst, extra[image.Repository]); len(others) > 0 {
+			e := sharedManifestError{image, dgst, others}
+			log.Warnf("%s", e)
+			shared = append(shared, e)
+			continue
+		}
+		deletes = append(deletes, RegistryEvent{Action: "delete", Target: image, Digest: dgst, Reason: pruneReason})
+	}
+	return deletes, shared, nil
 }
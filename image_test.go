@@ -7,7 +7,8 @@ import (
 	"strings"
 	"testing"
 
-	. "github.com/smartystreets/goconvey/convey"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
 )
 
 func TestGetMatchingImages(t *testing.T) {
@@ -27,7 +28,7 @@ func TestGetMatchingImages(t *testing.T) {
 				mockRegistry{map[string][]string{
 					"alpine":              {"0.1", "stable"},
 					"mynamespace/busybox": {"0.1", "0.1-stable"}}},
-				DockerImageFilter{matchEverything{}, regExFilter(".*stable")}},
+				DockerImageFilter{repoFilter: matchEverything{}, tagFilter: regExFilter(".*stable")}},
 			[]RegistryTarget{RegistryTarget{"alpine", "stable"}, RegistryTarget{"mynamespace/busybox", "0.1-stable"}},
 			false,
 		},
@@ -40,11 +41,31 @@ func TestGetMatchingImages(t *testing.T) {
 					"staging/image2": {"0.1"},
 					"dev/image1":     {"0.2"},
 				}},
-				DockerImageFilter{NewNamespaceFilter("staging", "prod"), matchEverything{}}},
+				DockerImageFilter{repoFilter: NewNamespaceFilter("staging", "prod"), tagFilter: matchEverything{}}},
 			[]RegistryTarget{RegistryTarget{"prod/image1", "0.1"},
 				RegistryTarget{"staging/image1", "0.1"},
 				RegistryTarget{"staging/image2", "0.1"}},
 			false,
+		},
+		{
+			"newest versions in each repository",
+			args{
+				mockRegistry{map[string][]string{
+					"alpine":  {"3.4", "3.10", "3.9", "latest", "3.11-rc1"},
+					"busybox": {"1.0"},
+				}},
+				DockerImageFilter{repoFilter: matchEverything{}, tagFilter: NewNewestFilter(2, &SemverFilter{[]versionRange{{}}})}},
+			[]RegistryTarget{RegistryTarget{"alpine", "3.10"}, RegistryTarget{"alpine", "3.9"},
+				RegistryTarget{"busybox", "1.0"}},
+			false,
+		},
+		{
+			"tags that can't be listed",
+			args{
+				tagsFailingRegistry{mockRegistry{map[string][]string{"alpine": {"3.4"}}}},
+				DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}}},
+			RegistryTargets{},
+			true,
 		}}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -82,25 +103,257 @@ func TestConsolidates(t *testing.T) {
 		mockRegistry{map[string][]string{
 			"production/tool1": {"0.1"},
 		}},
-		DockerImageFilter{NewNamespaceFilter("production"),
-			regExFilter("[\\d\\.]+")},
+		DockerImageFilter{repoFilter: NewNamespaceFilter("production"), tagFilter: regExFilter("[\\d\\.]+")},
 		&eventRecorder{},
 	},
-		RegistryEvents{[]RegistryEvent{RegistryEvent{"missing", RegistryTarget{"production/tool1", "0.2"}}, RegistryEvent{"missing", RegistryTarget{"production/tool2", "0.1"}}}},
+		RegistryEvents{[]RegistryEvent{RegistryEvent{Action: "missing", Target: RegistryTarget{"production/tool1", "0.2"}}, RegistryEvent{Action: "missing", Target: RegistryTarget{"production/tool2", "0.1"}}}},
 	}}
 	for _, tt := range tests {
-		Convey("for consolidation of:"+tt.name, t, func() {
-			Consolidate(tt.args.regSource, tt.args.regTarget, tt.args.filter, tt.args.handler)
-			fmt.Printf("hander %v", tt.args.handler)
+		t.Run(tt.name, func(t *testing.T) {
+			if err := Consolidate(tt.args.regSource, tt.args.regTarget, tt.args.filter, tt.args.handler); err != nil {
+				t.Fatalf("Consolidate() error = %v", err)
+			}
 			expected := tt.events.getRegistryTargets()
 			actual := tt.args.handler.events.getRegistryTargets()
 			sort.Sort(expected)
 			sort.Sort(actual)
-			So(actual, ShouldResemble, expected)
+			if !reflect.DeepEqual(actual, expected) {
+				t.Errorf("Consolidate() handled %v, want %v", actual, expected)
+			}
+		})
+	}
+}
+
+func TestConsolidateOutdated(t *testing.T) {
+	source := digestRegistry{
+		mockRegistry{map[string][]string{
+			"production/tool1": {"0.1", "stable"},
+			"production/tool2": {"latest"},
+		}},
+		map[RegistryTarget]digest.Digest{
+			RegistryTarget{"production/tool1", "stable"}: digest.FromBytes([]byte("rebuilt")),
+		},
+	}
+	target := mockRegistry{map[string][]string{
+		"production/tool1": {"0.1", "stable"},
+	}}
+	handler := &eventRecorder{}
+	err := Consolidate(source, target, DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}}, handler)
+	if err != nil {
+		t.Fatalf("Consolidate() error = %v", err)
+	}
+	want := []RegistryEvent{
+		RegistryEvent{Action: "missing", Target: RegistryTarget{"production/tool2", "latest"}},
+		RegistryEvent{Action: "outdated", Target: RegistryTarget{"production/tool1", "stable"}},
+	}
+	if !reflect.DeepEqual(handler.events.Events, want) {
+		t.Errorf("Consolidate() events = %v, want %v", handler.events.Events, want)
+	}
+}
+
+func TestConsolidateAndPrune(t *testing.T) {
+	source := mockRegistry{map[string][]string{
+		"production/tool1": {"0.2"},
+	}}
+	extra, _ := source.ManifestDigest("production/tool1", "0.1")
+	tests := []struct {
+		name       string
+		maxDeletes int
+		want       []RegistryEvent
+		wantErr    bool
+	}{
+		{"no limit", 0, []RegistryEvent{
+			RegistryEvent{Action: "missing", Target: RegistryTarget{"production/tool1", "0.2"}},
+			RegistryEvent{Action: "delete", Target: RegistryTarget{"production/tool1", "0.1"}, Digest: extra, Reason: pruneReason},
+		}, false},
+		{"within limit", 1, []RegistryEvent{
+			RegistryEvent{Action: "missing", Target: RegistryTarget{"production/tool1", "0.2"}},
+			RegistryEvent{Action: "delete", Target: RegistryTarget{"production/tool1", "0.1"}, Digest: extra, Reason: pruneReason},
+		}, false},
+		{"over limit", 1, []RegistryEvent{
+			RegistryEvent{Action: "missing", Target: RegistryTarget{"production/tool1", "0.2"}},
+		}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target := mockRegistry{map[string][]string{
+				"production/tool1": {"0.1"},
+			}}
+			if tt.wantErr {
+				target.entries["production/tool2"] = []string{"0.1"}
+			}
+			handler := &eventRecorder{}
+			err := ConsolidateAndPrune(source, target, DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}},
+				handler, tt.maxDeletes)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ConsolidateAndPrune() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(handler.events.Events, tt.want) {
+				t.Errorf("ConsolidateAndPrune() events = %v, want %v", handler.events.Events, tt.want)
+			}
 		})
 	}
 }
 
+func TestImageHandlerDelete(t *testing.T) {
+	shared := digest.FromBytes([]byte("shared"))
+	target := digestRegistry{
+		mockRegistry{map[string][]string{
+			"production/tool1": {"0.1", "0.2", "latest"},
+		}},
+		map[RegistryTarget]digest.Digest{
+			RegistryTarget{"production/tool1", "0.2"}:    shared,
+			RegistryTarget{"production/tool1", "latest"}: shared,
+		},
+	}
+	handler := ImageHandler{
+		target: regTarget{nil, target},
+		filter: DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}},
+	}
+	handler.Handle(RegistryEvent{Action: "delete", Target: RegistryTarget{"production/tool1", "0.1"}})
+	if tags, _ := target.Tags("production/tool1"); len(tags) != 3 {
+		t.Errorf("deleted %v without pruning enabled", tags)
+	}
+	handler.prune = PruneOptions{Enabled: true}
+	if err := handler.Handle(RegistryEvent{Action: "delete", Target: RegistryTarget{"production/tool1", "0.1"}}); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	// deleting the manifest would take latest with it, which is no use trying again
+	err := handler.Handle(RegistryEvent{Action: "delete", Target: RegistryTarget{"production/tool1", "0.2"}})
+	if _, ok := err.(permanentError); !ok || !strings.Contains(err.Error(), "as latest") {
+		t.Errorf("Handle() error = %v, want latest being the same manifest", err)
+	}
+	want := []string{"0.2", "latest"}
+	if tags, _ := target.Tags("production/tool1"); !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags after delete = %v, want %v", tags, want)
+	}
+}
+
+func TestDeleteEvents(t *testing.T) {
+	shared, kept := digest.FromBytes([]byte("shared")), digest.FromBytes([]byte("kept"))
+	target := digestRegistry{
+		mockRegistry{map[string][]string{
+			"production/tool1": {"0.1", "0.2", "0.3", "latest"},
+			"production/tool2": {"0.1"},
+		}},
+		map[RegistryTarget]digest.Digest{
+			RegistryTarget{"production/tool1", "0.2"}:    shared,
+			RegistryTarget{"production/tool1", "0.3"}:    shared,
+			RegistryTarget{"production/tool1", "0.1"}:    kept,
+			RegistryTarget{"production/tool1", "latest"}: kept,
+		},
+	}
+	plan := SyncPlan{Extra: RegistryTargets{
+		{"production/tool1", "0.1"}, {"production/tool1", "0.2"}, {"production/tool1", "0.3"}, {"production/tool2", "0.1"},
+	}}
+	deletes, refused, err := deleteEvents(plan, PruneOptions{Enabled: true}, target)
+	if err != nil {
+		t.Fatalf("deleteEvents() error = %v", err)
+	}
+	// the tags being deleted together can go, but not one latest is the same manifest as
+	tool2, _ := target.ManifestDigest("production/tool2", "0.1")
+	want := []RegistryEvent{
+		{Action: "delete", Target: RegistryTarget{"production/tool1", "0.2"}, Digest: shared, Reason: pruneReason},
+		{Action: "delete", Target: RegistryTarget{"production/tool1", "0.3"}, Digest: shared, Reason: pruneReason},
+		{Action: "delete", Target: RegistryTarget{"production/tool2", "0.1"}, Digest: tool2, Reason: pruneReason},
+	}
+	if !reflect.DeepEqual(deletes, want) {
+		t.Errorf("deleteEvents() = %v, want %v", deletes, want)
+	}
+	if len(refused) != 1 || refused[0].image != (RegistryTarget{"production/tool1", "0.1"}) ||
+		!reflect.DeepEqual(refused[0].others, []string{"latest"}) {
+		t.Errorf("refused %v, want 0.1 as latest is the same manifest", refused)
+	}
+
+	handler := &eventRecorder{}
+	err = pruneExtra(handler, plan, PruneOptions{Enabled: true}, target)
+	if err == nil || len(handler.events.Events) != 3 {
+		t.Errorf("pruneExtra() error = %v after %d deletes, want the rest deleted and the prune failing", err,
+			len(handler.events.Events))
+	}
+}
+
+func TestRSyncPrunes(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	source.addImage("team/app", "1.0", "base")
+	target.addImage("team/app", "0.9", "old")
+	target.addImage("team/app", "0.8", "older")
+	target.addManifest("team/app", "stable", schema2.MediaTypeManifest, mustManifest(t, target, "team/app", "0.8"))
+
+	handler, err := NewRegistryCopyHandler(source.info(), target.info(), DockerImageFilter{repoFilter: matchEverything{}, tagFilter: regExFilter(`\d+\.\d+`)})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyHandler() error = %v", err)
+	}
+	handler.prune = PruneOptions{Enabled: true}
+	// stable doesn't match the filter, so 0.8 stays for it
+	if err = handler.RSync(handler.filter); err == nil || !strings.Contains(err.Error(), "same manifest") {
+		t.Errorf("RSync() error = %v, want 0.8 left for stable", err)
+	}
+	if got := copiedTags(target, "team/app", "0.8", "0.9", "1.0", "stable"); !reflect.DeepEqual(got, []string{"0.8", "1.0", "stable"}) {
+		t.Errorf("tags after the sync = %v, want 0.9 pruned", got)
+	}
+}
+
+func TestImageHandlerDeleteByDigest(t *testing.T) {
+	target := newFakeRegistry()
+	defer target.Close()
+	dgst := target.addImage("prod/app", "1.0", "base")
+	target.addManifest("prod/app", "stable", schema2.MediaTypeManifest, mustManifest(t, target, "prod/app", "1.0"))
+	target.addImage("prod/app", "2.0", "base", "two")
+	bySha, _ := NewTagRule(`latest`, `sha-{{slice .Digest 7 14}}`)
+	handler := ImageHandler{
+		target: regTarget{nil, target.info()},
+		filter: DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}},
+		prune:  PruneOptions{Enabled: true},
+		mapping: ImageMapping{
+			Repositories: RepositoryRewriter{PrefixRule{"staging/", "prod/"}},
+			Tags:         []TagRule{bySha},
+		},
+	}
+	// distribution sends the digest alone when a manifest is deleted
+	for n := 0; n < 2; n++ {
+		if err := handler.Handle(RegistryEvent{Action: "delete", Target: RegistryTarget{Repository: "staging/app"}, Digest: dgst}); err != nil {
+			t.Fatalf("Handle() error = %v", err)
+		}
+	}
+	if copied := copiedTags(target, "prod/app", "1.0", "stable", "2.0"); !reflect.DeepEqual(copied, []string{"2.0"}) {
+		t.Errorf("tags after delete = %v, want just 2.0", copied)
+	}
+	// its tags in the target can't be worked out without the digest, which retrying won't change
+	err := handler.Handle(RegistryEvent{Action: "delete", Target: RegistryTarget{"staging/app", "2.0"}})
+	if err == nil || isRetryable(err) {
+		t.Errorf("Handle() error = %v, want one not worth retrying", err)
+	}
+}
+
+// failingHandler fails every event for one repository
+type failingHandler struct {
+	repository string
+}
+
+func (f failingHandler) Handle(evt RegistryEvent) error {
+	if evt.Target.Repository == f.repository {
+		return fmt.Errorf("couldn't copy %s", evt.Target.Repository)
+	}
+	return nil
+}
+
+func TestConsolidateReportsFailures(t *testing.T) {
+	source := mockRegistry{map[string][]string{
+		"production/tool1": {"0.1", "0.2"},
+		"production/tool2": {"0.1"},
+	}}
+	target := mockRegistry{map[string][]string{}}
+	err := Consolidate(source, target, DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}},
+		failingHandler{"production/tool1"})
+	if err == nil || err.Error() != "2 of 3 images failed" {
+		t.Errorf("Consolidate() error = %v, want 2 of 3 images failed", err)
+	}
+}
+
 type eventRecorder struct {
 	events RegistryEvents
 	name   string
@@ -164,3 +417,47 @@ func (m mockRegistry) Repositories() ([]string, error) {
 func (m mockRegistry) Tags(repo string) ([]string, error) {
 	return m.entries[repo], nil
 }
+
+// tagsFailingRegistry can't list the tags of any repository
+type tagsFailingRegistry struct {
+	mockRegistry
+}
+
+func (t tagsFailingRegistry) Tags(repo string) ([]string, error) {
+	return nil, fmt.Errorf("registry down")
+}
+
+// ManifestDigest every tag gets its own digest, so the same tag in two
+// mock registries is considered the same image
+func (m mockRegistry) ManifestDigest(repo, tag string) (digest.Digest, error) {
+	return digest.FromBytes([]byte(repo + ":" + tag)), nil
+}
+
+// DeleteManifest drops every tag of the repository with the digest
+func (m mockRegistry) DeleteManifest(repo string, dgst digest.Digest) error {
+	remaining := []string{}
+	for _, tag := range m.entries[repo] {
+		if d, _ := m.ManifestDigest(repo, tag); d != dgst {
+			remaining = append(remaining, tag)
+		}
+	}
+	m.entries[repo] = remaining
+	return nil
+}
+
+// digestRegistry a mockRegistry where some tags point at particular manifests
+type digestRegistry struct {
+	mockRegistry
+	digests map[RegistryTarget]digest.Digest
+}
+
+func (d digestRegistry) GetRegistry() (Registry, error) {
+	return d, nil
+}
+
+func (d digestRegistry) ManifestDigest(repo, tag string) (digest.Digest, error) {
+	if dgst, ok := d.digests[RegistryTarget{repo, tag}]; ok {
+		return dgst, nil
+	}
+	return d.mockRegistry.ManifestDigest(repo, tag)
+}
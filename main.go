@@ -30,15 +30,34 @@ import (
 var cfgFile string
 
 func main() {
-	RootCmd.Execute()
+	Execute()
 }
 
 var debugLogging bool
 var registrySource, registryTarget RegistryInfo
-var namespaces []string
-var tagRegexp string
+var targetURLs []string
+var filterOptions FilterOptions
 var pollingFrequency time.Duration
 var port int
+var copyEngine string
+var prune PruneOptions
+var events EventPolicy
+var webhookAuth WebhookAuth
+var adminAuth WebhookAuth
+var notifyURLs []string
+var notify OutboundWebhook
+var tlsOptions TLSOptions
+var queueOptions = DefaultQueueOptions
+var stallTimeout time.Duration
+
+// defaultPruneMax most deletes a sync may do unless told otherwise
+const defaultPruneMax = 20
+
+var workerCount, targetWorkerCount int
+var sourceAttempts, targetAttempts int
+var retryBackoff time.Duration
+var rewriteRules, tagRules []string
+var platforms []string
 
 // RootCmd represents the base command when called without any subcommands
 var RootCmd = &cobra.Command{
@@ -46,81 +65,161 @@ var RootCmd = &cobra.Command{
 	Short: "Simple tool to help keep registries in sync",
 	Long: `
 
-	registrysync --source-url <registrysource>  --target-url
+	registrysync --source-url <registrysource>  --target-url <registrytarget>[,<registrytarget>...]
 
 	All settings can be overriden via enviornment variables prefixed with RR, e.g.
 	RR_SOURCE_URL
 	`,
 
 	// Set logging for all commands
-	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		if debugLogging {
 			log.SetLevel(log.DebugLevel)
 		}
+		if err := readFlags(cmd.Root()); err != nil {
+			return err
+		}
+		registrySource.retry = retryPolicy(sourceAttempts)
+		registryTarget.retry = retryPolicy(targetAttempts)
+		return nil
 	},
-	// Uncomment the following line if your bare application
-	// has an action associated with it:
-	Run: func(cmd *cobra.Command, args []string) {
-		if registrySource.address == "" {
-			log.Error("No source registry address specified")
-			cmd.Usage()
-			return
+	// Errors are logged by Execute, which exits with a failure
+	SilenceErrors: true,
+	SilenceUsage:  true,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		requests, err := serverRequests(cmd)
+		if err != nil {
+			return err
+		}
+		workers := NewWorkers(workerCount, targetWorkerCount)
+		mux := http.NewServeMux()
+		mux.Handle(metricsPath, metricsHandler())
+		checks := healthChecks{workers: workers, stall: stallTimeout}
+		for _, request := range requests {
+			s, err := request.newServer(workers, queueOptions)
+			if err != nil {
+				return err
+			}
+			s.start(mux)
+			checks.servers = append(checks.servers, s)
 		}
-		if registryTarget.address == "" {
-			log.Error("No target registry address specified")
-			cmd.Usage()
-			return
+		mux.Handle(livenessPath, checks.liveness())
+		mux.Handle(readinessPath, checks.readiness())
+		if err = registerAdminAPI(mux, adminAuth, checks.servers, workers); err != nil {
+			return err
 		}
-		var nameFilter, tagFilter Filter
-		if len(namespaces) == 0 {
-			nameFilter = matchEverything{}
-		} else {
-			nameFilter = NewNamespaceFilter(namespaces...)
+		listener := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
+		if !tlsOptions.enabled() {
+			return listener.ListenAndServe()
 		}
-		if tagRegexp == "" {
-			tagRegexp = ".*"
+		if listener.TLSConfig, err = tlsOptions.serverConfig(); err != nil {
+			return err
 		}
-		tagFilter, err := NewRegexTagFilter(tagRegexp)
+		log.Infof("Listening for notifications over https on %s", listener.Addr)
+		return listener.ListenAndServeTLS("", "")
+	},
+}
+
+// serverRequests the jobs from the config file, or if there are none a single job from the flags
+func serverRequests(cmd *cobra.Command) ([]ServerRequest, error) {
+	if viper.IsSet("jobs") {
+		return loadJobs(viper.Get("jobs"))
+	}
+	if !registriesGiven(cmd) {
+		return nil, fmt.Errorf("No jobs in the config file and no registries given")
+	}
+	request, err := flagRequest()
+	if err != nil {
+		return nil, err
+	}
+	return []ServerRequest{request}, nil
+}
+
+// flagRequest the job described by the command line flags
+func flagRequest() (ServerRequest, error) {
+	var mapping ImageMapping
+	for _, rule := range rewriteRules {
+		r, err := ParseRepositoryRule(rule)
 		if err != nil {
-			log.Errorf("Can't create filter from bad regular expression %s", tagRegexp)
-			return
+			return ServerRequest{}, err
 		}
-		filter := DockerImageFilter{nameFilter, tagFilter}
-		handler, err := NewDockerCLIHandler(registrySource, registryTarget, filter)
+		mapping.Repositories = append(mapping.Repositories, r)
+	}
+	for _, rule := range tagRules {
+		r, err := ParseTagRule(rule)
 		if err != nil {
-			log.Errorf("Couldn't not connect to registries %s %s",
-				registrySource.Address(), registryTarget.Address())
-			return
+			return ServerRequest{}, err
 		}
+		mapping.Tags = append(mapping.Tags, r)
+	}
+	source := registrySource
+	var err error
+	if source.platforms, err = ParsePlatforms(platforms); err != nil {
+		return ServerRequest{}, err
+	}
+	if err = events.validate(); err != nil {
+		return ServerRequest{}, err
+	}
+	targets := make([]RegistryInfo, 0, len(targetURLs))
+	for _, url := range targetURLs {
+		target := registryTarget
+		target.address = url
+		targets = append(targets, target)
+	}
+	options := filterOptions
+	// the flag, or else the config file or RR_NAMESPACE_REGEX
+	options.NamespaceRegex = viper.GetString("namespace-regex")
+	var webhooks []OutboundWebhook
+	for _, url := range notifyURLs {
+		webhook := notify
+		webhook.URL = url
+		webhooks = append(webhooks, webhook)
+	}
+	return ServerRequest{
+		name:          "default",
+		source:        source,
+		targets:       targets,
+		filterOptions: options,
+		engine:        copyEngine,
+		prune:         prune,
+		events:        events,
+		webhook:       webhookAuth,
+		notify:        webhooks,
+		mapping:       mapping,
+		frequency:     pollingFrequency,
+		resourcePath:  "/",
+	}, nil
+}
 
-		if pollingFrequency > 0 {
-			log.Infof("Setting up cron job for every %s ", pollingFrequency.String())
-			go func() {
-				c := time.Tick(pollingFrequency)
-				for range c {
-					// Note this purposfully runs the function
-					// in the same goroutine so we make sure there is
-					// only ever one. If it might take a long time and
-					// it's safe to have several running just add "go" here.
-					err := handler.RSync(filter)
-					if err != nil {
-						log.Errorf("Failure syncing between registries %s %s", registrySource.Address(),
-							registryTarget.Address())
-					}
-				}
-			}()
-		}
-		http.Handle("/", registryEventHandler(handler))
-		http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
-	},
+// registriesGiven checks both registries have been set, showing the usage when not
+func registriesGiven(cmd *cobra.Command) bool {
+	if registrySource.address == "" {
+		log.Error("No source registry address specified")
+		cmd.Usage()
+		return false
+	}
+	if len(targetURLs) == 0 {
+		log.Error("No target registry address specified")
+		cmd.Usage()
+		return false
+	}
+	return true
+}
+
+// retryPolicy the default policy with the attempts and backoff from the flags
+func retryPolicy(attempts int) RetryPolicy {
+	policy := DefaultRetryPolicy
+	policy.Attempts = attempts
+	policy.InitialBackoff = retryBackoff
+	return policy
 }
 
 // Execute adds all child commands to the root command sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	if err := RootCmd.Execute(); err != nil {
-		fmt.Println(err)
-		os.Exit(-1)
+		log.Error(err)
+		os.Exit(1)
 	}
 }
 
@@ -128,19 +227,68 @@ func init() {
 	cobra.OnInitialize(initConfig)
 
 	// TODO
-	RootCmd.Flags().StringVar(&registrySource.address, "source-url", "", "registry url to read images from")
-	RootCmd.Flags().StringVar(&registryTarget.address, "target-url", "", "registry url to send images to")
+	RootCmd.PersistentFlags().StringVar(&registrySource.address, "source-url", "", "registry url to read images from")
+	RootCmd.PersistentFlags().StringSliceVar(&targetURLs, "target-url", []string{}, "registry url to send images to.  Can have multiple, each image is pulled once and pushed to all of them")
+
+	RootCmd.PersistentFlags().StringVar(&registrySource.username, "source-user", "", "username for registry to read images from")
+	RootCmd.PersistentFlags().StringVar(&registryTarget.username, "target-user", "", "username for registry to send images to")
+	RootCmd.PersistentFlags().StringVar(&registrySource.password, "source-password", "", "password for registry to read images from")
+	RootCmd.PersistentFlags().StringVar(&registryTarget.password, "target-password", "", "password for registry to send images to")
 
-	RootCmd.Flags().StringVar(&registrySource.username, "source-user", "", "username for registry to read images from")
-	RootCmd.Flags().StringVar(&registryTarget.username, "target-user", "", "username for registry to send images to")
-	RootCmd.Flags().StringVar(&registrySource.password, "source-password", "", "password for registry to read images from")
-	RootCmd.Flags().StringVar(&registryTarget.password, "target-password", "", "password for registry to send images to")
+	RootCmd.PersistentFlags().IntVar(&sourceAttempts, "source-attempts", DefaultRetryPolicy.Attempts, "times to try an operation on the source registry before giving up")
+	RootCmd.PersistentFlags().IntVar(&targetAttempts, "target-attempts", DefaultRetryPolicy.Attempts, "times to try an operation on the target registry before giving up")
+	RootCmd.PersistentFlags().DurationVar(&retryBackoff, "retry-backoff", DefaultRetryPolicy.InitialBackoff, "how long to wait before retrying, doubled for every further attempt")
 
-	RootCmd.Flags().StringVar(&tagRegexp, "tag-regex", ".*", "regular expression of tags to match")
-	// RootCmd.Flags().StringSliceP(&namespaces, "name", []string{}, "namespace to watch.  Can have multiple. Blank for all")
+	RootCmd.PersistentFlags().StringSliceVar(&filterOptions.Namespaces, "name", []string{}, "namespace to watch.  Can have multiple. Blank for all")
+	RootCmd.PersistentFlags().StringVar(&filterOptions.NamespaceRegex, "namespace-regex", "", "regular expression of repositories to match")
+	RootCmd.PersistentFlags().StringVar(&filterOptions.TagRegex, "tag-regex", ".*", "regular expression of tags to match")
+	RootCmd.PersistentFlags().StringArrayVar(&filterOptions.Include.Repositories, "include-repo", []string{}, "Only match repositories matching one of these globs, or regex:<expression>.  Can have multiple")
+	RootCmd.PersistentFlags().StringArrayVar(&filterOptions.Exclude.Repositories, "exclude-repo", []string{}, "Never match repositories matching any of these globs, or regex:<expression>.  Can have multiple")
+	RootCmd.PersistentFlags().StringArrayVar(&filterOptions.Include.Tags, "include-tag", []string{}, "Only match tags matching one of these globs, or regex:<expression>.  Can have multiple")
+	RootCmd.PersistentFlags().StringArrayVar(&filterOptions.Exclude.Tags, "exclude-tag", []string{}, "Never match tags matching any of these globs, or regex:<expression>.  Can have multiple")
+	RootCmd.PersistentFlags().StringArrayVar(&filterOptions.Labels, "label", []string{}, "Only match images whose config has this label, <key>, !<key>, <key>=<value> or <key>!=<value>.  Can have multiple, all must match")
+	RootCmd.PersistentFlags().StringVar(&filterOptions.MaxAge, "max-age", "", "Only match images created at most this long ago, like 720h or 30d")
+	RootCmd.PersistentFlags().StringVar(&filterOptions.CreatedAfter, "created-after", "", "Only match images created after this date, like 2006-01-02")
+	RootCmd.PersistentFlags().StringVar(&filterOptions.CreatedBefore, "created-before", "", "Only match images created before this date, like 2006-01-02")
+	RootCmd.PersistentFlags().StringVar(&filterOptions.Semver, "semver", "", "Only match tags that are versions in a range like \">=2.3, <3\", \"^2.3\" or \"2.x || 3.1.x\"")
+	RootCmd.PersistentFlags().IntVar(&filterOptions.Newest, "newest", 0, "Only match the highest versions in each repository, 0 for all")
+	RootCmd.PersistentFlags().StringArrayVar(&rewriteRules, "rewrite", []string{}, "Rename repositories in the target, prefix:<from>=<to> or regex:<pattern>=<replacement>.  Can have multiple, the first that matches is used")
+	RootCmd.PersistentFlags().StringArrayVar(&tagRules, "rewrite-tag", []string{}, "Tag images differently in the target, <regex>=<tag>[,<tag>...] where tags can use $1 and {{.Repository}} {{.Tag}} {{.Digest}} {{.Date}}.  Can have multiple, the first that matches is used")
+	RootCmd.PersistentFlags().StringSliceVar(&platforms, "platform", []string{}, "Only copy these platforms of multi-arch images, like linux/amd64,linux/arm64/v8, writing an index with just them.  Blank for all.  Needs --engine registry")
+	RootCmd.Flags().StringVar(&copyEngine, "engine", "docker", "How images are copied. docker uses the docker cli, registry copies directly between registries")
 	// RootCmd.Flags().Duration(&pollingFrequency, "poll", "Set to have a cron job setup to converge")
 	RootCmd.Flags().DurationVar(&pollingFrequency, "poll", 0, "How frequently should we check the registries")
+	RootCmd.PersistentFlags().BoolVar(&prune.Enabled, "prune", false, "Mirror mode. Delete matching images from the target that aren't in the source")
+	RootCmd.Flags().BoolVar(&events.CopyUntagged, "copy-untagged", false, "Copy manifests pushed to the source without a tag by their digest. Needs --engine registry")
+	RootCmd.Flags().DurationVar(&events.DedupeWindow, "dedupe-window", defaultDedupeWindow, "How long notifications are remembered so repeats of them are dropped, 0 to keep them")
+	RootCmd.Flags().StringVar(&events.Deletes, "deletes", "prune", "What to do when notified of a delete in the source. prune deletes it from the targets when pruning, ignore never does")
+	RootCmd.PersistentFlags().IntVar(&prune.MaxDeletes, "prune-max", defaultPruneMax, "Most images a single sync may delete when pruning, 0 for no limit")
+	RootCmd.Flags().IntVar(&workerCount, "workers", 4, "Most images to copy at once, 0 for no limit")
+	RootCmd.Flags().IntVar(&targetWorkerCount, "target-workers", 0, "Most images to copy at once to any one target registry, 0 for no limit besides --workers")
 	// RootCmd.Flags().IntVar(p, name, value, usage)
+	RootCmd.PersistentFlags().StringVar(&webhookAuth.Token, "webhook-token", "", "Only accept notifications with this bearer token")
+	RootCmd.PersistentFlags().StringVar(&webhookAuth.User, "webhook-user", "", "Only accept notifications with this user and --webhook-password as basic auth")
+	RootCmd.PersistentFlags().StringVar(&webhookAuth.Password, "webhook-password", "", "Password for --webhook-user")
+	RootCmd.PersistentFlags().StringVar(&webhookAuth.Secret, "webhook-hmac-secret", "", "Only accept notifications signed with an HMAC-SHA256 of the body using this key")
+	RootCmd.PersistentFlags().StringVar(&webhookAuth.SignatureHeader, "webhook-hmac-header", defaultSignatureHeader, "Header with the signature of notifications, in hex optionally prefixed with sha256=")
+	RootCmd.PersistentFlags().StringSliceVar(&webhookAuth.Allow, "webhook-allow", []string{}, "Only accept notifications from these addresses or networks, like 10.0.0.0/8")
+	RootCmd.PersistentFlags().StringVar(&adminAuth.Token, "admin-token", "", "Serve the admin api under /api/, taking this bearer token")
+	RootCmd.PersistentFlags().StringVar(&adminAuth.User, "admin-user", "", "Serve the admin api under /api/, taking this user and --admin-password as basic auth")
+	RootCmd.PersistentFlags().StringVar(&adminAuth.Password, "admin-password", "", "Password for --admin-user")
+	RootCmd.PersistentFlags().StringSliceVar(&adminAuth.Allow, "admin-allow", []string{}, "Only accept admin api requests from these addresses or networks, like 10.0.0.0/8")
+	RootCmd.PersistentFlags().StringSliceVar(&notifyURLs, "notify-url", []string{}, "Post the result of every copy as JSON to this url.  Can have multiple")
+	RootCmd.PersistentFlags().StringVar(&notify.Template, "notify-template", "", "Template of what is posted to --notify-url, given the fields of the result, or slack for a Slack message.  Blank for the JSON of the result")
+	RootCmd.PersistentFlags().StringVar(&notify.Secret, "notify-hmac-secret", "", "Sign what is posted to --notify-url with an HMAC-SHA256 of the body using this key")
+	RootCmd.PersistentFlags().StringVar(&notify.SignatureHeader, "notify-hmac-header", defaultSignatureHeader, "Header with the signature of what is posted to --notify-url, as sha256=<hex>")
+	RootCmd.PersistentFlags().IntVar(&notify.Attempts, "notify-attempts", defaultOutboundAttempts, "Times to try posting a result to --notify-url before giving up")
+	RootCmd.Flags().StringVar(&tlsOptions.Cert, "tls-cert", "", "Certificate to serve notifications over https with, read again whenever it changes")
+	RootCmd.Flags().StringVar(&tlsOptions.Key, "tls-key", "", "Key of --tls-cert")
+	RootCmd.Flags().StringVar(&tlsOptions.ClientCA, "tls-client-ca", "", "Only accept notifications from clients with a certificate signed by one of the CAs in this file")
+	RootCmd.Flags().StringVar(&queueOptions.Dir, "queue-dir", "", "Where notifications are kept until they are copied, so none are lost on a restart.  Blank to only keep them in memory")
+	RootCmd.Flags().IntVar(&queueOptions.Workers, "queue-workers", DefaultQueueOptions.Workers, "Most notifications of a job worked on at once")
+	RootCmd.Flags().IntVar(&queueOptions.Attempts, "queue-attempts", DefaultQueueOptions.Attempts, "Times to try copying for a notification before it goes to the dead letters")
+	RootCmd.Flags().DurationVar(&queueOptions.Backoff, "queue-backoff", DefaultQueueOptions.Backoff, "How long to wait before trying a failed notification again, doubled for every further attempt")
+	RootCmd.Flags().DurationVar(&stallTimeout, "stall-timeout", defaultStallTimeout, "How long copies or the poll loop may go without getting anywhere before /healthz fails")
 	RootCmd.Flags().IntVar(&port, "port", 8787, "Port to  listen to notifications on")
 	RootCmd.PersistentFlags().BoolVarP(&debugLogging, "debug", "d", false, "turn on debug")
 
@@ -152,20 +300,55 @@ func init() {
 
 }
 
-// initConfig reads in config file and ENV variables if set.
-func initConfig() {
-	if cfgFile != "" { // enable ability to specify config file via flag
-		viper.SetConfigFile(cfgFile)
+// viperFlags the flags that can also be set in the config file or with RR_ environment variables
+var viperFlags = []string{"source-url",
+	"target-url", "source-user",
+	"target-user", "source-password", "target-password",
+	"name", "tag-regex", "semver", "newest", "namespace-regex",
+	"include-repo", "exclude-repo", "include-tag", "exclude-tag",
+	"label", "max-age", "created-after", "created-before", "platform", "port", "engine",
+	"prune", "prune-max", "workers", "target-workers",
+	"source-attempts", "target-attempts", "retry-backoff",
+	"webhook-token", "webhook-user", "webhook-password", "webhook-hmac-secret", "webhook-hmac-header", "webhook-allow",
+	"admin-token", "admin-user", "admin-password", "admin-allow",
+	"notify-url", "notify-template", "notify-hmac-secret", "notify-hmac-header", "notify-attempts",
+}
+
+// bindFlags binds the flags of the command to viper, whether they are persistent or its own
+func bindFlags(cmd *cobra.Command, names []string) error {
+	for _, name := range names {
+		flag := cmd.PersistentFlags().Lookup(name)
+		if flag == nil {
+			flag = cmd.Flags().Lookup(name)
+		}
+		if flag == nil {
+			return fmt.Errorf("no flag %s to bind", name)
+		}
+		if err := viper.BindPFlag(name, flag); err != nil {
+			return fmt.Errorf("couldn't bind flag %s : %s", name, err)
+		}
 	}
+	return nil
+}
 
-	viperStringFlags := []string{"source-url",
-		"target-url", "source-user",
-		"target-user", "source-password", "target-password",
-		"tag-regex", "namespace-regex", "port",
+// readFlags binds the flags of the root command to viper and reads the port, engine and workers
+// through it, so they can come from RR_ environment variables or the config file when the flag
+// isn't given
+func readFlags(root *cobra.Command) error {
+	if err := bindFlags(root, viperFlags); err != nil {
+		return err
 	}
+	port = viper.GetInt("port")
+	copyEngine = viper.GetString("engine")
+	workerCount = viper.GetInt("workers")
+	targetWorkerCount = viper.GetInt("target-workers")
+	return nil
+}
 
-	for _, flag := range viperStringFlags {
-		viper.BindPFlag(flag, RootCmd.PersistentFlags().Lookup(flag))
+// initConfig reads in config file and ENV variables if set.
+func initConfig() {
+	if cfgFile != "" { // enable ability to specify config file via flag
+		viper.SetConfigFile(cfgFile)
 	}
 
 	//Allow us to use RR environment variables
@@ -174,8 +357,11 @@ func initConfig() {
 	viper.SetEnvPrefix("rr")
 	viper.AutomaticEnv()
 
-	viper.SetConfigName("registryrsync.yml") // name of config file (without extension)
-	viper.AddConfigPath("$HOME")             // adding home directory as first search path
+	if cfgFile == "" {
+		// Setting the name clears any config file set above
+		viper.SetConfigName("registryrsync") // name of config file (without extension)
+		viper.AddConfigPath("$HOME")         // adding home directory as first search path
+	}
 
 	// If a config file is found, read it in.
 	if err := viper.ReadInConfig(); err == nil {
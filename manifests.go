@@ -0,0 +1,218 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+// The OCI media types, the vendored distribution predates them
+const (
+	mediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	mediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+)
+
+// isIndex true for manifest lists and OCI indexes, which point at a manifest for each platform
+func isIndex(mediaType string) bool {
+	return mediaType == manifestlist.MediaTypeManifestList || mediaType == mediaTypeOCIIndex
+}
+
+// isImageManifest true for manifests of a single image, made of a config and layers
+func isImageManifest(mediaType string) bool {
+	return mediaType == schema2.MediaTypeManifest || mediaType == mediaTypeOCIManifest
+}
+
+// isManifest true for any manifest we can copy, rather than a blob
+func isManifest(mediaType string) bool {
+	return isImageManifest(mediaType) || isIndex(mediaType)
+}
+
+// Platform an os and architecture, and optionally the variant, like linux/arm64/v8
+type Platform struct {
+	OS, Architecture, Variant string
+}
+
+// ParsePlatform reads os/architecture[/variant]
+func ParsePlatform(text string) (Platform, error) {
+	parts := strings.Split(text, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("platform %s should look like linux/amd64 or linux/arm64/v8", text)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+func (p Platform) String() string {
+	if p.Variant == "" {
+		return p.OS + "/" + p.Architecture
+	}
+	return p.OS + "/" + p.Architecture + "/" + p.Variant
+}
+
+// PlatformFilter the platforms copied from multi-arch images, all of them when empty
+type PlatformFilter []Platform
+
+// ParsePlatforms reads a list of platforms like linux/amd64
+func ParsePlatforms(texts []string) (PlatformFilter, error) {
+	var platforms PlatformFilter
+	for _, text := range texts {
+		p, err := ParsePlatform(text)
+		if err != nil {
+			return nil, err
+		}
+		platforms = append(platforms, p)
+	}
+	return platforms, nil
+}
+
+// matches a platform without a variant matches every variant of the architecture
+func (f PlatformFilter) matches(spec manifestlist.PlatformSpec) bool {
+	if len(f) == 0 {
+		return true
+	}
+	for _, p := range f {
+		if p.OS == spec.OS && p.Architecture == spec.Architecture && (p.Variant == "" || p.Variant == spec.Variant) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectManifests the manifests of an index for the platforms, and the index to push.  When some
+// platforms are left out the index is written again without them, otherwise it is kept as it was
+// so its digest doesn't change.  The same index always gives the same reduced index, so the digest
+// can be compared with an earlier copy.
+func selectManifests(payload []byte, platforms PlatformFilter) ([]byte, []manifestlist.ManifestDescriptor, error) {
+	var index map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &index); err != nil {
+		return nil, nil, err
+	}
+	var entries []json.RawMessage
+	if err := json.Unmarshal(index["manifests"], &entries); err != nil {
+		return nil, nil, err
+	}
+	var kept []json.RawMessage
+	var children []manifestlist.ManifestDescriptor
+	for _, entry := range entries {
+		var child manifestlist.ManifestDescriptor
+		if err := json.Unmarshal(entry, &child); err != nil {
+			return nil, nil, err
+		}
+		if platforms.matches(child.Platform) {
+			kept = append(kept, entry)
+			children = append(children, child)
+		}
+	}
+	if len(children) == 0 {
+		return nil, nil, fmt.Errorf("none of the platforms %v are in the index", platforms)
+	}
+	if len(kept) == len(entries) {
+		return payload, children, nil
+	}
+	manifests, err := json.Marshal(kept)
+	if err != nil {
+		return nil, nil, err
+	}
+	index["manifests"] = manifests
+	reduced, err := json.MarshalIndent(index, "", "   ")
+	return reduced, children, err
+}
+
+// imageBlobs the config and layers of a single image manifest
+func imageBlobs(payload []byte) ([]distribution.Descriptor, error) {
+	// an OCI manifest has the same layout as a schema2 one
+	var m schema2.Manifest
+	if err := json.Unmarshal(payload, &m); err != nil {
+		return nil, err
+	}
+	return append([]distribution.Descriptor{m.Config}, m.Layers...), nil
+}
+
+// childManifest a manifest an index points at, pushed by digest before the index
+type childManifest struct {
+	digest    digest.Digest
+	mediaType string
+	payload   []byte
+}
+
+// resolvedManifest a manifest ready to be pushed with everything it needs
+type resolvedManifest struct {
+	mediaType string
+	payload   []byte
+	children  []childManifest
+	// blobs every config and layer, each once, the config of the first image coming first
+	blobs []distribution.Descriptor
+}
+
+// manifestGetter fetches a manifest from a repository by tag or digest
+type manifestGetter func(reference string) (mediaType string, payload []byte, err error)
+
+// resolveManifest fetches a manifest and, for an index, the manifests of the platforms it has
+// that are wanted.  An image that isn't multi-arch is the same whatever the platforms.
+func resolveManifest(get manifestGetter, reference string, platforms PlatformFilter) (resolvedManifest, error) {
+	mediaType, payload, err := get(reference)
+	if err != nil {
+		return resolvedManifest{}, err
+	}
+	m := resolvedManifest{mediaType: mediaType, payload: payload}
+	switch {
+	case isImageManifest(mediaType):
+		m.blobs, err = imageBlobs(payload)
+		if err != nil {
+			return m, permanent(err)
+		}
+		return m, nil
+	case !isIndex(mediaType):
+		return m, permanent(fmt.Errorf("unsupported manifest type %q for %s", mediaType, reference))
+	}
+	reduced, children, err := selectManifests(payload, platforms)
+	if err != nil {
+		return m, permanent(fmt.Errorf("bad index %s : %s", reference, err))
+	}
+	m.payload = reduced
+	seen := make(map[digest.Digest]bool)
+	for _, child := range children {
+		childType, childPayload, err := get(child.Digest.String())
+		if err != nil {
+			return m, err
+		}
+		if digest.FromBytes(childPayload) != child.Digest {
+			return m, permanent(fmt.Errorf("manifest %s in index %s doesn't match its digest", child.Digest, reference))
+		}
+		if !isImageManifest(childType) {
+			return m, permanent(fmt.Errorf("unsupported manifest type %q in index %s", childType, reference))
+		}
+		blobs, err := imageBlobs(childPayload)
+		if err != nil {
+			return m, permanent(err)
+		}
+		m.children = append(m.children, childManifest{child.Digest, childType, childPayload})
+		for _, blob := range blobs {
+			if !seen[blob.Digest] {
+				seen[blob.Digest] = true
+				m.blobs = append(m.blobs, blob)
+			}
+		}
+	}
+	return m, nil
+}
+
+// indexDigest the digest of the manifest as it would be pushed with the platforms selected
+func indexDigest(mediaType string, payload []byte, platforms PlatformFilter) (digest.Digest, error) {
+	if len(platforms) > 0 && isIndex(mediaType) {
+		reduced, _, err := selectManifests(payload, platforms)
+		if err != nil {
+			return "", err
+		}
+		payload = reduced
+	}
+	return digest.FromBytes(payload), nil
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+)
+
+func TestParsePlatform(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    Platform
+		wantErr bool
+	}{
+		{"linux/amd64", Platform{"linux", "amd64", ""}, false},
+		{"linux/arm64/v8", Platform{"linux", "arm64", "v8"}, false},
+		{"linux", Platform{}, true},
+		{"linux/", Platform{}, true},
+		{"linux/arm/v7/extra", Platform{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParsePlatform(tt.text)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParsePlatform(%s) = %v, %v, want %v, error %v", tt.text, got, err, tt.want, tt.wantErr)
+		}
+		if err == nil && got.String() != tt.text {
+			t.Errorf("String() = %s, want %s", got, tt.text)
+		}
+	}
+}
+
+func TestSelectManifests(t *testing.T) {
+	f := newFakeRegistry()
+	defer f.Close()
+	images := map[string]digest.Digest{
+		"linux/amd64":    f.addImage("app", "", "amd64"),
+		"linux/arm64/v8": f.addImage("app", "", "arm64"),
+		"linux/arm/v7":   f.addImage("app", "", "arm"),
+	}
+	f.addIndex("app", "1.0", manifestlist.MediaTypeManifestList, images)
+	index, _ := f.manifest("app", "1.0")
+
+	tests := []struct {
+		name      string
+		platforms []string
+		want      []string
+		wantErr   bool
+	}{
+		{"all", nil, []string{"linux/amd64", "linux/arm/v7", "linux/arm64/v8"}, false},
+		{"some", []string{"linux/amd64", "linux/arm64"}, []string{"linux/amd64", "linux/arm64/v8"}, false},
+		{"variant", []string{"linux/arm/v6", "linux/arm/v7"}, []string{"linux/arm/v7"}, false},
+		{"none", []string{"windows/amd64"}, nil, true},
+	}
+	for _, tt := range tests {
+		platforms, _ := ParsePlatforms(tt.platforms)
+		reduced, children, err := selectManifests(index.payload, platforms)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%s: selectManifests() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+			continue
+		}
+		var got []string
+		for _, child := range children {
+			p := child.Platform
+			got = append(got, Platform{p.OS, p.Architecture, p.Variant}.String())
+			if child.Digest != images[got[len(got)-1]] {
+				t.Errorf("%s: child %s has digest %s", tt.name, got[len(got)-1], child.Digest)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: platforms = %v, want %v", tt.name, got, tt.want)
+		}
+		if err != nil {
+			continue
+		}
+		if len(got) == len(images) && string(reduced) != string(index.payload) {
+			t.Errorf("%s: index changed though nothing was left out", tt.name)
+		}
+		var written manifestlist.ManifestList
+		if err := json.Unmarshal(reduced, &written); err != nil || len(written.Manifests) != len(got) ||
+			written.MediaType != manifestlist.MediaTypeManifestList {
+			t.Errorf("%s: index written as %s", tt.name, reduced)
+		}
+	}
+}
+
+func TestRegistryCopyIndex(t *testing.T) {
+	for _, mediaType := range []string{manifestlist.MediaTypeManifestList, mediaTypeOCIIndex} {
+		source := newFakeRegistry()
+		target := newFakeRegistry()
+		index := source.addIndex("app", "1.0", mediaType, map[string]digest.Digest{
+			"linux/amd64": source.addImage("app", "", "shared", "amd64"),
+			"linux/arm64": source.addImage("app", "", "shared", "arm64"),
+		})
+
+		handler, err := NewRegistryCopyHandler(source.info(), target.info(), DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+		if err != nil {
+			t.Fatalf("NewRegistryCopyHandler() error = %v", err)
+		}
+		if err = handler.PullTagPush("app", "1.0"); err != nil {
+			t.Fatalf("PullTagPush() error = %v", err)
+		}
+		copied, ok := target.manifest("app", "1.0")
+		if !ok || digest.FromBytes(copied.payload) != index || copied.mediaType != mediaType {
+			t.Errorf("%s: index wasn't copied as it was", mediaType)
+		}
+		// the config and a layer the images share and a layer for each platform
+		if target.uploads != 4 {
+			t.Errorf("%s: %d blobs uploaded, want 4", mediaType, target.uploads)
+		}
+		source.Close()
+		target.Close()
+	}
+}
+
+func TestRegistryCopyPlatforms(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	amd64 := source.addImage("app", "", "amd64")
+	arm64 := source.addImage("app", "", "arm64")
+	source.addIndex("app", "1.0", manifestlist.MediaTypeManifestList,
+		map[string]digest.Digest{"linux/amd64": amd64, "linux/arm64": arm64})
+	source.addImage("app", "plain", "plain")
+
+	info := source.info()
+	info.platforms = PlatformFilter{{OS: "linux", Architecture: "arm64"}}
+	handler, err := NewRegistryCopyHandler(info, target.info(), DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyHandler() error = %v", err)
+	}
+	if err = handler.RSync(handler.filter); err != nil {
+		t.Fatalf("RSync() error = %v", err)
+	}
+	if _, ok := target.manifest("app", arm64.String()); !ok {
+		t.Error("arm64 manifest wasn't copied")
+	}
+	if _, ok := target.manifest("app", amd64.String()); ok {
+		t.Error("amd64 manifest was copied")
+	}
+	if _, ok := target.manifest("app", "plain"); !ok {
+		t.Error("image that isn't multi-arch wasn't copied")
+	}
+
+	// the reduced index has the digest the source gives with the platforms, so it is up to date
+	s, _ := info.GetRegistry()
+	d, _ := target.info().GetRegistry()
+	plan, err := Diff(s, d, handler.filter, ImageMapping{}, true)
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	if len(plan.Missing) != 0 || len(plan.Outdated) != 0 || len(plan.Extra) != 0 {
+		t.Errorf("Diff() = %+v after copying, want nothing to do", plan)
+	}
+	blobs, err := s.(blobRegistry).ImageBlobs("app", "1.0")
+	if err != nil || len(blobs) != 2 {
+		t.Errorf("ImageBlobs() = %v, %v, want the config and layer of arm64", blobs, err)
+	}
+}
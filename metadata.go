@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+)
+
+// imageConfig the parts of an image config, docker or OCI, we filter on
+type imageConfig struct {
+	Created time.Time
+	Config  struct {
+		Labels map[string]string
+	}
+}
+
+// configReader a registry we can read image configs from
+type configReader interface {
+	ManifestDigest(repository, reference string) (digest.Digest, error)
+	ImageBlobs(repository, reference string) ([]distribution.Descriptor, error)
+	ReadBlob(repository string, dgst digest.Digest) ([]byte, error)
+}
+
+// LabelMatcher a condition on one label of an image config
+type LabelMatcher struct {
+	Key string
+	// Op is one of exists, missing, = or !=
+	Op    string
+	Value string
+}
+
+// ParseLabelMatcher reads key for a label that is set, !key for one that isn't,
+// key=value or key!=value.  A missing label counts as not equal to any value.
+func ParseLabelMatcher(text string) (LabelMatcher, error) {
+	var m LabelMatcher
+	switch {
+	case strings.Contains(text, "!="):
+		n := strings.Index(text, "!=")
+		m = LabelMatcher{text[:n], "!=", text[n+2:]}
+	case strings.Contains(text, "="):
+		n := strings.Index(text, "=")
+		m = LabelMatcher{text[:n], "=", text[n+1:]}
+	case strings.HasPrefix(text, "!"):
+		m = LabelMatcher{Key: text[1:], Op: "missing"}
+	default:
+		m = LabelMatcher{Key: text, Op: "exists"}
+	}
+	m.Key = strings.TrimSpace(m.Key)
+	if m.Key == "" {
+		return m, fmt.Errorf("label matcher %s has no label", text)
+	}
+	return m, nil
+}
+
+// Matches true if the labels satisfy the condition
+func (m LabelMatcher) Matches(labels map[string]string) bool {
+	value, ok := labels[m.Key]
+	switch m.Op {
+	case "exists":
+		return ok
+	case "missing":
+		return !ok
+	case "=":
+		return ok && value == m.Value
+	}
+	return !ok || value != m.Value
+}
+
+func (m LabelMatcher) String() string {
+	switch m.Op {
+	case "exists":
+		return m.Key
+	case "missing":
+		return "!" + m.Key
+	}
+	return m.Key + m.Op + m.Value
+}
+
+// MetadataFilter selects images by the labels and creation date in their config.  Unlike
+// the repository and tag filters it has to fetch the manifest and config of each image, so
+// configs are cached by digest and an image that hasn't changed only costs a HEAD request.
+type MetadataFilter struct {
+	labels []LabelMatcher
+	// maxAge the oldest an image can be, 0 for any age
+	maxAge time.Duration
+	// after and before bound when the image was created, ignored when zero
+	after, before time.Time
+	cache         *configCache
+}
+
+// NewMetadataFilter an image has to match all the labels and be created within the bounds
+func NewMetadataFilter(labels []LabelMatcher, maxAge time.Duration, after, before time.Time) *MetadataFilter {
+	return &MetadataFilter{labels, maxAge, after, before, newConfigCache()}
+}
+
+// matchesConfig true if the config satisfies every condition
+func (m *MetadataFilter) matchesConfig(config imageConfig) bool {
+	for _, label := range m.labels {
+		if !label.Matches(config.Config.Labels) {
+			return false
+		}
+	}
+	if m.maxAge > 0 && (config.Created.IsZero() || now().Sub(config.Created) > m.maxAge) {
+		return false
+	}
+	if !m.after.IsZero() && !config.Created.After(m.after) {
+		return false
+	}
+	if !m.before.IsZero() && !config.Created.Before(m.before) {
+		return false
+	}
+	return true
+}
+
+// MatchesImage reads the config of the image from the registry, unless it is cached, to check it
+func (m *MetadataFilter) MatchesImage(reg Registry, image RegistryTarget) (bool, error) {
+	reader, ok := reg.(configReader)
+	if !ok {
+		return false, fmt.Errorf("can't read image configs from %v", reg)
+	}
+	config, err := m.cache.get(reader, image)
+	if err != nil {
+		return false, err
+	}
+	return m.matchesConfig(config), nil
+}
+
+// FilterImages the images whose config matches.  An image whose config can't be read is left out,
+// among the unreadable ones so it isn't taken for an image that no longer matches.
+func (m *MetadataFilter) FilterImages(reg Registry, images RegistryTargets) (matching, unreadable RegistryTargets) {
+	matching = make(RegistryTargets, 0, len(images))
+	for _, image := range images {
+		ok, err := m.MatchesImage(reg, image)
+		if err != nil {
+			log.Warnf("Leaving out %s:%s as its config can't be read : %s", image.Repository, image.Tag, err)
+			unreadable = append(unreadable, image)
+			continue
+		}
+		if ok {
+			matching = append(matching, image)
+		} else {
+			log.Debugf("Ignoring image %s:%s as its config doesn't match", image.Repository, image.Tag)
+		}
+	}
+	return matching, unreadable
+}
+
+// configCache image configs by digest.  Both are content addressed so they never go stale
+// and can be shared by the source and target registries.
+type configCache struct {
+	mu sync.Mutex
+	// manifests the config digest of each manifest
+	manifests map[digest.Digest]digest.Digest
+	configs   map[digest.Digest]imageConfig
+}
+
+func newConfigCache() *configCache {
+	return &configCache{
+		manifests: make(map[digest.Digest]digest.Digest),
+		configs:   make(map[digest.Digest]imageConfig),
+	}
+}
+
+func (c *configCache) get(reg configReader, image RegistryTarget) (imageConfig, error) {
+	manifest, err := reg.ManifestDigest(image.Repository, image.Tag)
+	if err != nil {
+		return imageConfig{}, err
+	}
+	c.mu.Lock()
+	configDigest, ok := c.manifests[manifest]
+	config, cached := c.configs[configDigest]
+	c.mu.Unlock()
+	if ok && cached {
+		return config, nil
+	}
+	blobs, err := reg.ImageBlobs(image.Repository, manifest.String())
+	if err != nil {
+		return imageConfig{}, err
+	}
+	configDigest = blobs[0].Digest
+	c.mu.Lock()
+	config, cached = c.configs[configDigest]
+	c.manifests[manifest] = configDigest
+	c.mu.Unlock()
+	if cached {
+		return config, nil
+	}
+	payload, err := reg.ReadBlob(image.Repository, configDigest)
+	if err != nil {
+		return imageConfig{}, err
+	}
+	if err = json.Unmarshal(payload, &config); err != nil {
+		return imageConfig{}, fmt.Errorf("bad config %s : %s", configDigest, err)
+	}
+	c.mu.Lock()
+	c.configs[configDigest] = config
+	c.mu.Unlock()
+	return config, nil
+}
+
+// parseAge reads a duration like 720h, also allowing whole days like 30d
+func parseAge(text string) (time.Duration, error) {
+	if strings.HasSuffix(text, "d") {
+		var days int
+		if _, err := fmt.Sscanf(text, "%dd", &days); err == nil && fmt.Sprintf("%dd", days) == text {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	return time.ParseDuration(text)
+}
+
+// parseDate reads a date like 2006-01-02 or a time in RFC 3339 format
+func parseDate(text string) (time.Time, error) {
+	if t, err := time.Parse(dateFormat, text); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, text)
+}
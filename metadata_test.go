@@ -0,0 +1,194 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+func TestParseLabelMatcher(t *testing.T) {
+	labels := map[string]string{"approved": "true", "revision": "abc123", "empty": ""}
+	tests := []struct {
+		text    string
+		want    bool
+		wantErr bool
+	}{
+		{"revision", true, false},
+		{"empty", true, false},
+		{"missing", false, false},
+		{"!missing", true, false},
+		{"!revision", false, false},
+		{"approved=true", true, false},
+		{"approved=false", false, false},
+		{"missing=true", false, false},
+		{"approved!=true", false, false},
+		{"approved!=false", true, false},
+		{"missing!=true", true, false},
+		{"=true", false, true},
+		{"!", false, true},
+	}
+	for _, tt := range tests {
+		m, err := ParseLabelMatcher(tt.text)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseLabelMatcher(%s) error = %v, wantErr %v", tt.text, err, tt.wantErr)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := m.Matches(labels); got != tt.want {
+			t.Errorf("%s matches = %v, want %v", tt.text, got, tt.want)
+		}
+		if m.String() != tt.text {
+			t.Errorf("String() = %s, want %s", m, tt.text)
+		}
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	tests := []struct {
+		text    string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"30d", 30 * 24 * time.Hour, false},
+		{"720h", 720 * time.Hour, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"1.5d", 0, true},
+		{"d", 0, true},
+	}
+	for _, tt := range tests {
+		got, err := parseAge(tt.text)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseAge(%s) = %v, %v, want %v, error %v", tt.text, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestMetadataFilterMatchesConfig(t *testing.T) {
+	defer func(saved func() time.Time) { now = saved }(now)
+	now = func() time.Time { return time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC) }
+	config := func(created string, labels map[string]string) imageConfig {
+		var c imageConfig
+		c.Created, _ = time.Parse(time.RFC3339, created)
+		c.Config.Labels = labels
+		return c
+	}
+	approved := []LabelMatcher{{"org.opencontainers.image.revision", "exists", ""}, {"com.genesys.approved", "=", "true"}}
+	tests := []struct {
+		name   string
+		filter *MetadataFilter
+		config imageConfig
+		want   bool
+	}{
+		{"approved", NewMetadataFilter(approved, 0, time.Time{}, time.Time{}),
+			config("", map[string]string{"org.opencontainers.image.revision": "abc", "com.genesys.approved": "true"}), true},
+		{"not approved", NewMetadataFilter(approved, 0, time.Time{}, time.Time{}),
+			config("", map[string]string{"org.opencontainers.image.revision": "abc", "com.genesys.approved": "false"}), false},
+		{"no labels", NewMetadataFilter(approved, 0, time.Time{}, time.Time{}), config("", nil), false},
+		{"recent", NewMetadataFilter(nil, 30*24*time.Hour, time.Time{}, time.Time{}),
+			config("2026-10-01T00:00:00Z", nil), true},
+		{"too old", NewMetadataFilter(nil, 30*24*time.Hour, time.Time{}, time.Time{}),
+			config("2026-09-01T00:00:00Z", nil), false},
+		{"no date", NewMetadataFilter(nil, 30*24*time.Hour, time.Time{}, time.Time{}), config("", nil), false},
+		{"between", NewMetadataFilter(nil, 0, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)),
+			config("2026-01-15T00:00:00Z", nil), true},
+		{"before bounds", NewMetadataFilter(nil, 0, time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}),
+			config("2025-12-31T00:00:00Z", nil), false},
+		{"after bounds", NewMetadataFilter(nil, 0, time.Time{}, time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)),
+			config("2026-03-01T00:00:00Z", nil), false},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.matchesConfig(tt.config); got != tt.want {
+			t.Errorf("%s: matchesConfig() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestGetMatchingImagesByMetadata(t *testing.T) {
+	defer func(saved func() time.Time) { now = saved }(now)
+	now = func() time.Time { return time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC) }
+	source := newFakeRegistry()
+	defer source.Close()
+	source.addImageWithConfig("app", "1.0", `{"created":"2026-10-10T00:00:00Z","config":{"Labels":{"com.genesys.approved":"true"}}}`, "a")
+	source.addImageWithConfig("app", "1.1", `{"created":"2026-10-11T00:00:00Z","config":{"Labels":{"com.genesys.approved":"false"}}}`, "b")
+	source.addImageWithConfig("app", "0.9", `{"created":"2026-01-01T00:00:00Z","config":{"Labels":{"com.genesys.approved":"true"}}}`, "c")
+	// another tag of an image already looked at needs no more downloads
+	source.addManifest("app", "stable", schema2.MediaTypeManifest, mustManifest(t, source, "app", "1.0"))
+
+	filter, err := newImageFilter(FilterOptions{Labels: []string{"com.genesys.approved=true"}, MaxAge: "30d"})
+	if err != nil {
+		t.Fatalf("newImageFilter() error = %v", err)
+	}
+	reg, err := source.info().GetRegistry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		images, err := GetMatchingImages(reg, filter)
+		if err != nil {
+			t.Fatalf("GetMatchingImages() error = %v", err)
+		}
+		if len(images) != 2 || images[0] != (RegistryTarget{"app", "1.0"}) || images[1] != (RegistryTarget{"app", "stable"}) {
+			t.Errorf("GetMatchingImages() = %v, want app:1.0 and app:stable", images)
+		}
+		if source.downloads != 3 {
+			t.Errorf("%d configs downloaded, want 3", source.downloads)
+		}
+	}
+
+	handler := ImageHandler{source: regSource{nil, source.info()}, filter: filter}
+	matches, err := handler.filter.matchesEvent(RegistryEvent{Action: "push", Target: RegistryTarget{"app", "1.1"}}, handler.source)
+	if err != nil || matches {
+		t.Errorf("matchesEvent(app:1.1) = %v, %v, want false", matches, err)
+	}
+	matches, err = handler.filter.matchesEvent(RegistryEvent{Action: "delete", Target: RegistryTarget{"app", "1.1"}}, handler.source)
+	if err != nil || !matches {
+		t.Errorf("matchesEvent(delete app:1.1) = %v, %v, want true", matches, err)
+	}
+}
+
+func mustManifest(t *testing.T, f *fakeRegistry, repo, ref string) []byte {
+	m, ok := f.manifest(repo, ref)
+	if !ok {
+		t.Fatalf("no manifest %s:%s", repo, ref)
+	}
+	return m.payload
+}
+
+func TestDiffKeepsImagesWhoseConfigCantBeRead(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	approved := func(tag string) string {
+		return `{"config":{"Labels":{"com.genesys.approved":"true"},"Env":["VERSION=` + tag + `"]}}`
+	}
+	for _, tag := range []string{"1.0", "2.0"} {
+		source.addImageWithConfig("app", tag, approved(tag), tag)
+		target.addImageWithConfig("app", tag, approved(tag), tag)
+	}
+	target.addImageWithConfig("app", "0.9", approved("0.9"), "0.9")
+	// the config of 2.0 is gone from the source, so it can't tell if 2.0 is still approved
+	source.mu.Lock()
+	delete(source.blobs["app"], digest.FromBytes([]byte(approved("2.0"))))
+	source.mu.Unlock()
+
+	filter, err := newImageFilter(FilterOptions{Labels: []string{"com.genesys.approved=true"}})
+	if err != nil {
+		t.Fatalf("newImageFilter() error = %v", err)
+	}
+	s, _ := source.info().GetRegistry()
+	d, _ := target.info().GetRegistry()
+	plan, err := Diff(s, d, filter, ImageMapping{}, true)
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	want := SyncPlan{Missing: RegistryTargets{}, Outdated: RegistryTargets{}, Extra: RegistryTargets{{"app", "0.9"}}}
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("Diff() = %+v, want %+v", plan, want)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// metricsPath where the metrics are served in the Prometheus text format
+const metricsPath = "/metrics"
+
+// durationBuckets the upper bounds in seconds of the buckets of the duration histograms, from a
+// small image on the same network up to a sync of a whole registry
+var durationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+var (
+	eventsReceived = newMetric("registryrsync_events_received_total", "counter",
+		"Notifications received by each job, by action", "job", "action")
+	imagesCopied = newMetric("registryrsync_images_copied_total", "counter",
+		"Images copied to each target", "job", "target")
+	imagesFailed = newMetric("registryrsync_images_failed_total", "counter",
+		"Copies of images to each target that failed", "job", "target")
+	bytesCopied = newMetric("registryrsync_bytes_copied_total", "counter",
+		"Bytes of layers and manifests uploaded to each target, only known with the registry engine", "job", "target")
+	copyDuration = newHistogram("registryrsync_copy_duration_seconds",
+		"How long copying an image to all the targets needing it took", durationBuckets, "job")
+	consolidateDuration = newHistogram("registryrsync_consolidate_duration_seconds",
+		"How long a sync of the whole source to the targets took", durationBuckets, "job")
+	imagesMissing = newMetric("registryrsync_images_missing", "gauge",
+		"Images missing or outdated in each target after the last sync", "job", "target")
+	lastSuccess = newMetric("registryrsync_last_success_timestamp_seconds", "gauge",
+		"When a sync of each job last finished without errors, as a unix time", "job")
+)
+
+// allMetrics everything served, in the order written
+var allMetrics = []*metric{
+	eventsReceived, imagesCopied, imagesFailed, bytesCopied,
+	copyDuration, consolidateDuration, imagesMissing, lastSuccess,
+}
+
+// metric a counter, gauge or histogram with a value for each set of label values
+type metric struct {
+	name, kind, help string
+	labels           []string
+	buckets          []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series the value of a metric for one set of label values
+type series struct {
+	labels []string
+	value  float64
+	// counts of the observations in each bucket of a histogram, not including the ones before
+	counts []uint64
+	count  uint64
+}
+
+func newMetric(name, kind, help string, labels ...string) *metric {
+	return &metric{name: name, kind: kind, help: help, labels: labels, series: make(map[string]*series)}
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	m := newMetric(name, "histogram", help, labels...)
+	m.buckets = buckets
+	return m
+}
+
+// get the series for the label values, creating it the first time.  Called with the lock held.
+func (m *metric) get(labels []string) *series {
+	if len(labels) != len(m.labels) {
+		panic(fmt.Sprintf("metric %s takes labels %v, given %v", m.name, m.labels, labels))
+	}
+	key := strings.Join(labels, "\x00")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: labels, counts: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add to a counter or gauge
+func (m *metric) add(value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labels).value += value
+}
+
+// set a gauge
+func (m *metric) set(value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(labels).value = value
+}
+
+// observe a value of a histogram
+func (m *metric) observe(value float64, labels ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(labels)
+	s.value += value
+	s.count++
+	for n, bound := range m.buckets {
+		if value <= bound {
+			s.counts[n]++
+			break
+		}
+	}
+}
+
+// value of a counter or gauge, 0 when it hasn't been set
+func (m *metric) valueOf(labels ...string) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s, ok := m.series[strings.Join(labels, "\x00")]; ok {
+		return s.value
+	}
+	return 0
+}
+
+// write the metric in the Prometheus text format, its series sorted so it reads the same each time
+func (m *metric) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.name, m.help, m.name, m.kind)
+	keys := make([]string, 0, len(m.series))
+	for key := range m.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			fmt.Fprintf(w, "%s%s %s\n", m.name, m.labelText(s.labels), formatValue(s.value))
+			continue
+		}
+		var cumulative uint64
+		for n, bound := range m.buckets {
+			cumulative += s.counts[n]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelText(s.labels, "le", formatValue(bound)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", m.name, m.labelText(s.labels, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", m.name, m.labelText(s.labels), formatValue(s.value))
+		fmt.Fprintf(w, "%s_count%s %d\n", m.name, m.labelText(s.labels), s.count)
+	}
+}
+
+// labelText the labels like {job="a",target="b"}, with any extra name and value pairs after them
+func (m *metric) labelText(values []string, extra ...string) string {
+	var pairs []string
+	for n, name := range m.labels {
+		pairs = append(pairs, name+"="+quoteLabel(values[n]))
+	}
+	for n := 0; n+1 < len(extra); n += 2 {
+		pairs = append(pairs, extra[n]+"="+quoteLabel(extra[n+1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// labelEscaper escapes what the text format needs escaping in label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// metricsHandler serves every metric in the Prometheus text format
+func metricsHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buffered := bufio.NewWriter(w)
+		for _, m := range allMetrics {
+			m.write(buffered)
+		}
+		if err := buffered.Flush(); err != nil {
+			log.Warnf("Couldn't write metrics : %s", err)
+		}
+	}
+}
+
+// recordCopy counts the copy of an image to a target
+func recordCopy(job string, result CopyResult) {
+	if result.Error != "" {
+		imagesFailed.add(1, job, result.Registry)
+		return
+	}
+	imagesCopied.add(1, job, result.Registry)
+	bytesCopied.add(float64(result.Bytes), job, result.Registry)
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// resetMetrics forgets what was recorded before, by other tests or earlier runs of the same one
+func resetMetrics() {
+	for _, m := range allMetrics {
+		m.mu.Lock()
+		m.series = make(map[string]*series)
+		m.mu.Unlock()
+	}
+}
+
+func TestMetricWrite(t *testing.T) {
+	counter := newMetric("test_total", "counter", "Things", "job", "action")
+	counter.add(2, "b", "push")
+	counter.add(1, "a", `say "hi"`)
+	counter.add(1, "b", "push")
+	histogram := newHistogram("test_seconds", "Time", []float64{1, 5}, "job")
+	for _, value := range []float64{0.5, 3, 4, 10} {
+		histogram.observe(value, "a")
+	}
+	gauge := newMetric("test_gauge", "gauge", "Level")
+	gauge.set(5)
+	gauge.set(1.5)
+
+	var out bytes.Buffer
+	for _, m := range []*metric{counter, histogram, gauge} {
+		m.write(&out)
+	}
+	want := `# HELP test_total Things
+# TYPE test_total counter
+test_total{job="a",action="say \"hi\""} 1
+test_total{job="b",action="push"} 3
+# HELP test_seconds Time
+# TYPE test_seconds histogram
+test_seconds_bucket{job="a",le="1"} 1
+test_seconds_bucket{job="a",le="5"} 3
+test_seconds_bucket{job="a",le="+Inf"} 4
+test_seconds_sum{job="a"} 17.5
+test_seconds_count{job="a"} 4
+# HELP test_gauge Level
+# TYPE test_gauge gauge
+test_gauge 1.5
+`
+	if out.String() != want {
+		t.Errorf("wrote\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+func TestSyncMetrics(t *testing.T) {
+	resetMetrics()
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	source.addImage("team/app", "1.0", "base")
+	source.addImage("team/app", "2.0", "base", "app")
+	filter := DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}}
+
+	handler, err := NewRegistryCopyFanOut(source.info(), []RegistryInfo{target.info()}, filter)
+	if err != nil {
+		t.Fatalf("NewRegistryCopyFanOut() error = %v", err)
+	}
+	handler.job = "metrics-sync"
+	if err = handler.RSync(filter); err != nil {
+		t.Fatalf("RSync() error = %v", err)
+	}
+	if got := imagesCopied.valueOf("metrics-sync", target.URL); got != 2 {
+		t.Errorf("copied %v, want 2", got)
+	}
+	if got := bytesCopied.valueOf("metrics-sync", target.URL); got <= float64(len("base")+len("app")) {
+		t.Errorf("copied %v bytes, want the layers, configs and manifests", got)
+	}
+	if got := imagesMissing.valueOf("metrics-sync", target.URL); got != 0 {
+		t.Errorf("%v missing after the sync, want none", got)
+	}
+	if got := lastSuccess.valueOf("metrics-sync"); time.Since(time.Unix(int64(got), 0)) > time.Minute {
+		t.Errorf("last success at %v", got)
+	}
+
+	// the target can't take the new image, so it is still missing after the next sync
+	source.addImage("team/app", "3.0", "base", "more")
+	handler.handlers[0].target.pusher = recordingPusher{failPrefix: target.URL}
+	before := lastSuccess.valueOf("metrics-sync")
+	if err = handler.RSync(filter); err == nil {
+		t.Fatal("RSync() should fail")
+	}
+	if got := imagesMissing.valueOf("metrics-sync", target.URL); got != 1 {
+		t.Errorf("%v missing, want the one that failed", got)
+	}
+	if got := imagesFailed.valueOf("metrics-sync", target.URL); got != 1 {
+		t.Errorf("%v failed, want 1", got)
+	}
+	if got := lastSuccess.valueOf("metrics-sync"); got != before {
+		t.Errorf("last success moved to %v after a failed sync", got)
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(w, httptest.NewRequest("GET", metricsPath, nil))
+	for _, line := range []string{
+		`registryrsync_images_copied_total{job="metrics-sync",target="` + target.URL + `"} 2`,
+		`registryrsync_consolidate_duration_seconds_count{job="metrics-sync"} 2`,
+		`registryrsync_copy_duration_seconds_count{job="metrics-sync"} 3`,
+	} {
+		if !strings.Contains(w.Body.String(), line+"\n") {
+			t.Errorf("metrics don't have %s", line)
+		}
+	}
+}
+
+func TestEventMetrics(t *testing.T) {
+	resetMetrics()
+	d := NewEventDispatcher("metrics-events", &RecorderHandler{}, EventPolicy{})
+	for _, action := range []string{"push", "pull", "pull", "made-up-1", "made-up-2"} {
+		d.Handle(RegistryEvent{Action: action, Target: RegistryTarget{"app", "1.0"}})
+	}
+	if push, pull := eventsReceived.valueOf("metrics-events", "push"), eventsReceived.valueOf("metrics-events", "pull"); push != 1 || pull != 2 {
+		t.Errorf("received %v pushes and %v pulls, want 1 and 2", push, pull)
+	}
+	if other, made := eventsReceived.valueOf("metrics-events", "other"), eventsReceived.valueOf("metrics-events", "made-up-1"); other != 2 || made != 0 {
+		t.Errorf("received %v other and %v made-up-1, want the unknown actions counted as other", other, made)
+	}
+	if got, want := d.summary(), "other ignored 2, pull ignored 2, push handled 1"; got != want {
+		t.Errorf("summary() = %s, want %s", got, want)
+	}
+}
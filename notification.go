@@ -1,14 +1,93 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/digest"
 )
 
+// Envelope a notification as the registry sends it, see the sample at the end
+type Envelope struct {
+	Events []Event
+}
+
+// Event everything the registry tells us about one thing that happened to it
+type Event struct {
+	ID        string
+	Timestamp time.Time
+	Action    string
+	Target    EventTarget
+	Request   RequestRecord
+	Actor     ActorRecord
+	Source    SourceRecord
+}
+
+// EventTarget the manifest or blob the event is about.  Deletes only have the repository and digest.
+type EventTarget struct {
+	MediaType  string
+	Size       int64
+	Digest     digest.Digest
+	Length     int64
+	Repository string
+	URL        string
+	Tag        string
+}
+
+// RequestRecord the request to the registry that caused the event
+type RequestRecord struct {
+	ID        string
+	Addr      string
+	Host      string
+	Method    string
+	UserAgent string `json:"useragent"`
+}
+
+// ActorRecord who made the request, empty when the registry doesn't check
+type ActorRecord struct {
+	Name string
+}
+
+// SourceRecord the registry instance that sent the event
+type SourceRecord struct {
+	Addr       string
+	InstanceID string `json:"instanceID"`
+}
+
+// registryEvent the event for the handlers, keeping the digest so the exact manifest is copied
+func (e Event) registryEvent() RegistryEvent {
+	return RegistryEvent{
+		Action:       e.Action,
+		Target:       RegistryTarget{e.Target.Repository, e.Target.Tag},
+		Digest:       e.Target.Digest,
+		Notification: &e,
+	}
+}
+
+// maxNotificationBytes the most of a notification read, far more than registries send
+const maxNotificationBytes = 4 << 20
+
+// readNotification reads the body of the request, failing once it is over maxNotificationBytes
+func readNotification(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	return ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxNotificationBytes))
+}
+
+// tooLarge true when reading the body failed for it being over the limit
+func tooLarge(err error) bool {
+	_, ok := err.(*http.MaxBytesError)
+	return ok
+}
+
+// registryEventHandler takes notifications in any of the formats we know, telling them apart by their fields
 func registryEventHandler(handler RegistryEventHandler) http.HandlerFunc {
+	return payloadHandler(handler, detectingDecoder(PayloadDecoders))
+}
+
+// payloadHandler takes notifications in the format of the decoder
+func payloadHandler(handler RegistryEventHandler, decoder PayloadDecoder) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		log.Infof("Got new request")
 		if r.Body == nil {
@@ -17,18 +96,30 @@ func registryEventHandler(handler RegistryEventHandler) http.HandlerFunc {
 		}
 		log.Debugf("Processing Notification event")
 
-		var events RegistryEvents
-		err := json.NewDecoder(r.Body).Decode(&events)
+		body, err := readNotification(w, r)
+		if tooLarge(err) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		events, err := decoder.Decode(body)
 		if err != nil {
-			log.Warnf("Couldn't decode")
+			log.Warnf("Couldn't decode as %s : %s", decoder.Name(), err)
 
 			http.Error(w, err.Error(), 400)
 			return
 		}
 		log.Debugf("Got back events %v", events)
 
-		for _, event := range events.Events {
-			handler.Handle(event)
+		for _, event := range events {
+			if err = handler.Handle(event); err != nil {
+				// the registry sends the notification again when it isn't acknowledged
+				http.Error(w, "Couldn't queue events", http.StatusServiceUnavailable)
+				return
+			}
 		}
 		fmt.Fprintf(w, "Events processed")
 	}
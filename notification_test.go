@@ -3,10 +3,9 @@ package main
 import (
 	"net/http"
 	"net/http/httptest"
+	"reflect"
 	"strings"
 	"testing"
-
-	. "github.com/smartystreets/goconvey/convey"
 )
 
 type RecorderHandler struct {
@@ -19,17 +18,14 @@ func (r *RecorderHandler) Handle(event RegistryEvent) error {
 }
 
 func Test_registryEventHandler(t *testing.T) {
-	type args struct {
-		requestBody string
-		handler     *RecorderHandler
-	}
 	tests := []struct {
-		name string
-		args args
-		want []RegistryEvent
+		name        string
+		requestBody string
+		wantStatus  int
+		want        []RegistryEvent
 	}{{
 		"Full event notification",
-		args{`{
+		`{
 			"events": [
 			 {
 					"id": "320678d8-ca14-430f-8bb6-4ca139cd83f7",
@@ -59,28 +55,73 @@ func Test_registryEventHandler(t *testing.T) {
 			 }
 		]
 	}`,
-			&RecorderHandler{}},
-		[]RegistryEvent{RegistryEvent{"pull", RegistryTarget{"helllo-world", "latest"}}},
+		http.StatusOK,
+		[]RegistryEvent{RegistryEvent{Action: "pull", Target: RegistryTarget{"hello-world", "latest"},
+			Digest: "sha256:fea8895f450959fa676bcc1df0611ea93823a735a01205fd8622846041d0c7cf"}},
+	}, {
+		"Not a notification",
+		`hello-world:latest`,
+		http.StatusBadRequest,
+		nil,
 	}}
-	Convey("We can parse out", t, func() {
-		for _, tt := range tests {
-			Convey(tt.name, func() {
-				t.Run(tt.name, func(t *testing.T) {
-					eventHandler := registryEventHandler(tt.args.handler)
-					req, _ := http.NewRequest("POST", "/", strings.NewReader(tt.args.requestBody))
-					w := httptest.NewRecorder()
-					eventHandler.ServeHTTP(w, req)
-					//TODO this isn't really data driven. i.e. I can't return non 200 with
-					// this approach
-					if w.Code != http.StatusOK {
-						t.Errorf("Home page didn't return %v", http.StatusOK)
-					}
-					ShouldResemble(tt.args.handler.events, tt.want)
-					// if got := tt.args.handler.events; !reflect.DeepEqual(got, tt.want) {
-					// 	t.Errorf("didn't handle events() = %v, want %v", got, tt.want)
-					// }
-				})
-			})
-		}
-	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := &RecorderHandler{}
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.requestBody))
+			w := httptest.NewRecorder()
+			registryEventHandler(handler).ServeHTTP(w, req)
+			if w.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d : %s", w.Code, tt.wantStatus, w.Body.String())
+			}
+			// the notification each event came from is checked by TestEnvelopeEvents
+			var got []RegistryEvent
+			for _, evt := range handler.events {
+				evt.Notification = nil
+				got = append(got, evt)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("handled %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvelopeEvents(t *testing.T) {
+	body := `{"events": [{
+		"id": "320678d8-ca14-430f-8bb6-4ca139cd83f7",
+		"timestamp": "2016-03-09T14:44:26.402973972-08:00",
+		"action": "push",
+		"target": {
+			"mediaType": "application/vnd.docker.distribution.manifest.v2+json",
+			"size": 708,
+			"digest": "sha256:fea8895f450959fa676bcc1df0611ea93823a735a01205fd8622846041d0c7cf",
+			"length": 708,
+			"repository": "hello-world",
+			"url": "http://192.168.100.227:5000/v2/hello-world/manifests/sha256:fea8895f450959fa676bcc1df0611ea93823a735a01205fd8622846041d0c7cf",
+			"tag": "latest"
+		},
+		"request": {"id": "6df24a34", "addr": "192.168.64.11:42961", "host": "192.168.100.227:5000", "method": "PUT", "useragent": "docker/1.13"},
+		"actor": {"name": "ci"},
+		"source": {"addr": "xtal.local:5000", "instanceID": "a53db899-3b4b-4a62-a067-8dd013beaca4"}
+	}]}`
+	handler := &RecorderHandler{}
+	w := httptest.NewRecorder()
+	registryEventHandler(handler).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	if w.Code != http.StatusOK || len(handler.events) != 1 {
+		t.Fatalf("got status %d and events %v", w.Code, handler.events)
+	}
+	evt := handler.events[0]
+	if evt.Action != "push" || evt.Target != (RegistryTarget{"hello-world", "latest"}) ||
+		evt.Digest != "sha256:fea8895f450959fa676bcc1df0611ea93823a735a01205fd8622846041d0c7cf" {
+		t.Errorf("event = %v", evt)
+	}
+	n := evt.Notification
+	if n == nil {
+		t.Fatal("event lost the notification")
+	}
+	if n.ID != "320678d8-ca14-430f-8bb6-4ca139cd83f7" || n.Timestamp.IsZero() || n.Target.Size != 708 ||
+		n.Request.Method != "PUT" || n.Request.UserAgent != "docker/1.13" || n.Actor.Name != "ci" ||
+		n.Source.InstanceID != "a53db899-3b4b-4a62-a067-8dd013beaca4" {
+		t.Errorf("notification = %+v", *n)
+	}
 }
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution/digest"
+)
+
+// CopyResult what happened copying an image to one target, the document sent to outbound webhooks
+type CopyResult struct {
+	Job    string `json:"job"`
+	Status string `json:"status"`
+	// Source the image copied, like staging.example.com/app:1.4.2
+	Source string `json:"source"`
+	// Registry the address of the target
+	Registry string `json:"registry"`
+	// Targets the names the image was pushed as, none when it failed before they were known
+	Targets []string `json:"targets"`
+	// Digest the manifest in the target, when the engine can tell
+	Digest digest.Digest `json:"digest,omitempty"`
+	// Duration in seconds
+	Duration float64 `json:"duration"`
+	// Bytes of layers and manifests uploaded to the target, 0 with the docker engine which doesn't say
+	Bytes int64     `json:"bytes"`
+	Error string    `json:"error,omitempty"`
+	Time  time.Time `json:"time"`
+}
+
+// OutboundWebhook somewhere the results of copies are posted
+type OutboundWebhook struct {
+	URL string
+	// Template of the body, given the CopyResult, or slack for a message an incoming webhook of
+	// Slack takes.  The JSON of the CopyResult when blank.
+	Template string
+	// Secret the key of an HMAC-SHA256 of the body, sent in hex as sha256=<hex> in the SignatureHeader
+	Secret          string `mapstructure:"hmac-secret"`
+	SignatureHeader string `mapstructure:"hmac-header"`
+	// Attempts in total before giving up on a result, the default when 0
+	Attempts int
+}
+
+// defaultOutboundAttempts times each result is posted before giving up unless told otherwise
+const defaultOutboundAttempts = 3
+
+// slackTemplate a message for the incoming webhooks of Slack, and chat tools copying them
+const slackTemplate = `{"text": {{if .Error}}{{json (printf ":x: %s couldn't copy %s to %s : %s" .Job .Source .Registry .Error)}}` +
+	`{{else}}{{json (printf ":white_check_mark: %s copied %s to %s in %.1fs" .Job .Source (join .Targets ", ") .Duration)}}{{end}}}`
+
+// templateFuncs what templates can use besides the builtins
+var templateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		text, err := json.Marshal(value)
+		return string(text), err
+	},
+	"join": strings.Join,
+}
+
+// Notifier posts the results of the copies of a job to its outbound webhooks, in the background
+// so a slow webhook doesn't hold up copying
+type Notifier struct {
+	job    string
+	hooks  []outboundHook
+	client *http.Client
+	// sent the results being posted
+	sent sync.WaitGroup
+}
+
+type outboundHook struct {
+	OutboundWebhook
+	template *template.Template
+	retry    RetryPolicy
+}
+
+// NewNotifier checks the webhooks for the job called name make sense
+func NewNotifier(name string, webhooks []OutboundWebhook) (*Notifier, error) {
+	n := &Notifier{job: name, client: &http.Client{Timeout: 30 * time.Second}}
+	for _, webhook := range webhooks {
+		if webhook.URL == "" {
+			return nil, fmt.Errorf("outbound webhook without a url")
+		}
+		hook := outboundHook{OutboundWebhook: webhook, retry: DefaultRetryPolicy}
+		if hook.SignatureHeader == "" {
+			hook.SignatureHeader = defaultSignatureHeader
+		}
+		if hook.Attempts > 0 {
+			hook.retry.Attempts = hook.Attempts
+		} else {
+			hook.retry.Attempts = defaultOutboundAttempts
+		}
+		text := webhook.Template
+		if text == "slack" {
+			text = slackTemplate
+		}
+		if text != "" {
+			t, err := template.New(webhook.URL).Funcs(templateFuncs).Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("bad template for outbound webhook %s : %s", webhook.URL, err)
+			}
+			hook.template = t
+		}
+		n.hooks = append(n.hooks, hook)
+	}
+	return n, nil
+}
+
+// Notify posts the result to every webhook, doing nothing when there aren't any
+func (n *Notifier) Notify(result CopyResult) {
+	if n == nil || len(n.hooks) == 0 {
+		return
+	}
+	result.Job = n.job
+	for _, hook := range n.hooks {
+		n.sent.Add(1)
+		go func(hook outboundHook) {
+			defer n.sent.Done()
+			err := hook.retry.Do("posting result to "+hook.URL, func() error {
+				return n.post(hook, result)
+			})
+			if err != nil {
+				log.Warnf("Couldn't tell %s that %s %s to %s : %s", hook.URL, result.Source, result.Status, result.Registry, err)
+			}
+		}(hook)
+	}
+}
+
+// Wait until the results being posted have been, for tests and shutting down
+func (n *Notifier) Wait() {
+	if n != nil {
+		n.sent.Wait()
+	}
+}
+
+func (n *Notifier) post(hook outboundHook, result CopyResult) error {
+	body, err := hook.body(result)
+	if err != nil {
+		return permanent(err)
+	}
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if hook.Secret != "" {
+		req.Header.Set(hook.SignatureHeader, "sha256="+signBody(hook.Secret, body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		err = fmt.Errorf("got status %s", resp.Status)
+		// like the registries, only worth trying again if the webhook is having trouble
+		if resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusRequestTimeout {
+			return permanent(err)
+		}
+		return err
+	}
+	return nil
+}
+
+// body the result as JSON, or through the template of the webhook
+func (h outboundHook) body(result CopyResult) ([]byte, error) {
+	if h.template == nil {
+		return json.Marshal(result)
+	}
+	var body bytes.Buffer
+	if err := h.template.Execute(&body, result); err != nil {
+		return nil, err
+	}
+	return body.Bytes(), nil
+}
+
+// signBody the HMAC-SHA256 of the body in hex
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// qualifiedName the image with the address of its registry in front, left alone for the docker hub
+func qualifiedName(address, name string) string {
+	if address == "" {
+		return name
+	}
+	return address + "/" + name
+}
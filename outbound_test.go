@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// webhookReceiver records what is posted to it, answering with the statuses given in turn and then 200
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	statuses []int
+	bodies   []string
+	headers  []http.Header
+}
+
+func newWebhookReceiver(statuses ...int) *webhookReceiver {
+	r := &webhookReceiver{statuses: statuses}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.bodies = append(r.bodies, string(body))
+		r.headers = append(r.headers, req.Header)
+		if len(r.statuses) > 0 {
+			w.WriteHeader(r.statuses[0])
+			r.statuses = r.statuses[1:]
+		}
+	}))
+	return r
+}
+
+func (r *webhookReceiver) received() ([]string, []http.Header) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.bodies...), append([]http.Header{}, r.headers...)
+}
+
+// results the copy results posted as JSON, sorted by target
+func (r *webhookReceiver) results(t *testing.T) []CopyResult {
+	bodies, _ := r.received()
+	var results []CopyResult
+	for _, body := range bodies {
+		var result CopyResult
+		if err := json.Unmarshal([]byte(body), &result); err != nil {
+			t.Fatalf("posted %s : %s", body, err)
+		}
+		results = append(results, result)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Registry < results[j].Registry })
+	return results
+}
+
+func TestNotifierPostsResults(t *testing.T) {
+	defer func(original func(time.Duration)) { sleep = original }(sleep)
+	sleep = func(time.Duration) {}
+	signed := newWebhookReceiver(http.StatusServiceUnavailable)
+	defer signed.Close()
+	slack := newWebhookReceiver()
+	defer slack.Close()
+	rejecting := newWebhookReceiver(http.StatusBadRequest)
+	defer rejecting.Close()
+
+	n, err := NewNotifier("promote", []OutboundWebhook{
+		{URL: signed.URL, Secret: "s3cret"},
+		{URL: slack.URL, Template: "slack"},
+		{URL: rejecting.URL, Template: `{{.Source}} {{.Status}}`},
+	})
+	if err != nil {
+		t.Fatalf("NewNotifier() error = %v", err)
+	}
+	result := CopyResult{Status: "succeeded", Source: "staging/app:1.4.2", Registry: "prod",
+		Targets: []string{"prod/app:1.4.2", "prod/app:stable"}, Digest: digest.Digest("sha256:aaaa"), Duration: 2.5, Bytes: 1024}
+	n.Notify(result)
+	n.Wait()
+
+	bodies, headers := signed.received()
+	if len(bodies) != 2 {
+		t.Fatalf("got %d posts, want a retry after the 503", len(bodies))
+	}
+	if got := headers[1].Get("X-Signature"); got != "sha256="+signBody("s3cret", []byte(bodies[1])) {
+		t.Errorf("signature = %s", got)
+	}
+	result.Job = "promote"
+	if got := signed.results(t)[0]; got.Job != "promote" || got.Digest != result.Digest || got.Bytes != 1024 ||
+		strings.Join(got.Targets, ",") != strings.Join(result.Targets, ",") {
+		t.Errorf("posted %+v, want %+v", got, result)
+	}
+
+	bodies, headers = slack.received()
+	var message struct{ Text string }
+	if len(bodies) != 1 || json.Unmarshal([]byte(bodies[0]), &message) != nil {
+		t.Fatalf("slack got %v", bodies)
+	}
+	if want := ":white_check_mark: promote copied staging/app:1.4.2 to prod/app:1.4.2, prod/app:stable in 2.5s"; message.Text != want {
+		t.Errorf("slack message = %q, want %q", message.Text, want)
+	}
+	if headers[0].Get("X-Signature") != "" {
+		t.Error("signed without a secret")
+	}
+
+	if bodies, _ = rejecting.received(); len(bodies) != 1 || bodies[0] != "staging/app:1.4.2 succeeded" {
+		t.Errorf("webhook turning it away got %q, want one try with the template", bodies)
+	}
+}
+
+func TestNotifierSlackFailure(t *testing.T) {
+	slack := newWebhookReceiver()
+	defer slack.Close()
+	n, _ := NewNotifier("promote", []OutboundWebhook{{URL: slack.URL, Template: "slack"}})
+	n.Notify(CopyResult{Status: "failed", Source: "staging/app:1.4.2", Registry: "prod", Error: `manifest "unknown"`})
+	n.Wait()
+	bodies, _ := slack.received()
+	var message struct{ Text string }
+	if len(bodies) != 1 || json.Unmarshal([]byte(bodies[0]), &message) != nil {
+		t.Fatalf("slack got %v", bodies)
+	}
+	if want := `:x: promote couldn't copy staging/app:1.4.2 to prod : manifest "unknown"`; message.Text != want {
+		t.Errorf("slack message = %q, want %q", message.Text, want)
+	}
+}
+
+func TestNewNotifierErrors(t *testing.T) {
+	for _, webhooks := range [][]OutboundWebhook{
+		{{Template: "slack"}},
+		{{URL: "http://example.com", Template: "{{.Source"}},
+	} {
+		if _, err := NewNotifier("job", webhooks); err == nil {
+			t.Errorf("NewNotifier(%+v) should fail", webhooks)
+		}
+	}
+	var none *Notifier
+	none.Notify(CopyResult{})
+	none.Wait()
+}
+
+func TestFanOutNotifies(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	eu := newFakeRegistry()
+	defer eu.Close()
+	us := newFakeRegistry()
+	defer us.Close()
+	pushed := source.addImage("team/app", "1.0", "base", "app")
+	eu.addBlob("team/app", []byte("base"), "")
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+
+	handler, err := NewRegistryCopyFanOut(source.info(), []RegistryInfo{eu.info(), us.info()},
+		DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyFanOut() error = %v", err)
+	}
+	handler.notifier, _ = NewNotifier("promote", []OutboundWebhook{{URL: receiver.URL}})
+	if err = handler.Handle(RegistryEvent{Action: "push", Target: RegistryTarget{"team/app", "1.0"}}); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	handler.notifier.Wait()
+
+	manifest, _ := source.manifest("team/app", "1.0")
+	config := int64(len(`{"image":"team/app:1.0"}`))
+	want := map[string]int64{
+		eu.URL: config + int64(len("app")+len(manifest.payload)),
+		us.URL: config + int64(len("base")+len("app")+len(manifest.payload)),
+	}
+	results := receiver.results(t)
+	if len(results) != 2 {
+		t.Fatalf("got results %+v, want one for each target", results)
+	}
+	for _, result := range results {
+		if result.Job != "promote" || result.Status != "succeeded" || result.Source != source.URL+"/team/app:1.0" ||
+			result.Digest != pushed || result.Error != "" || result.Time.IsZero() {
+			t.Errorf("result = %+v", result)
+		}
+		if len(result.Targets) != 1 || result.Targets[0] != result.Registry+"/team/app:1.0" {
+			t.Errorf("targets = %v", result.Targets)
+		}
+		if result.Bytes != want[result.Registry] {
+			t.Errorf("%s got %d bytes, want %d", result.Registry, result.Bytes, want[result.Registry])
+		}
+	}
+}
+
+func TestFanOutNotifiesFailures(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	receiver := newWebhookReceiver()
+	defer receiver.Close()
+
+	handler, _ := NewRegistryCopyFanOut(source.info(), []RegistryInfo{target.info()},
+		DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	handler.notifier, _ = NewNotifier("promote", []OutboundWebhook{{URL: receiver.URL}})
+	if err := handler.Handle(RegistryEvent{Action: "push", Target: RegistryTarget{"team/missing", "1.0"}}); err == nil {
+		t.Fatal("copying a missing image should fail")
+	}
+	handler.notifier.Wait()
+	results := receiver.results(t)
+	if len(results) != 1 || results[0].Status != "failed" || results[0].Error == "" || results[0].Bytes != 0 ||
+		results[0].Registry != target.URL {
+		t.Errorf("results = %+v, want the failure", results)
+	}
+}
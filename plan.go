@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var planOutput, planJob string
+
+// planCmd shows what a sync would do without copying anything
+var planCmd = &cobra.Command{
+	Use:   "plan",
+	Short: "Show what a sync would change in the target without changing it",
+	Long: `
+
+	registrysync plan --source-url <registrysource>  --target-url <registrytarget>[,<registrytarget>...] [--output human|json|csv]
+	registrysync plan --job <name from the config file> [--output human|json|csv]
+
+	Lists the images missing from each target, the ones whose tags have moved at the source
+	and with --prune the ones that would be deleted, along with the bytes that would be copied.
+	`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		request, err := planRequest(cmd)
+		if err != nil {
+			return err
+		}
+		filter, err := request.filter()
+		if err != nil {
+			return err
+		}
+		writer, ok := planWriters[planOutput]
+		if !ok {
+			return fmt.Errorf("Unknown output %s, expected human, json or csv", planOutput)
+		}
+		source, err := request.source.GetRegistry()
+		if err != nil {
+			return fmt.Errorf("Couldn't connect to %s : %s", request.source.Address(), err)
+		}
+		var entries []PlanEntry
+		var total int64
+		for _, info := range request.targets {
+			target, err := info.GetRegistry()
+			if err != nil {
+				return fmt.Errorf("Couldn't connect to %s : %s", info.Address(), err)
+			}
+			plan, err := Diff(source, target, filter, request.mapping, request.prune.Enabled)
+			if err != nil {
+				return fmt.Errorf("Couldn't work out the differences between %s and %s : %s", request.source.Address(),
+					info.Address(), err)
+			}
+			targetEntries, size := estimateTransfer(source, target, plan, request.mapping)
+			for _, entry := range targetEntries {
+				entry.Target = info.Address()
+				entries = append(entries, entry)
+			}
+			total += size
+		}
+		if err = writer(os.Stdout, entries, total); err != nil {
+			return fmt.Errorf("Couldn't write the plan : %s", err)
+		}
+		return nil
+	},
+}
+
+func init() {
+	planCmd.Flags().StringVarP(&planOutput, "output", "o", "human", "How to show the plan, one of human, json or csv")
+	planCmd.Flags().StringVar(&planJob, "job", "", "Plan a job from the config file instead of using the registry flags")
+	RootCmd.AddCommand(planCmd)
+}
+
+// planRequest the job named by --job or else the one described by the flags
+func planRequest(cmd *cobra.Command) (ServerRequest, error) {
+	if planJob == "" {
+		if !registriesGiven(cmd) {
+			return ServerRequest{}, fmt.Errorf("No registries given")
+		}
+		return flagRequest()
+	}
+	requests, err := loadJobs(viper.Get("jobs"))
+	if err != nil {
+		return ServerRequest{}, err
+	}
+	for _, request := range requests {
+		if request.name == planJob {
+			return request, nil
+		}
+	}
+	return ServerRequest{}, fmt.Errorf("No job called %s in the config file", planJob)
+}
+
+// PlanEntry a single change a sync would make to a target
+type PlanEntry struct {
+	Target     string `json:"target"`
+	Action     string `json:"action"`
+	Repository string `json:"repository"`
+	Tag        string `json:"tag"`
+	// Bytes that need copying for this image, -1 when it couldn't be worked out
+	Bytes int64 `json:"bytes"`
+}
+
+// blobRegistry a registry that can tell us what images are made of
+type blobRegistry interface {
+	ImageBlobs(repository, reference string) ([]distribution.Descriptor, error)
+	HasBlob(repository string, dgst digest.Digest) (bool, error)
+}
+
+// estimateTransfer turns a plan into entries, named as in the target, with the bytes each copy
+// needs.  Blobs the target already has, or that an earlier entry will copy, aren't counted again.
+func estimateTransfer(regSource, regTarget Registry, plan SyncPlan, mapping ImageMapping) (entries []PlanEntry, total int64) {
+	source, sourceOk := regSource.(blobRegistry)
+	target, targetOk := regTarget.(blobRegistry)
+	counted := make(map[string]bool)
+	estimate := func(image RegistryTarget, repository string) int64 {
+		if !sourceOk || !targetOk {
+			return -1
+		}
+		blobs, err := source.ImageBlobs(image.Repository, image.Tag)
+		if err != nil {
+			log.Warnf("Couldn't get the size of %s:%s : %s", image.Repository, image.Tag, err)
+			return -1
+		}
+		var size int64
+		for _, blob := range blobs {
+			key := repository + "@" + blob.Digest.String()
+			if counted[key] {
+				continue
+			}
+			counted[key] = true
+			if exists, err := target.HasBlob(repository, blob.Digest); err == nil && exists {
+				continue
+			}
+			size += blob.Size
+		}
+		return size
+	}
+	add := func(action string, images RegistryTargets, copies bool) {
+		for _, image := range images {
+			entry := PlanEntry{Action: action, Repository: image.Repository, Tag: image.Tag}
+			if copies {
+				// Named as in the target, with all the tags it will get there
+				entry.Repository = mapping.Repositories.Rewrite(image.Repository)
+				if m, err := mapping.mapImage(image, sourceDigest(regSource, image, mapping)); err == nil {
+					entry.Tag = strings.Join(append(m.tags, m.stamps...), ",")
+				}
+				entry.Bytes = estimate(image, entry.Repository)
+				if entry.Bytes > 0 {
+					total += entry.Bytes
+				}
+			}
+			entries = append(entries, entry)
+		}
+	}
+	add("missing", plan.Missing, true)
+	add("outdated", plan.Outdated, true)
+	add("delete", plan.Extra, false)
+	return
+}
+
+// sourceDigest the digest of the image if the mapping needs it to name the image in the target
+func sourceDigest(regSource Registry, image RegistryTarget, mapping ImageMapping) string {
+	if !mapping.needsDigest() {
+		return ""
+	}
+	dgst, err := regSource.ManifestDigest(image.Repository, image.Tag)
+	if err != nil {
+		return ""
+	}
+	return dgst.String()
+}
+
+type planWriter func(w io.Writer, entries []PlanEntry, total int64) error
+
+var planWriters = map[string]planWriter{
+	"human": writeHumanPlan,
+	"json":  writeJSONPlan,
+	"csv":   writeCSVPlan,
+}
+
+func writeHumanPlan(w io.Writer, entries []PlanEntry, total int64) error {
+	if len(entries) == 0 {
+		_, err := fmt.Fprintln(w, "Target is in sync, nothing to do")
+		return err
+	}
+	var targets []string
+	seen := make(map[string]bool)
+	for _, e := range entries {
+		if !seen[e.Target] {
+			seen[e.Target] = true
+			targets = append(targets, e.Target)
+		}
+	}
+	for _, target := range targets {
+		indent := "  "
+		if len(targets) > 1 {
+			fmt.Fprintf(w, "%s:\n", target)
+			indent = "    "
+		}
+		for _, section := range []struct{ action, title string }{
+			{"missing", "Missing from the target"},
+			{"outdated", "Outdated in the target"},
+			{"delete", "To be deleted from the target"},
+		} {
+			printed := false
+			for _, e := range entries {
+				if e.Target != target || e.Action != section.action {
+					continue
+				}
+				if !printed {
+					fmt.Fprintf(w, "%s%s:\n", indent[2:], section.title)
+					printed = true
+				}
+				if e.Action == "delete" {
+					fmt.Fprintf(w, "%s%s:%s\n", indent, e.Repository, e.Tag)
+				} else {
+					fmt.Fprintf(w, "%s%s:%s (%s)\n", indent, e.Repository, e.Tag, humanBytes(e.Bytes))
+				}
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d changes, about %s to copy\n", len(entries), humanBytes(total))
+	return err
+}
+
+func writeJSONPlan(w io.Writer, entries []PlanEntry, total int64) error {
+	if entries == nil {
+		entries = []PlanEntry{}
+	}
+	return json.NewEncoder(w).Encode(struct {
+		Entries    []PlanEntry `json:"entries"`
+		TotalBytes int64       `json:"totalBytes"`
+	}{entries, total})
+}
+
+func writeCSVPlan(w io.Writer, entries []PlanEntry, total int64) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"target", "action", "repository", "tag", "bytes"})
+	for _, e := range entries {
+		out.Write([]string{e.Target, e.Action, e.Repository, e.Tag, strconv.FormatInt(e.Bytes, 10)})
+	}
+	out.Flush()
+	return out.Error()
+}
+
+func humanBytes(size int64) string {
+	if size < 0 {
+		return "unknown size"
+	}
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
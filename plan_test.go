@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestEstimateTransfer(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	source.addImage("team/app", "1.0", "base", "one")
+	source.addImage("team/app", "2.0", "base", "two")
+	target.addImage("team/app", "0.9", "base")
+
+	s, _ := source.info().GetRegistry()
+	d, _ := target.info().GetRegistry()
+	plan, err := Diff(s, d, DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}}, ImageMapping{}, true)
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	entries, total := estimateTransfer(s, d, plan, ImageMapping{})
+	// the configs are {"image":"team/app:1.0"} and the base layer is already in the target
+	want := []PlanEntry{
+		{"", "missing", "team/app", "1.0", 24 + 3},
+		{"", "missing", "team/app", "2.0", 24 + 3},
+		{"", "delete", "team/app", "0.9", 0},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("estimateTransfer() = %v, want %v", entries, want)
+	}
+	if total != 54 {
+		t.Errorf("estimateTransfer() total = %d, want 54", total)
+	}
+}
+
+func TestEstimateTransferWithoutBlobs(t *testing.T) {
+	plan := SyncPlan{Missing: RegistryTargets{RegistryTarget{"team/app", "1.0"}}}
+	entries, total := estimateTransfer(mockRegistry{}, mockRegistry{}, plan, ImageMapping{})
+	if len(entries) != 1 || entries[0].Bytes != -1 || total != 0 {
+		t.Errorf("estimateTransfer() = %v, %d want an unknown size", entries, total)
+	}
+}
+
+func TestPlanWriters(t *testing.T) {
+	entries := []PlanEntry{
+		{"prod", "missing", "team/app", "1.0", 2048},
+		{"prod", "delete", "team/app", "0.9", 0},
+	}
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"human", "Missing from the target:\n  team/app:1.0 (2.0 KiB)\nTo be deleted from the target:\n  team/app:0.9\n2 changes, about 2.0 KiB to copy\n"},
+		{"json", `{"entries":[{"target":"prod","action":"missing","repository":"team/app","tag":"1.0","bytes":2048},{"target":"prod","action":"delete","repository":"team/app","tag":"0.9","bytes":0}],"totalBytes":2048}` + "\n"},
+		{"csv", "target,action,repository,tag,bytes\nprod,missing,team/app,1.0,2048\nprod,delete,team/app,0.9,0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.output, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := planWriters[tt.output](&out, entries, 2048); err != nil {
+				t.Fatalf("writer error = %v", err)
+			}
+			if out.String() != tt.want {
+				t.Errorf("got\n%s\nwant\n%s", out.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestHumanPlanSeveralTargets(t *testing.T) {
+	entries := []PlanEntry{
+		{"eu", "missing", "team/app", "1.0", 2048},
+		{"asia", "missing", "team/app", "1.0", 2048},
+		{"asia", "delete", "team/app", "0.9", 0},
+	}
+	want := "eu:\n  Missing from the target:\n    team/app:1.0 (2.0 KiB)\n" +
+		"asia:\n  Missing from the target:\n    team/app:1.0 (2.0 KiB)\n  To be deleted from the target:\n    team/app:0.9\n" +
+		"3 changes, about 4.0 KiB to copy\n"
+	var out bytes.Buffer
+	if err := writeHumanPlan(&out, entries, 4096); err != nil {
+		t.Fatalf("writeHumanPlan() error = %v", err)
+	}
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// QueueOptions how notifications wait to be copied once they are acknowledged
+type QueueOptions struct {
+	// Dir where events are kept until they are copied, each job in a directory of its own.
+	// Without one they are only kept in memory and lost on a restart.
+	Dir string
+	// Workers how many events of a job are worked on at once
+	Workers int
+	// Attempts how many times an event is tried before it goes to the dead letters
+	Attempts int
+	// Backoff the wait before trying a failed event again, doubled each time
+	Backoff time.Duration
+}
+
+// DefaultQueueOptions used unless told otherwise
+var DefaultQueueOptions = QueueOptions{Workers: 4, Attempts: 5, Backoff: 10 * time.Second}
+
+// QueuedEvent an event waiting to be handled and how trying it has gone so far
+type QueuedEvent struct {
+	ID        uint64
+	Event     RegistryEvent
+	Queued    time.Time
+	Attempts  int
+	LastError string `json:",omitempty"`
+	// FailedAt when it was given up on and went to the dead letters
+	FailedAt time.Time
+
+	// notBefore when a failed event can be tried again
+	notBefore time.Time
+	running   bool
+}
+
+// EventQueue acknowledges events as soon as they are written down and hands them to the
+// handler in the background.  Events for the same image are handled one at a time in the
+// order they came, so an older push can't overwrite a newer one.  Events that keep failing
+// are put aside as dead letters to be looked at and retried.  With a directory the queue
+// survives a restart, picking up where it left off.
+type EventQueue struct {
+	name    string
+	handler RegistryEventHandler
+	options QueueOptions
+
+	mu      sync.Mutex
+	wake    *sync.Cond
+	wakeAt  time.Time
+	nextID  uint64
+	pending []*QueuedEvent
+	dead    map[uint64]*QueuedEvent
+	stopped bool
+	running sync.WaitGroup
+	// progressed when an event was last started or finished, or the queue stopped being empty
+	progressed time.Time
+}
+
+// NewEventQueue the queue for the job called name, loading any events left from before
+func NewEventQueue(name string, handler RegistryEventHandler, options QueueOptions) (*EventQueue, error) {
+	if options.Workers < 1 {
+		options.Workers = 1
+	}
+	if options.Attempts < 1 {
+		options.Attempts = 1
+	}
+	q := &EventQueue{
+		name:    name,
+		handler: handler,
+		options: options,
+		nextID:  1,
+		dead:    make(map[uint64]*QueuedEvent),
+	}
+	q.wake = sync.NewCond(&q.mu)
+	if options.Dir == "" {
+		return q, nil
+	}
+	for _, dir := range []string{q.dir("pending"), q.dir("dead")} {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, fmt.Errorf("can't create queue directory %s : %s", dir, err)
+		}
+	}
+	pending, err := readQueued(q.dir("pending"))
+	if err != nil {
+		return nil, err
+	}
+	dead, err := readQueued(q.dir("dead"))
+	if err != nil {
+		return nil, err
+	}
+	q.pending = pending
+	for _, e := range append(pending, dead...) {
+		if e.ID >= q.nextID {
+			q.nextID = e.ID + 1
+		}
+	}
+	for _, e := range dead {
+		q.dead[e.ID] = e
+	}
+	if len(pending) > 0 || len(dead) > 0 {
+		log.Infof("Job %s has %d events left to copy and %d dead letters from before", name, len(pending), len(dead))
+	}
+	return q, nil
+}
+
+// Start the workers
+func (q *EventQueue) Start() {
+	q.mu.Lock()
+	q.progressed = now()
+	q.mu.Unlock()
+	for n := 0; n < q.options.Workers; n++ {
+		q.running.Add(1)
+		go q.work()
+	}
+}
+
+// Stop the workers once they finish what they are doing, leaving the rest queued
+func (q *EventQueue) Stop() {
+	q.mu.Lock()
+	q.stopped = true
+	q.wake.Broadcast()
+	q.mu.Unlock()
+	q.running.Wait()
+}
+
+// Handle queues the event, only failing if it couldn't be written down.  A push of a tag
+// that is already waiting to be copied takes the place of the earlier push, so only the
+// latest manifest is copied.
+func (q *EventQueue) Handle(evt RegistryEvent) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if waiting := q.waitingPush(evt); waiting != nil {
+		replaced := *waiting
+		replaced.Event, replaced.Attempts, replaced.LastError, replaced.notBefore = evt, 0, "", time.Time{}
+		if err := q.save("pending", &replaced); err != nil {
+			log.Errorf("Couldn't queue %s for job %s : %s", evt, q.name, err)
+			return err
+		}
+		log.Debugf("Job %s will copy %s rather than %s", q.name, evt, waiting.Event)
+		*waiting = replaced
+		q.wake.Signal()
+		return nil
+	}
+	e := &QueuedEvent{ID: q.nextID, Event: evt, Queued: now()}
+	if err := q.save("pending", e); err != nil {
+		log.Errorf("Couldn't queue %s for job %s : %s", evt, q.name, err)
+		return err
+	}
+	q.nextID++
+	if len(q.pending) == 0 {
+		q.progressed = now()
+	}
+	q.pending = append(q.pending, e)
+	q.wake.Signal()
+	return nil
+}
+
+// waitingPush the last event queued for the same tag as the push, if it is a push that
+// hasn't been started on.  Untagged pushes are each of a different manifest so aren't replaced.
+func (q *EventQueue) waitingPush(evt RegistryEvent) *QueuedEvent {
+	if evt.Action != "push" || evt.Target.Tag == "" {
+		return nil
+	}
+	for n := len(q.pending) - 1; n >= 0; n-- {
+		e := q.pending[n]
+		if e.Event.Target != evt.Target {
+			continue
+		}
+		if e.running || e.Event.Action != "push" {
+			return nil
+		}
+		return e
+	}
+	return nil
+}
+
+// Pending how many events are waiting or being worked on
+func (q *EventQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending)
+}
+
+// Progress how many events are waiting or being worked on and when one was last started or finished
+func (q *EventQueue) Progress() (pending int, progressed time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.pending), q.progressed
+}
+
+func (q *EventQueue) work() {
+	defer q.running.Done()
+	for {
+		e := q.next()
+		if e == nil {
+			return
+		}
+		q.done(e, q.handler.Handle(e.Event))
+	}
+}
+
+// next waits for an event that can be worked on, nil once the queue is stopped
+func (q *EventQueue) next() *QueuedEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for !q.stopped {
+		e, wait := q.ready()
+		if e != nil {
+			e.running = true
+			e.Attempts++
+			q.progressed = now()
+			return e
+		}
+		if wait > 0 && (q.wakeAt.IsZero() || now().Add(wait).Before(q.wakeAt)) {
+			// wake up for the first retry that is due
+			q.wakeAt = now().Add(wait)
+			time.AfterFunc(wait, func() {
+				q.mu.Lock()
+				q.wakeAt = time.Time{}
+				q.wake.Broadcast()
+				q.mu.Unlock()
+			})
+		}
+		q.wake.Wait()
+	}
+	return nil
+}
+
+// ready the first event that can be worked on now, or how long until a failed one can be
+// tried again.  An event waits while an earlier one for the same image isn't done.
+func (q *EventQueue) ready() (*QueuedEvent, time.Duration) {
+	blocked := make(map[RegistryTarget]bool)
+	var wait time.Duration
+	for _, e := range q.pending {
+		target := e.Event.Target
+		if blocked[target] {
+			continue
+		}
+		blocked[target] = true
+		if e.running {
+			continue
+		}
+		if d := e.notBefore.Sub(now()); d > 0 {
+			if wait == 0 || d < wait {
+				wait = d
+			}
+			continue
+		}
+		return e, 0
+	}
+	return nil, wait
+}
+
+// done takes the event off the queue if it worked, otherwise puts it back to be tried again
+// later or, when it has had all its attempts or can't work however often it is tried, with
+// the dead letters
+func (q *EventQueue) done(e *QueuedEvent, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	defer q.wake.Broadcast()
+	e.running = false
+	q.progressed = now()
+	if err == nil {
+		q.remove(e)
+		return
+	}
+	e.LastError = err.Error()
+	retryable := isRetryable(err)
+	if retryable && e.Attempts < q.options.Attempts {
+		backoff := q.options.Backoff << uint(e.Attempts-1)
+		e.notBefore = now().Add(backoff)
+		log.Warnf("Job %s couldn't handle %s on attempt %d of %d, trying again in %s : %s", q.name, e.Event,
+			e.Attempts, q.options.Attempts, backoff, err)
+		if err := q.save("pending", e); err != nil {
+			log.Warnf("Couldn't save attempts at %s : %s", e.Event, err)
+		}
+		return
+	}
+	if retryable {
+		log.Errorf("Job %s gave up on %s after %d attempts, it is with the dead letters : %s", q.name, e.Event,
+			e.Attempts, err)
+	} else {
+		log.Errorf("Job %s gave up on %s, trying again won't help, it is with the dead letters : %s", q.name,
+			e.Event, err)
+	}
+	e.FailedAt = now()
+	if err := q.save("dead", e); err != nil {
+		log.Errorf("Couldn't save dead letter %s, it will be lost on a restart : %s", e.Event, err)
+	}
+	q.remove(e)
+	q.dead[e.ID] = e
+}
+
+// remove takes the event off the pending list and the disk
+func (q *EventQueue) remove(e *QueuedEvent) {
+	for n, p := range q.pending {
+		if p == e {
+			q.pending = append(q.pending[:n], q.pending[n+1:]...)
+			break
+		}
+	}
+	q.delete("pending", e)
+}
+
+// PendingEvent an event on the queue and whether it is being worked on
+type PendingEvent struct {
+	QueuedEvent
+	Running bool
+	// RetryAt when it is tried again after failing, zero when it hasn't failed
+	RetryAt time.Time
+}
+
+// Queued the events waiting or being worked on, in the order they came
+func (q *EventQueue) Queued() []PendingEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	events := make([]PendingEvent, 0, len(q.pending))
+	for _, e := range q.pending {
+		events = append(events, PendingEvent{QueuedEvent: *e, Running: e.running, RetryAt: e.notBefore})
+	}
+	return events
+}
+
+// DeadLetters the events given up on, oldest first
+func (q *EventQueue) DeadLetters() []QueuedEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	letters := make([]QueuedEvent, 0, len(q.dead))
+	for _, e := range q.dead {
+		letters = append(letters, *e)
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].ID < letters[j].ID })
+	return letters
+}
+
+// DeadLetter the dead letter with the id
+func (q *EventQueue) DeadLetter(id uint64) (QueuedEvent, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.dead[id]
+	if !ok {
+		return QueuedEvent{}, false
+	}
+	return *e, true
+}
+
+// Retry queues a dead letter again with a fresh set of attempts.  It goes to the back
+// of the queue, after anything newer for the same image.
+func (q *EventQueue) Retry(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.dead[id]
+	if !ok {
+		return fmt.Errorf("no dead letter %d for job %s", id, q.name)
+	}
+	retry := &QueuedEvent{ID: q.nextID, Event: e.Event, Queued: now()}
+	if err := q.save("pending", retry); err != nil {
+		return err
+	}
+	q.nextID++
+	q.pending = append(q.pending, retry)
+	delete(q.dead, id)
+	q.delete("dead", e)
+	q.wake.Signal()
+	log.Infof("Job %s is retrying %s", q.name, e.Event)
+	return nil
+}
+
+// Discard drops a dead letter for good
+func (q *EventQueue) Discard(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	e, ok := q.dead[id]
+	if !ok {
+		return fmt.Errorf("no dead letter %d for job %s", id, q.name)
+	}
+	delete(q.dead, id)
+	q.delete("dead", e)
+	return nil
+}
+
+// dir where the events of a kind, pending or dead, are kept
+func (q *EventQueue) dir(kind string) string {
+	return filepath.Join(q.options.Dir, q.name, kind)
+}
+
+func (q *EventQueue) file(kind string, e *QueuedEvent) string {
+	return filepath.Join(q.dir(kind), fmt.Sprintf("%020d.json", e.ID))
+}
+
+// save writes the event to disk, replacing what was there in one go so a crash
+// can't leave half an event behind
+func (q *EventQueue) save(kind string, e *QueuedEvent) error {
+	if q.options.Dir == "" {
+		return nil
+	}
+	content, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	path := q.file(kind, e)
+	tmp, err := ioutil.TempFile(q.dir(kind), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(content)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (q *EventQueue) delete(kind string, e *QueuedEvent) {
+	if q.options.Dir == "" {
+		return
+	}
+	if err := os.Remove(q.file(kind, e)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Couldn't remove %s from the queue of job %s : %s", e.Event, q.name, err)
+	}
+}
+
+// readQueued the events in a directory in the order they were queued
+func readQueued(dir string) ([]*QueuedEvent, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var events []*QueuedEvent
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".tmp") {
+			// left by a crash while saving, the event it was for is still in the old file
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		if _, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64); err != nil {
+			continue
+		}
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		var e QueuedEvent
+		if err = json.Unmarshal(content, &e); err != nil {
+			log.Warnf("Skipping unreadable queued event %s : %s", filepath.Join(dir, name), err)
+			continue
+		}
+		events = append(events, &e)
+	}
+	// the names are zero padded so they already sort by id
+	return events, nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// flakyHandler records events, failing each one the first few times it is handled
+type flakyHandler struct {
+	mu       sync.Mutex
+	failures map[RegistryTarget]int
+	handled  []RegistryEvent
+	// err what it fails with, the registry being down unless set
+	err      error
+	attempts int
+}
+
+func (f *flakyHandler) Handle(evt RegistryEvent) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.attempts++
+	if f.failures[evt.Target] > 0 {
+		f.failures[evt.Target]--
+		if f.err != nil {
+			return f.err
+		}
+		return errors.New("registry down")
+	}
+	f.handled = append(f.handled, evt)
+	return nil
+}
+
+func (f *flakyHandler) events() []RegistryEvent {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]RegistryEvent{}, f.handled...)
+}
+
+// waitFor polls until the condition holds, failing the test if it takes too long
+func waitFor(t *testing.T, what string, condition func() bool) {
+	for start := time.Now(); !condition(); time.Sleep(5 * time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("gave up waiting for %s", what)
+		}
+	}
+}
+
+// pushOf a push of the image with a made up digest ending in hex
+func pushOf(repository, tag, hex string) RegistryEvent {
+	return RegistryEvent{Action: "push", Target: RegistryTarget{repository, tag}, Digest: digest.Digest("sha256:" + hex)}
+}
+
+func TestEventQueueKeepsOrderPerImage(t *testing.T) {
+	handler := &flakyHandler{failures: map[RegistryTarget]int{{"app", "1.0"}: 2}}
+	q, _ := NewEventQueue("job", handler, QueueOptions{Workers: 4, Attempts: 3, Backoff: time.Millisecond})
+	first, other := pushOf("app", "1.0", "aaaa"), pushOf("other", "1.0", "cccc")
+	second := RegistryEvent{Action: "delete", Target: RegistryTarget{"app", "1.0"}}
+	for _, evt := range []RegistryEvent{first, second, other} {
+		if err := q.Handle(evt); err != nil {
+			t.Fatalf("Handle() error = %v", err)
+		}
+	}
+	q.Start()
+	defer q.Stop()
+	waitFor(t, "the queue to empty", func() bool { return q.Pending() == 0 })
+	// other isn't held up by the retries of app:1.0, which stay in order
+	if got, want := handler.events(), []RegistryEvent{other, first, second}; !reflect.DeepEqual(got, want) {
+		t.Errorf("handled %v, want %v", got, want)
+	}
+}
+
+func TestEventQueueCoalescesPushes(t *testing.T) {
+	handler := &flakyHandler{}
+	q, _ := NewEventQueue("job", handler, QueueOptions{Workers: 1, Attempts: 1})
+	latest := pushOf("app", "1.0", "cccc")
+	untagged := []RegistryEvent{pushOf("app", "", "dddd"), pushOf("app", "", "eeee")}
+	for _, evt := range []RegistryEvent{pushOf("app", "1.0", "aaaa"), untagged[0], pushOf("app", "1.0", "bbbb"), untagged[1], latest} {
+		q.Handle(evt)
+	}
+	if q.Pending() != 3 {
+		t.Errorf("%d events queued, want the pushes of 1.0 as one and both untagged", q.Pending())
+	}
+	q.Start()
+	defer q.Stop()
+	waitFor(t, "the queue to empty", func() bool { return q.Pending() == 0 })
+	if got, want := handler.events(), []RegistryEvent{latest, untagged[0], untagged[1]}; !reflect.DeepEqual(got, want) {
+		t.Errorf("handled %v, want %v", got, want)
+	}
+}
+
+func TestEventQueueDoesntCoalesceStartedPush(t *testing.T) {
+	release := make(chan bool)
+	handler := &blockingHandler{release: release, started: make(chan bool, 1)}
+	q, _ := NewEventQueue("job", handler, QueueOptions{Workers: 2, Attempts: 1})
+	q.Start()
+	defer q.Stop()
+	q.Handle(pushOf("app", "1.0", "aaaa"))
+	<-handler.started
+	q.Handle(pushOf("app", "1.0", "bbbb"))
+	q.Handle(pushOf("app", "1.0", "cccc"))
+	if q.Pending() != 2 {
+		t.Errorf("%d events queued, want the one being copied and the latest", q.Pending())
+	}
+	close(release)
+	waitFor(t, "the queue to empty", func() bool { return q.Pending() == 0 })
+}
+
+// blockingHandler holds up every event until released
+type blockingHandler struct {
+	release <-chan bool
+	started chan bool
+}
+
+func (b *blockingHandler) Handle(evt RegistryEvent) error {
+	select {
+	case b.started <- true:
+	default:
+	}
+	<-b.release
+	return nil
+}
+
+func TestEventQueueDeadLetters(t *testing.T) {
+	handler := &flakyHandler{failures: map[RegistryTarget]int{{"app", "1.0"}: 3}}
+	q, _ := NewEventQueue("job", handler, QueueOptions{Workers: 1, Attempts: 2, Backoff: time.Millisecond})
+	q.Start()
+	defer q.Stop()
+	evt := pushOf("app", "1.0", "aaaa")
+	q.Handle(evt)
+	waitFor(t, "the event to fail", func() bool { return len(q.DeadLetters()) == 1 })
+	letter := q.DeadLetters()[0]
+	if letter.Event.Target != evt.Target || letter.Attempts != 2 || letter.LastError != "registry down" || letter.FailedAt.IsZero() {
+		t.Errorf("dead letter = %+v", letter)
+	}
+	if err := q.Retry(letter.ID); err != nil {
+		t.Fatalf("Retry() error = %v", err)
+	}
+	waitFor(t, "the retry to work", func() bool { return len(handler.events()) == 1 })
+	if len(q.DeadLetters()) != 0 {
+		t.Errorf("dead letters left after retrying %v", q.DeadLetters())
+	}
+	if err := q.Retry(letter.ID); err == nil {
+		t.Error("retrying a dead letter twice should fail")
+	}
+}
+
+func TestEventQueueDeadLettersPermanentFailures(t *testing.T) {
+	handler := &flakyHandler{failures: map[RegistryTarget]int{{"app", "1.0"}: 1},
+		err: permanent(errors.New("manifest invalid"))}
+	q, _ := NewEventQueue("job", handler, QueueOptions{Workers: 1, Attempts: 5, Backoff: time.Hour})
+	q.Start()
+	defer q.Stop()
+	q.Handle(pushOf("app", "1.0", "aaaa"))
+	waitFor(t, "the event to fail", func() bool { return len(q.DeadLetters()) == 1 })
+	letter := q.DeadLetters()[0]
+	if letter.Attempts != 1 || letter.LastError != "manifest invalid" || letter.FailedAt.IsZero() || q.Pending() != 0 {
+		t.Errorf("dead letter = %+v with %d pending, want it given up on at the first attempt", letter, q.Pending())
+	}
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	if handler.attempts != 1 {
+		t.Errorf("handled %d times, want once", handler.attempts)
+	}
+}
+
+func TestEventQueueReplaysFromDisk(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	defer os.RemoveAll(dir)
+	options := QueueOptions{Dir: dir, Workers: 2, Attempts: 1, Backoff: time.Millisecond}
+
+	failing := &flakyHandler{failures: map[RegistryTarget]int{{"broken", "1.0"}: 1}}
+	q, err := NewEventQueue("job", failing, options)
+	if err != nil {
+		t.Fatalf("NewEventQueue() error = %v", err)
+	}
+	q.Handle(pushOf("broken", "1.0", "aaaa"))
+	q.Start()
+	waitFor(t, "the dead letter", func() bool { return len(q.DeadLetters()) == 1 })
+	q.Stop()
+	// queued after the workers stopped, as if the process was restarted before getting to them
+	waiting := []RegistryEvent{pushOf("app", "1.0", "bbbb"), pushOf("app", "1.1", "cccc")}
+	for _, evt := range waiting {
+		q.Handle(evt)
+	}
+
+	handler := &flakyHandler{}
+	replayed, err := NewEventQueue("job", handler, options)
+	if err != nil {
+		t.Fatalf("NewEventQueue() error = %v", err)
+	}
+	if replayed.Pending() != 2 || len(replayed.DeadLetters()) != 1 {
+		t.Fatalf("reloaded %d pending and %v dead", replayed.Pending(), replayed.DeadLetters())
+	}
+	replayed.Start()
+	defer replayed.Stop()
+	waitFor(t, "the replay", func() bool { return replayed.Pending() == 0 })
+	if got := handler.events(); !reflect.DeepEqual(got, waiting) {
+		t.Errorf("replayed %v, want %v", got, waiting)
+	}
+	// new events don't reuse the ids of the old ones
+	replayed.Handle(pushOf("app", "1.2", "dddd"))
+	if id := replayed.DeadLetters()[0].ID; id >= replayed.nextID-1 {
+		t.Errorf("new event got id %d, the dead letter has %d", replayed.nextID-1, id)
+	}
+	files, _ := ioutil.ReadDir(replayed.dir("dead"))
+	if len(files) != 1 {
+		t.Errorf("expected the dead letter on disk, got %d files", len(files))
+	}
+}
+
+func TestEventQueueFailsWhenItCantSave(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "queue")
+	q, err := NewEventQueue("job", &flakyHandler{}, QueueOptions{Dir: dir})
+	if err != nil {
+		t.Fatalf("NewEventQueue() error = %v", err)
+	}
+	os.RemoveAll(dir)
+	if err = q.Handle(pushOf("app", "1.0", "aaaa")); err == nil {
+		t.Error("Handle() should fail when the event can't be saved")
+	}
+	body := `{"events": [{"action": "push", "target": {"repository": "app", "tag": "1.0"}}]}`
+	w := httptest.NewRecorder()
+	registryEventHandler(q).ServeHTTP(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want %d so the registry sends it again", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestDeadLetterAPI(t *testing.T) {
+	handler := &flakyHandler{failures: map[RegistryTarget]int{{"app", "1.0"}: 1, {"app", "1.1"}: 1, {"app", "1.2"}: 1}}
+	q, _ := NewEventQueue("job", handler, QueueOptions{Workers: 1, Attempts: 1})
+	q.Start()
+	defer q.Stop()
+	for _, tag := range []string{"1.0", "1.1", "1.2"} {
+		q.Handle(pushOf("app", tag, "aaaa"))
+	}
+	waitFor(t, "the dead letters", func() bool { return len(q.DeadLetters()) == 3 })
+	prefix := jobAPIPath("job", "dead-letters")
+	api := deadLetterAPI(prefix, q)
+	call := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		api.ServeHTTP(w, httptest.NewRequest(method, prefix+path, nil))
+		return w
+	}
+	if w := call("GET", ""); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"Tag":"1.1"`) {
+		t.Errorf("list got %d %s", w.Code, w.Body.String())
+	}
+	if w := call("GET", "/2"); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"LastError":"registry down"`) {
+		t.Errorf("get got %d %s", w.Code, w.Body.String())
+	}
+	if w := call("GET", "/99"); w.Code != http.StatusNotFound {
+		t.Errorf("get of a missing dead letter got %d", w.Code)
+	}
+	if w := call("DELETE", "/1"); w.Code != http.StatusNoContent {
+		t.Errorf("delete got %d", w.Code)
+	}
+	if w := call("POST", "/2/retry"); w.Code != http.StatusAccepted {
+		t.Errorf("retry got %d", w.Code)
+	}
+	waitFor(t, "the retry", func() bool { return len(handler.events()) == 1 })
+	if w := call("POST", "/retry"); w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"retried":1`) {
+		t.Errorf("retry all got %d %s", w.Code, w.Body.String())
+	}
+	waitFor(t, "the retries", func() bool { return len(handler.events()) == 2 })
+	if w := call("PUT", "/1"); w.Code != http.StatusNotFound {
+		t.Errorf("put of a dropped dead letter got %d", w.Code)
+	}
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"fmt"
+	"io/ioutil"
 	"strings"
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
 	"github.com/heroku/docker-registry-client/registry"
 	//	"github.com/docker/distribution/manifest"
 	"regexp"
@@ -17,6 +20,9 @@ type RegistryInfo struct {
 	username   string
 	password   string
 	isInsecure bool
+	retry      RetryPolicy
+	// platforms copied from multi-arch images, only used for a source
+	platforms PlatformFilter
 }
 
 //RegistryFactory somethign that can give us pointers to registries
@@ -29,6 +35,105 @@ type RegistryFactory interface {
 type Registry interface {
 	Repositories() ([]string, error)
 	Tags(string) ([]string, error)
+	ManifestDigest(repository, reference string) (digest.Digest, error)
+	DeleteManifest(repository string, dgst digest.Digest) error
+}
+
+// v2Registry adapts the registry client to our Registry interface, retrying failures
+type v2Registry struct {
+	*registry.Registry
+	retry     RetryPolicy
+	platforms PlatformFilter
+}
+
+// Repositories every repository in the catalog
+func (r v2Registry) Repositories() (repos []string, err error) {
+	err = r.retry.Do("listing repositories of "+r.URL, func() (err error) {
+		repos, err = r.Registry.Repositories()
+		return
+	})
+	return
+}
+
+// Tags every tag of a repository
+func (r v2Registry) Tags(repository string) (tags []string, err error) {
+	err = r.retry.Do("listing tags of "+repository, func() (err error) {
+		tags, err = r.Registry.Tags(repository)
+		return
+	})
+	return
+}
+
+// ManifestDigest the digest of the manifest a tag currently points at.  With platforms
+// it is the digest of a multi-arch image as it would be copied, with just those platforms.
+func (r v2Registry) ManifestDigest(repository, reference string) (dgst digest.Digest, err error) {
+	err = r.retry.Do("getting digest of "+repository+":"+reference, func() (err error) {
+		if len(r.platforms) == 0 {
+			dgst, err = manifestDigest(r.Registry, repository, reference)
+			return
+		}
+		mediaType, payload, err := getManifest(r.Registry, repository, reference)
+		if err != nil {
+			return err
+		}
+		dgst, err = indexDigest(mediaType, payload, r.platforms)
+		return
+	})
+	return
+}
+
+// ImageBlobs the config and layers that make up an image, for a multi-arch image those of
+// every platform copied
+func (r v2Registry) ImageBlobs(repository, reference string) ([]distribution.Descriptor, error) {
+	m, err := resolveManifest(r.manifestGetter(repository), reference, r.platforms)
+	if err != nil {
+		return nil, err
+	}
+	return m.blobs, nil
+}
+
+// manifestGetter fetches manifests from the repository, retrying failures
+func (r v2Registry) manifestGetter(repository string) manifestGetter {
+	return func(reference string) (mediaType string, payload []byte, err error) {
+		err = r.retry.Do("getting manifest of "+repository+":"+reference, func() (err error) {
+			mediaType, payload, err = getManifest(r.Registry, repository, reference)
+			return
+		})
+		return
+	}
+}
+
+// HasBlob whether the repository already has the blob
+func (r v2Registry) HasBlob(repository string, dgst digest.Digest) (exists bool, err error) {
+	err = r.retry.Do("checking for blob "+dgst.String(), func() (err error) {
+		exists, err = hasBlob(r.Registry, repository, dgst)
+		return
+	})
+	return
+}
+
+// ReadBlob the whole of a small blob like an image config, checked against its digest
+func (r v2Registry) ReadBlob(repository string, dgst digest.Digest) (content []byte, err error) {
+	err = r.retry.Do("reading blob "+dgst.String(), func() error {
+		body, err := downloadBlob(r.Registry, repository, dgst)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		content, err = ioutil.ReadAll(body)
+		return err
+	})
+	if err == nil && digest.FromBytes(content) != dgst {
+		err = fmt.Errorf("blob %s from %s doesn't match its digest", dgst, repository)
+	}
+	return
+}
+
+// DeleteManifest removes a manifest, and with it every tag pointing at it
+func (r v2Registry) DeleteManifest(repository string, dgst digest.Digest) error {
+	return r.retry.Do("deleting "+repository+"@"+dgst.String(), func() error {
+		return deleteManifest(r.Registry, repository, dgst)
+	})
 }
 
 // RegistryEvent indication that some image changed in some way
@@ -36,6 +141,30 @@ type RegistryEvent struct {
 	// TODO create an enum
 	Action string
 	Target RegistryTarget
+	// Digest of the manifest when it is known, so the copy is of exactly that manifest
+	// even if the tag has moved on since
+	Digest digest.Digest
+	// Notification the event as the registry sent it, nil for events we make up
+	Notification *Event
+	// Reason why we made the event up, pruneReason for deletes of images a sync found in the
+	// target but not the source
+	Reason string
+}
+
+// pruneReason the reason of deletes made up when pruning
+const pruneReason = "prune"
+
+// pruned true for a delete of an image a sync found in the target but not the source, which
+// names the image in the target and has been filtered already
+func (e RegistryEvent) pruned() bool {
+	return e.Action == "delete" && e.Reason == pruneReason
+}
+
+func (e RegistryEvent) String() string {
+	if e.Digest != "" {
+		return fmt.Sprintf("%s %s:%s@%s", e.Action, e.Target.Repository, e.Target.Tag, e.Digest)
+	}
+	return fmt.Sprintf("%s %s:%s", e.Action, e.Target.Repository, e.Target.Tag)
 }
 
 // RegistryTarget Indicates the precise image
@@ -68,24 +197,48 @@ type RegistryEventHandler interface {
 
 var protocolRegex = regexp.MustCompile("https?")
 
-// GetRegistry gets an actual registry with repositories and tags
-func (r RegistryInfo) GetRegistry() (Registry, error) {
-	var regURL string
+// dockerHubURL is where images are fetched from when a RegistryInfo has no address
+const dockerHubURL = "https://registry-1.docker.io"
+
+// URL the base url of the registry api, guessing the protocol when none is given
+func (r RegistryInfo) URL() string {
+	if r.address == "" {
+		return dockerHubURL
+	}
 	if protocolRegex.Match([]byte(r.address)) {
-		regURL = r.address
+		return r.address
+	}
+	var protocol string
+	if strings.Index(r.address, "localhost") == 0 {
+		protocol = "http"
 	} else {
-		var protocol string
-		if strings.Index(r.address, "localhost") == 0 {
-			protocol = "http"
-		} else {
-			protocol = "https"
-		}
-		regURL = fmt.Sprintf("%s://%s", protocol, r.address)
+		protocol = "https"
+	}
+	return fmt.Sprintf("%s://%s", protocol, r.address)
+}
+
+// GetRegistry gets an actual registry with repositories and tags
+func (r RegistryInfo) GetRegistry() (Registry, error) {
+	reg, err := r.connect()
+	if err != nil {
+		return nil, err
 	}
+	return v2Registry{reg, r.retry, r.platforms}, nil
+}
 
+// connect gives back the underlying registry client rather than
+// the narrower Registry abstraction
+func (r RegistryInfo) connect() (*registry.Registry, error) {
+	regURL := r.URL()
 	log.Infof("Connecting to registry %s", regURL)
 
-	reg, err := registry.New(regURL, r.username, r.password)
+	var reg *registry.Registry
+	var err error
+	if r.isInsecure {
+		reg, err = registry.NewInsecure(regURL, r.username, r.password)
+	} else {
+		reg, err = registry.New(regURL, r.username, r.password)
+	}
 
 	if err != nil {
 		//TODO should this be fatal?  maybe a warn.
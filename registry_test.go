@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestRegistryManifestDigest(t *testing.T) {
+	fake := newFakeRegistry()
+	defer fake.Close()
+	want := fake.addImage("team/app", "1.0", "layer")
+
+	reg, err := fake.info().GetRegistry()
+	if err != nil {
+		t.Fatalf("GetRegistry() error = %v", err)
+	}
+	got, err := reg.ManifestDigest("team/app", "1.0")
+	if err != nil {
+		t.Fatalf("ManifestDigest() error = %v", err)
+	}
+	if got != want {
+		t.Errorf("ManifestDigest() = %s, want %s", got, want)
+	}
+	if _, err = reg.ManifestDigest("team/app", "2.0"); err == nil {
+		t.Error("expected an error for an unknown tag")
+	}
+}
+
+func TestRegistryDeleteManifest(t *testing.T) {
+	fake := newFakeRegistry()
+	defer fake.Close()
+	dgst := fake.addImage("team/app", "1.0", "layer")
+	fake.addImage("team/app", "2.0", "other layer")
+
+	reg, err := fake.info().GetRegistry()
+	if err != nil {
+		t.Fatalf("GetRegistry() error = %v", err)
+	}
+	if err = reg.DeleteManifest("team/app", dgst); err != nil {
+		t.Fatalf("DeleteManifest() error = %v", err)
+	}
+	tags, _ := reg.Tags("team/app")
+	if len(tags) != 1 || tags[0] != "2.0" {
+		t.Errorf("tags after delete = %v, want [2.0]", tags)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/manifestlist"
+	"github.com/docker/distribution/manifest/schema2"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// The heroku client vendors its own copy of docker/distribution so its
+// digest and manifest types can't be mixed with ours.  These helpers speak
+// the v2 api directly using the client's authenticating http.Client.
+
+// manifestMediaTypes the manifest formats we ask registries for
+var manifestMediaTypes = []string{
+	schema2.MediaTypeManifest,
+	mediaTypeOCIManifest,
+	manifestlist.MediaTypeManifestList,
+	mediaTypeOCIIndex,
+}
+
+func apiURL(reg *registry.Registry, pathTemplate string, args ...interface{}) string {
+	return reg.URL + fmt.Sprintf(pathTemplate, args...)
+}
+
+// getManifest fetches the raw manifest so it can be stored elsewhere without changing its digest
+func getManifest(reg *registry.Registry, repository, reference string) (mediaType string, payload []byte, err error) {
+	req, err := http.NewRequest("GET", apiURL(reg, "/v2/%s/manifests/%s", repository, reference), nil)
+	if err != nil {
+		return
+	}
+	for _, mt := range manifestMediaTypes {
+		req.Header.Add("Accept", mt)
+	}
+	resp, err := reg.Client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	payload, err = ioutil.ReadAll(resp.Body)
+	mediaType = resp.Header.Get("Content-Type")
+	return
+}
+
+// manifestDigest asks for the digest of a manifest without downloading it.  The
+// accept headers matter, without them a registry may answer with the digest of
+// a converted schema1 manifest.
+func manifestDigest(reg *registry.Registry, repository, reference string) (digest.Digest, error) {
+	req, err := http.NewRequest("HEAD", apiURL(reg, "/v2/%s/manifests/%s", repository, reference), nil)
+	if err != nil {
+		return "", err
+	}
+	for _, mt := range manifestMediaTypes {
+		req.Header.Add("Accept", mt)
+	}
+	resp, err := reg.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err != nil {
+		return "", err
+	}
+	if header := resp.Header.Get("Docker-Content-Digest"); header != "" {
+		return digest.ParseDigest(header)
+	}
+	// Not every registry sends the header, so work it out ourselves
+	_, payload, err := getManifest(reg, repository, reference)
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(payload), nil
+}
+
+// putManifest uploads a manifest as is, so the digest stays the same as at the source
+func putManifest(reg *registry.Registry, repository, reference, mediaType string, payload []byte) error {
+	req, err := http.NewRequest("PUT", apiURL(reg, "/v2/%s/manifests/%s", repository, reference),
+		bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	client := *reg.Client
+	client.Transport = replayingBodies(client.Transport)
+	resp, err := client.Do(req)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// replayingBodies the transports of the registry client, with the token transport sending a
+// fresh copy of the body when it sends a request again with the token the registry asked for
+func replayingBodies(transport http.RoundTripper) http.RoundTripper {
+	switch t := transport.(type) {
+	case *registry.ErrorTransport:
+		return &registry.ErrorTransport{Transport: replayingBodies(t.Transport)}
+	case *registry.BasicTransport:
+		return &registry.BasicTransport{Transport: replayingBodies(t.Transport), URL: t.URL, Username: t.Username,
+			Password: t.Password}
+	case *registry.TokenTransport:
+		return &registry.TokenTransport{Transport: replayingTransport{t.Transport}, Username: t.Username,
+			Password: t.Password}
+	default:
+		return transport
+	}
+}
+
+// replayingTransport sends each request with a body of its own, so the same request can be sent twice
+type replayingTransport struct {
+	transport http.RoundTripper
+}
+
+func (t replayingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	transport := t.transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if req.GetBody == nil {
+		return transport.RoundTrip(req)
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	copied := req.Clone(req.Context())
+	copied.Body = body
+	return transport.RoundTrip(copied)
+}
+
+// deleteManifest registries only delete by digest, not by tag
+func deleteManifest(reg *registry.Registry, repository string, dgst digest.Digest) error {
+	req, err := http.NewRequest("DELETE", apiURL(reg, "/v2/%s/manifests/%s", repository, dgst), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := reg.Client.Do(req)
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	return err
+}
+
+// hasBlob checks whether the registry already has a blob in a repository
+func hasBlob(reg *registry.Registry, repository string, dgst digest.Digest) (bool, error) {
+	resp, err := reg.Client.Head(apiURL(reg, "/v2/%s/blobs/%s", repository, dgst))
+	if resp != nil {
+		defer resp.Body.Close()
+	}
+	if err == nil {
+		return resp.StatusCode == http.StatusOK, nil
+	}
+	if statusCode(err) == http.StatusNotFound {
+		return false, nil
+	}
+	return false, err
+}
+
+// downloadBlob the caller needs to close the content
+func downloadBlob(reg *registry.Registry, repository string, dgst digest.Digest) (io.ReadCloser, error) {
+	resp, err := reg.Client.Get(apiURL(reg, "/v2/%s/blobs/%s", repository, dgst))
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// uploadBlob does a monolithic upload of the blob
+func uploadBlob(reg *registry.Registry, repository string, dgst digest.Digest, content io.Reader, size int64) error {
+	push, uploadURL, err := startUpload(reg, repository)
+	if err != nil {
+		return err
+	}
+	q := uploadURL.Query()
+	q.Set("digest", dgst.String())
+	uploadURL.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("PUT", uploadURL.String(), content)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	if size > 0 {
+		req.ContentLength = size
+	}
+	return push.send(req)
+}
+
+// pushClient sends blobs to a registry.  The token transport of the registry client sends each
+// request without a token first and again with one when turned away, by which time the blob has
+// been read.  So pushing starts an upload straight through the token transport, which leaves the
+// credentials it got on the request, and the blob is sent with them from the start.
+type pushClient struct {
+	transport http.RoundTripper
+	host      string
+	// authorization the header the upload was started with
+	authorization string
+}
+
+// startUpload starts an upload to the repository, giving back the client to push with and where to upload to
+func startUpload(reg *registry.Registry, repository string) (*pushClient, *url.URL, error) {
+	base, err := url.Parse(reg.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	push := &pushClient{transport: reg.Client.Transport, host: base.Host}
+	req, err := http.NewRequest("POST", apiURL(reg, "/v2/%s/blobs/uploads/", repository), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	// below the transport adding basic auth, so the token set on the request is kept after
+	if basic := basicTransport(reg.Client.Transport); basic != nil {
+		push.transport = &registry.ErrorTransport{Transport: basic.Transport}
+		if strings.HasPrefix(req.URL.String(), basic.URL) && (basic.Username != "" || basic.Password != "") {
+			req.SetBasicAuth(basic.Username, basic.Password)
+		}
+	}
+	if push.transport == nil {
+		push.transport = http.DefaultTransport
+	}
+	resp, err := push.transport.RoundTrip(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp.Body.Close()
+	push.authorization = req.Header.Get("Authorization")
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return push, base.ResolveReference(location), nil
+}
+
+// send the request with the credentials the upload was started with, when it is to the same registry
+func (p *pushClient) send(req *http.Request) error {
+	if p.authorization != "" && req.URL.Host == p.host {
+		req.Header.Set("Authorization", p.authorization)
+	}
+	resp, err := p.transport.RoundTrip(req)
+	if resp != nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+// basicTransport finds the transport adding basic auth among those the registry client wraps
+// around each other, nil when there isn't one
+func basicTransport(transport http.RoundTripper) *registry.BasicTransport {
+	for {
+		switch t := transport.(type) {
+		case *registry.ErrorTransport:
+			transport = t.Transport
+		case *registry.BasicTransport:
+			return t
+		default:
+			return nil
+		}
+	}
+}
+
+// statusCode digs out the http status from errors made by the registry client, 0 if there isn't one
+func statusCode(err error) int {
+	if urlErr, ok := err.(*url.Error); ok {
+		err = urlErr.Err
+	}
+	if httpErr, ok := err.(*registry.HttpStatusError); ok {
+		return httpErr.Response.StatusCode
+	}
+	return 0
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/docker/distribution"
+	"github.com/docker/distribution/digest"
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+// NewRegistryCopyHandler creates something that copies images between
+// registries over the v2 api.  Nothing is pulled to a docker daemon, the
+// manifests and blobs are streamed straight from the source to the target.
+// Like NewDockerCLIHandler a source without an address is the docker hub.
+func NewRegistryCopyHandler(source, target RegistryInfo, filter DockerImageFilter) (handler ImageHandler, err error) {
+	c, err := newRegistryCopier(source, target)
+	if err != nil {
+		return
+	}
+	handler.source = regSource{c, source}
+	handler.tagger = c
+	handler.target = regTarget{c, target}
+	handler.filter = filter
+	return
+}
+
+// NewRegistryCopyFanOut like NewRegistryCopyHandler but for several targets.  Each blob
+// is downloaded from the source once and streamed to every target missing it.
+func NewRegistryCopyFanOut(source RegistryInfo, targets []RegistryInfo, filter DockerImageFilter) (FanOutHandler, error) {
+	c, err := newRegistryCopier(source, targets...)
+	if err != nil {
+		return FanOutHandler{}, err
+	}
+	handlers := make([]ImageHandler, 0, len(targets))
+	for _, target := range targets {
+		handlers = append(handlers, ImageHandler{
+			source: regSource{c, source},
+			tagger: c,
+			target: regTarget{c, target},
+			filter: filter,
+		})
+	}
+	return newFanOutHandler(handlers), nil
+}
+
+// registryCopier maps the pull, tag and push steps onto the registry api.
+// Pulling only fetches the manifest, tagging records where it should go and
+// pushing copies the blobs that are missing before putting the manifest.
+type registryCopier struct {
+	sourceInfo RegistryInfo
+	source     *registry.Registry
+	targets    []*copyTarget
+
+	mu     sync.Mutex
+	staged map[string]stagedImage
+	// how many tags of each pulled image are still to be pushed
+	pending map[string]int
+}
+
+// copyTarget a target registry, connected to the first time it is needed
+type copyTarget struct {
+	info RegistryInfo
+
+	mu  sync.Mutex
+	reg *registry.Registry
+}
+
+// stagedImage a manifest that has been pulled but not yet pushed
+type stagedImage struct {
+	repository string
+	resolvedManifest
+	// the name this was tagged from, if any
+	from string
+}
+
+func newRegistryCopier(source RegistryInfo, targets ...RegistryInfo) (*registryCopier, error) {
+	s, err := source.connect()
+	if err != nil {
+		return nil, err
+	}
+	c := &registryCopier{
+		sourceInfo: source,
+		source:     s,
+		staged:     make(map[string]stagedImage),
+		pending:    make(map[string]int),
+	}
+	for _, target := range targets {
+		// A target that is down shouldn't stop copies to the others
+		t, err := target.connect()
+		if err != nil && len(targets) == 1 {
+			return nil, err
+		}
+		c.targets = append(c.targets, &copyTarget{info: target, reg: t})
+	}
+	return c, nil
+}
+
+// Pull fetches the manifest of the image from the source registry, and for a multi-arch
+// image the manifests of the platforms being copied
+func (c *registryCopier) Pull(name string) error {
+	log.Debugf(">>Pull (%s)", name)
+	defer log.Debug("<<Pull")
+	repo, ref := splitImageName(name, c.sourceInfo.address)
+	if c.sourceInfo.address == "" && !strings.Contains(repo, "/") {
+		// official images on the hub live in the library namespace
+		repo = "library/" + repo
+	}
+	source := v2Registry{c.source, c.sourceInfo.retry, c.sourceInfo.platforms}
+	m, err := resolveManifest(source.manifestGetter(repo), ref, c.sourceInfo.platforms)
+	if err != nil {
+		log.Warnf("Couldn't get manifest for %s:%s from %s : %s", repo, ref, c.sourceInfo.URL(), err)
+		return err
+	}
+	c.mu.Lock()
+	c.staged[name] = stagedImage{repository: repo, resolvedManifest: m}
+	c.mu.Unlock()
+	return nil
+}
+
+// Tag makes a pulled image available to be pushed under a new name
+func (c *registryCopier) Tag(name, tag string) error {
+	log.Debugf(">>Tag (%s,%s)", name, tag)
+	defer log.Debug("<<Tag")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	img, ok := c.staged[name]
+	if !ok {
+		return fmt.Errorf("image %s has not been pulled", name)
+	}
+	img.from = name
+	c.staged[tag] = img
+	c.pending[name]++
+	return nil
+}
+
+// Push copies every blob the target doesn't have yet and then the manifest
+func (c *registryCopier) Push(name string) error {
+	return c.PushAll([]string{name})[name]
+}
+
+// pushReport what pushing a name copied
+type pushReport struct {
+	// digest of the manifest put in the target
+	digest digest.Digest
+	// bytes of blobs uploaded and manifests put
+	bytes int64
+}
+
+// pushJob one name being pushed to a target
+type pushJob struct {
+	name   string
+	target *copyTarget
+	repo   string
+	ref    string
+	img    stagedImage
+}
+
+// PushAll pushes several names, usually the same image to different targets, giving
+// back the error for each name that failed.  Blobs needed by more than one target are
+// only downloaded once and streamed to all of them.
+func (c *registryCopier) PushAll(names []string) map[string]error {
+	errs, _ := c.PushAllReporting(names)
+	return errs
+}
+
+// PushAllReporting like PushAll, also giving back what was copied for each name pushed
+func (c *registryCopier) PushAllReporting(names []string) (map[string]error, map[string]pushReport) {
+	log.Debugf(">>PushAll (%v)", names)
+	defer log.Debug("<<PushAll")
+	errs := make(map[string]error)
+	reports := make(map[string]pushReport)
+	defer c.unstage(names)
+
+	jobs := make([]*pushJob, 0, len(names))
+	for _, name := range names {
+		c.mu.Lock()
+		img, ok := c.staged[name]
+		c.mu.Unlock()
+		if !ok {
+			errs[name] = fmt.Errorf("image %s has not been pulled", name)
+			continue
+		}
+		target, err := c.connectTarget(name)
+		if err != nil {
+			errs[name] = err
+			continue
+		}
+		repo, ref := splitImageName(name, target.info.address)
+		jobs = append(jobs, &pushJob{name, target, repo, ref, img})
+	}
+
+	// Work out which pushes need which blobs so each is only downloaded once, and only
+	// uploaded once to a repository when the image is pushed there under several tags
+	var order []distribution.Descriptor
+	needed := make(map[digest.Digest][]*pushJob)
+	sharing := make(map[string][]*pushJob)
+	for _, job := range jobs {
+		for _, blob := range job.img.blobs {
+			key := job.target.info.address + "/" + job.repo + "@" + blob.Digest.String()
+			if _, seen := sharing[key]; seen {
+				sharing[key] = append(sharing[key], job)
+				continue
+			}
+			var exists bool
+			err := job.target.info.retry.Do("checking for blob "+blob.Digest.String(), func() (err error) {
+				exists, err = hasBlob(job.target.reg, job.repo, blob.Digest)
+				return
+			})
+			if err != nil {
+				errs[job.name] = err
+				break
+			}
+			if exists {
+				log.Debugf("Blob %s already in %s", blob.Digest, job.repo)
+				continue
+			}
+			sharing[key] = []*pushJob{job}
+			if _, ok := needed[blob.Digest]; !ok {
+				order = append(order, blob)
+			}
+			needed[blob.Digest] = append(needed[blob.Digest], job)
+		}
+	}
+	for _, blob := range order {
+		var waiting []*pushJob
+		for _, job := range needed[blob.Digest] {
+			if errs[job.name] == nil {
+				waiting = append(waiting, job)
+			}
+		}
+		for name, err := range c.streamBlob(blob, waiting) {
+			errs[name] = err
+		}
+		for _, job := range needed[blob.Digest] {
+			if err := errs[job.name]; err != nil {
+				for _, other := range sharing[job.target.info.address+"/"+job.repo+"@"+blob.Digest.String()] {
+					errs[other.name] = err
+				}
+				continue
+			}
+			// counted once for the repository, against the first name needing it
+			report := reports[job.name]
+			report.bytes += blob.Size
+			reports[job.name] = report
+		}
+	}
+
+	for _, job := range jobs {
+		if errs[job.name] != nil {
+			log.Warnf("Couldn't push %s : %s", job.name, errs[job.name])
+			continue
+		}
+		// The manifests of each platform have to be there before an index pointing at them
+		var err error
+		for _, child := range job.img.children {
+			err = job.target.info.retry.Do("putting manifest "+child.digest.String(), func() error {
+				return putManifest(job.target.reg, job.repo, child.digest.String(), child.mediaType, child.payload)
+			})
+			if err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = job.target.info.retry.Do("putting manifest of "+job.name, func() error {
+				return putManifest(job.target.reg, job.repo, job.ref, job.img.mediaType, job.img.payload)
+			})
+		}
+		if err != nil {
+			log.Warnf("Couldn't put manifest %s:%s : %s", job.repo, job.ref, err)
+			errs[job.name] = err
+			continue
+		}
+		report := reports[job.name]
+		report.digest = digest.FromBytes(job.img.payload)
+		report.bytes += int64(len(job.img.payload))
+		for _, child := range job.img.children {
+			report.bytes += int64(len(child.payload))
+		}
+		reports[job.name] = report
+	}
+	for name, err := range errs {
+		if err == nil {
+			delete(errs, name)
+		} else {
+			delete(reports, name)
+		}
+	}
+	return errs, reports
+}
+
+// streamBlob downloads a blob once, streaming it to every push needing it.  Any push
+// whose upload fails falls back to copying the blob on its own, with its own retries.
+func (c *registryCopier) streamBlob(blob distribution.Descriptor, jobs []*pushJob) map[string]error {
+	errs := make(map[string]error)
+	if len(jobs) == 0 {
+		return errs
+	}
+	var failed []*pushJob
+	if len(jobs) == 1 {
+		failed = jobs
+	} else {
+		failed = c.teeBlob(blob, jobs)
+	}
+	for _, job := range failed {
+		err := job.target.info.retry.Do("copying blob "+blob.Digest.String(), func() error {
+			return c.copyBlob(job.img.repository, job.target.reg, job.repo, blob)
+		})
+		if err != nil {
+			log.Warnf("Couldn't copy blob %s to %s : %s", blob.Digest, job.repo, err)
+			errs[job.name] = err
+		}
+	}
+	return errs
+}
+
+// teeBlob makes a single attempt at uploading the blob to all the targets at the same time,
+// giving back the ones that failed
+func (c *registryCopier) teeBlob(blob distribution.Descriptor, jobs []*pushJob) (failed []*pushJob) {
+	source := jobs[0].img.repository
+	content, err := downloadBlob(c.source, source, blob.Digest)
+	if err != nil {
+		log.Warnf("Couldn't download blob %s from %s : %s", blob.Digest, source, err)
+		return jobs
+	}
+	defer content.Close()
+
+	log.Debugf("Streaming blob %s (%d bytes) to %d targets", blob.Digest, blob.Size, len(jobs))
+	writers := make([]*io.PipeWriter, len(jobs))
+	results := make([]error, len(jobs))
+	var wg sync.WaitGroup
+	for n, job := range jobs {
+		reader, writer := io.Pipe()
+		writers[n] = writer
+		wg.Add(1)
+		go func(n int, job *pushJob) {
+			defer wg.Done()
+			results[n] = uploadBlob(job.target.reg, job.repo, blob.Digest, reader, blob.Size)
+			// Stop anything still being written to us blocking
+			reader.CloseWithError(fmt.Errorf("upload to %s finished", job.target.info.address))
+		}(n, job)
+	}
+	_, err = io.Copy(&fanOutWriter{writers: writers, failed: make([]bool, len(writers))}, content)
+	for _, writer := range writers {
+		writer.CloseWithError(err)
+	}
+	wg.Wait()
+	for n, job := range jobs {
+		if results[n] != nil {
+			log.Debugf("Streaming blob %s to %s failed : %s", blob.Digest, job.target.info.address, results[n])
+			failed = append(failed, job)
+		}
+	}
+	return
+}
+
+// fanOutWriter writes to all its writers, dropping any that fail so the rest carry on
+type fanOutWriter struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (f *fanOutWriter) Write(p []byte) (int, error) {
+	alive := 0
+	for n, w := range f.writers {
+		if f.failed[n] {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			f.failed[n] = true
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, io.ErrClosedPipe
+	}
+	return len(p), nil
+}
+
+// Discard forgets names that won't be pushed, like a push that failed
+func (c *registryCopier) Discard(names ...string) {
+	c.unstage(names)
+}
+
+// unstage forgets pushed names, and the images they were tagged from once all their tags are pushed.
+// An image pulled is only forgotten once no tags of it are waiting to be pushed.
+func (c *registryCopier) unstage(names []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, name := range names {
+		img, ok := c.staged[name]
+		if !ok || (img.from == "" && c.pending[name] > 0) {
+			continue
+		}
+		delete(c.staged, name)
+		if img.from != "" {
+			c.pending[img.from]--
+			if c.pending[img.from] <= 0 {
+				delete(c.pending, img.from)
+				delete(c.staged, img.from)
+			}
+		}
+	}
+}
+
+// connectTarget picks the target registry from the address at the start of the name,
+// connecting to it if that hasn't been done yet
+func (c *registryCopier) connectTarget(name string) (*copyTarget, error) {
+	target := c.targets[0]
+	for _, t := range c.targets {
+		if t.info.address != "" && strings.HasPrefix(name, t.info.address+"/") {
+			target = t
+			break
+		}
+	}
+	target.mu.Lock()
+	defer target.mu.Unlock()
+	if target.reg == nil {
+		reg, err := target.info.connect()
+		if err != nil {
+			return nil, err
+		}
+		target.reg = reg
+	}
+	return target, nil
+}
+
+// copyBlob streams a single blob from the source to the target unless it is already there
+func (c *registryCopier) copyBlob(sourceRepo string, target *registry.Registry, targetRepo string, blob distribution.Descriptor) error {
+	exists, err := hasBlob(target, targetRepo, blob.Digest)
+	if err != nil {
+		return err
+	}
+	if exists {
+		log.Debugf("Blob %s already in %s", blob.Digest, targetRepo)
+		return nil
+	}
+	content, err := downloadBlob(c.source, sourceRepo, blob.Digest)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	log.Debugf("Copying blob %s (%d bytes) to %s", blob.Digest, blob.Size, targetRepo)
+	return uploadBlob(target, targetRepo, blob.Digest, content, blob.Size)
+}
+
+// splitImageName breaks something like myregistry:5000/namespace/image:tag
+// into the repository and the tag or digest, dropping the registry address
+func splitImageName(name, address string) (repository, reference string) {
+	if address != "" && strings.HasPrefix(name, address+"/") {
+		name = strings.TrimPrefix(name, address+"/")
+	}
+	if i := strings.Index(name, "@"); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		return name[:i], name[i+1:]
+	}
+	return name, "latest"
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+func TestRegistryCopyPullTagPush(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+
+	dgst := source.addImage("prod/app", "1.0", "layer one", "layer two")
+	// the target already shares a layer so that one shouldn't be sent again
+	target.addBlob("prod/app", []byte("layer one"), "")
+
+	handler, err := NewRegistryCopyHandler(source.info(), target.info(), DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyHandler() error = %v", err)
+	}
+	if err = handler.PullTagPush("prod/app", "1.0"); err != nil {
+		t.Fatalf("PullTagPush() error = %v", err)
+	}
+	copied, ok := target.manifest("prod/app", "1.0")
+	if !ok {
+		t.Fatal("manifest was not copied to the target")
+	}
+	original, _ := source.manifest("prod/app", "1.0")
+	if string(copied.payload) != string(original.payload) || copied.mediaType != original.mediaType {
+		t.Errorf("copied manifest differs from the source, digest %s", dgst)
+	}
+	if target.uploads != 2 {
+		t.Errorf("expected the config and one layer to be uploaded, got %d uploads", target.uploads)
+	}
+	if len(handler.tagger.(*registryCopier).staged) != 0 {
+		t.Errorf("staged images left behind after push %v", handler.tagger.(*registryCopier).staged)
+	}
+}
+
+func TestRegistryCopyMissingImage(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+
+	handler, err := NewRegistryCopyHandler(source.info(), target.info(), DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyHandler() error = %v", err)
+	}
+	if err = handler.PullTagPush("prod/app", "1.0"); err == nil {
+		t.Error("expected an error copying an image the source doesn't have")
+	}
+}
+
+func Test_splitImageName(t *testing.T) {
+	tests := []struct {
+		name, address   string
+		repository, ref string
+	}{
+		{"alpine", "", "alpine", "latest"},
+		{"alpine:3.4", "", "alpine", "3.4"},
+		{"localhost:5000/team/app:1.0", "localhost:5000", "team/app", "1.0"},
+		{"localhost:5000/team/app", "localhost:5000", "team/app", "latest"},
+		{"team/app@sha256:abc", "", "team/app", "sha256:abc"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo, ref := splitImageName(tt.name, tt.address)
+			if repo != tt.repository || ref != tt.ref {
+				t.Errorf("splitImageName() = %s, %s want %s, %s", repo, ref, tt.repository, tt.ref)
+			}
+		})
+	}
+}
+
+func TestRegistryCopyRewritesRepositories(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	source.addImage("library/alpine", "3.4", "base")
+	source.addImage("library/alpine", "3.5", "base")
+
+	handler, err := NewRegistryCopyHandler(source.info(), target.info(), DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyHandler() error = %v", err)
+	}
+	handler.mapping = ImageMapping{Repositories: RepositoryRewriter{PrefixRule{"library/", ""}}}
+	if err = handler.RSync(handler.filter); err != nil {
+		t.Fatalf("RSync() error = %v", err)
+	}
+	if got := target.tags("alpine"); len(got) != 2 {
+		t.Errorf("tags in the target = %v, want 3.4 and 3.5 under alpine", got)
+	}
+	uploads := target.uploads
+	// the next sync has to see the renamed images are already there
+	if err = handler.RSync(handler.filter); err != nil {
+		t.Fatalf("RSync() error = %v", err)
+	}
+	if target.uploads != uploads {
+		t.Errorf("second sync uploaded %d more blobs, want none", target.uploads-uploads)
+	}
+}
+
+func TestRegistryCopyPushedDigest(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+
+	pushed := source.addImage("prod/app", "1.0", "first build")
+	// the tag moved on before the notification was handled
+	source.addImage("prod/app", "1.0", "second build")
+	untagged := source.addImage("prod/app", "", "platform build")
+
+	handler, err := NewRegistryCopyHandler(source.info(), target.info(), DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyHandler() error = %v", err)
+	}
+	if err = handler.Handle(RegistryEvent{Action: "push", Target: RegistryTarget{"prod/app", "1.0"}, Digest: pushed}); err != nil {
+		t.Fatalf("Handle() error = %v", err)
+	}
+	if copied, _ := target.manifest("prod/app", "1.0"); digest.FromBytes(copied.payload) != pushed {
+		t.Errorf("copied %s, want the pushed manifest %s", digest.FromBytes(copied.payload), pushed)
+	}
+	if err = handler.Handle(RegistryEvent{Action: "push", Target: RegistryTarget{"prod/app", ""}, Digest: untagged}); err != nil {
+		t.Fatalf("Handle() untagged error = %v", err)
+	}
+	if _, ok := target.manifest("prod/app", untagged.String()); !ok {
+		t.Error("untagged manifest was not copied by its digest")
+	}
+	if got := target.tags("prod/app"); !reflect.DeepEqual(got, []string{"1.0"}) {
+		t.Errorf("target tags = %v, want just 1.0", got)
+	}
+}
+
+// tokenRegistry serves the fake registry only to requests with a bearer token, which it hands
+// out for basic auth like a registry with a token service does
+func tokenRegistry(f *fakeRegistry) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if user, password, ok := r.BasicAuth(); !ok || user != "promoter" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token": "t0k3n"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer t0k3n" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="fake",scope="repository:prod/app:push,pull"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		f.serve(w, r)
+	}))
+	return server
+}
+
+func TestRegistryCopyTokenAuth(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	withToken := tokenRegistry(target)
+	defer withToken.Close()
+	source.addImage("prod/app", "1.0", "layer one", "layer two")
+
+	info := RegistryInfo{address: withToken.URL, username: "promoter", password: "secret", retry: RetryPolicy{Attempts: 1}}
+	handler, err := NewRegistryCopyHandler(source.info(), info, DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyHandler() error = %v", err)
+	}
+	if err = handler.PullTagPush("prod/app", "1.0"); err != nil {
+		t.Fatalf("PullTagPush() error = %v", err)
+	}
+	if _, ok := target.manifest("prod/app", "1.0"); !ok || target.uploads != 3 {
+		t.Errorf("copied manifest %v with %d uploads, want it and the config and two layers", ok, target.uploads)
+	}
+	// with every blob there already only the manifest is sent, no upload being started for a token
+	source.addImageWithConfig("prod/app", "1.1", `{"image":"prod/app:1.0"}`, "layer one", "layer two")
+	started := target.uploadID
+	if err = handler.PullTagPush("prod/app", "1.1"); err != nil {
+		t.Fatalf("PullTagPush() error = %v", err)
+	}
+	if _, ok := target.manifest("prod/app", "1.1"); !ok || target.uploadID != started {
+		t.Errorf("copied manifest %v starting %d uploads, want it without any", ok, target.uploadID-started)
+	}
+}
+
+func TestRegistryCopyForgetsFailedPushes(t *testing.T) {
+	defer func(original func(time.Duration)) { sleep = original }(sleep)
+	sleep = func(time.Duration) {}
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	noUploads := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.URL.Path, "/blobs/uploads/") {
+			http.Error(w, "storage full", http.StatusInternalServerError)
+			return
+		}
+		target.serve(w, r)
+	}))
+	defer noUploads.Close()
+	source.addImage("prod/app", "1.0", "layer")
+
+	handler, err := NewRegistryCopyHandler(source.info(), RegistryInfo{address: noUploads.URL}, DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyHandler() error = %v", err)
+	}
+	rule, _ := ParseTagRule(`1\.0=1.0,stable`)
+	handler.mapping = ImageMapping{Tags: []TagRule{rule}}
+	if err = handler.PullTagPush("prod/app", "1.0"); err == nil {
+		t.Fatal("PullTagPush() should fail when the target can't take uploads")
+	}
+	if staged := handler.tagger.(*registryCopier).staged; len(staged) != 0 {
+		t.Errorf("%d staged images left behind after failing", len(staged))
+	}
+}
@@ -93,7 +93,7 @@ func waitStarted(client *docker.Client, id string, maxWait time.Duration) error
 		c, err := client.InspectContainer(id)
 		if err != nil {
 			//This is to be expected so probably will remove log message later
-			log.Warnf("Container not started %s %s", c, err)
+			log.Warnf("Container not started %v %s", c, err)
 			break
 		}
 		if c.State.Running {
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RetryPolicy how many times and how patiently to retry a failed registry operation
+type RetryPolicy struct {
+	// Attempts in total, so 1 or less means no retries
+	Attempts int
+	// InitialBackoff the wait before the first retry, doubled for each one after
+	InitialBackoff time.Duration
+	// MaxBackoff the longest we will wait between attempts
+	MaxBackoff time.Duration
+	// Jitter the fraction of the backoff that is randomised so clients don't retry in step
+	Jitter float64
+}
+
+// DefaultRetryPolicy used for registries unless told otherwise
+var DefaultRetryPolicy = RetryPolicy{
+	Attempts:       3,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+	Jitter:         0.2,
+}
+
+// sleep swapped out by tests
+var sleep = time.Sleep
+
+// Do runs fn until it succeeds, fails with an error that isn't worth retrying or we run out of attempts
+func (p RetryPolicy) Do(operation string, fn func() error) error {
+	var err error
+	backoff := p.InitialBackoff
+	for attempt := 1; ; attempt++ {
+		err = fn()
+		if err == nil || attempt >= p.Attempts || !isRetryable(err) {
+			return err
+		}
+		wait := backoff
+		if p.Jitter > 0 {
+			wait += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(backoff))
+		}
+		log.Warnf("%s failed on attempt %d of %d, retrying in %s : %s", operation, attempt, p.Attempts, wait, err)
+		sleep(wait)
+		backoff *= 2
+		if p.MaxBackoff > 0 && backoff > p.MaxBackoff {
+			backoff = p.MaxBackoff
+		}
+	}
+}
+
+// permanentError an error that will happen again no matter how often we retry
+type permanentError struct {
+	err error
+}
+
+func (p permanentError) Error() string {
+	return p.err.Error()
+}
+
+// permanent marks an error as not worth retrying
+func permanent(err error) error {
+	return permanentError{err}
+}
+
+// permanentCLIFailures what the docker cli says when the registry turned it down for good
+var permanentCLIFailures = []string{"manifest unknown", "unauthorized", "denied"}
+
+// isRetryable sorts errors into ones that might go away, like timeouts, rate limiting and
+// server errors, and ones that won't, like bad credentials, missing images or invalid manifests.
+func isRetryable(err error) bool {
+	if _, ok := err.(permanentError); ok {
+		return false
+	}
+	if code := statusCode(err); code != 0 {
+		return code >= 500 || code == http.StatusTooManyRequests || code == http.StatusRequestTimeout
+	}
+	if cli, ok := err.(cliError); ok {
+		output := strings.ToLower(cli.output)
+		for _, reason := range permanentCLIFailures {
+			if strings.Contains(output, reason) {
+				return false
+			}
+		}
+	}
+	// Everything else is network trouble, timeouts or the docker cli failing for reasons we can't see
+	return true
+}
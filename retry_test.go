@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/heroku/docker-registry-client/registry"
+)
+
+func httpError(code int) error {
+	return &url.Error{Op: "Get", URL: "http://registry/v2/", Err: &registry.HttpStatusError{
+		Response: &http.Response{StatusCode: code},
+	}}
+}
+
+func Test_isRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"server error", httpError(http.StatusBadGateway), true},
+		{"rate limited", httpError(http.StatusTooManyRequests), true},
+		{"unauthorized", httpError(http.StatusUnauthorized), false},
+		{"not found", httpError(http.StatusNotFound), false},
+		{"manifest invalid", httpError(http.StatusBadRequest), false},
+		{"connection reset", &url.Error{Op: "Get", URL: "http://registry/v2/", Err: errors.New("connection reset by peer")}, true},
+		{"marked permanent", permanent(errors.New("unsupported manifest")), false},
+		{"docker cli network trouble", cliError{errors.New("exit status 1"), "net/http: TLS handshake timeout"}, true},
+		{"docker cli missing image", cliError{errors.New("exit status 1"), "Error response from daemon: manifest for app:1.0 not found: manifest unknown: manifest unknown"}, false},
+		{"docker cli not logged in", cliError{errors.New("exit status 1"), "unauthorized: authentication required"}, false},
+		{"docker cli no access", cliError{errors.New("exit status 1"), "denied: requested access to the resource is denied"}, false},
+		{"targets that all failed for good", targetErrors(map[string]error{"a": httpError(http.StatusNotFound), "b": httpError(http.StatusUnauthorized)}, 2), false},
+		{"targets of which one might recover", targetErrors(map[string]error{"a": httpError(http.StatusNotFound), "b": httpError(http.StatusBadGateway)}, 2), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	var waits []time.Duration
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+	defer func() { sleep = time.Sleep }()
+
+	policy := RetryPolicy{Attempts: 4, InitialBackoff: time.Second, MaxBackoff: 3 * time.Second}
+	tests := []struct {
+		name      string
+		errs      []error
+		wantCalls int
+		wantWaits []time.Duration
+		wantErr   bool
+	}{
+		{"succeeds first time", []error{nil}, 1, nil, false},
+		{"recovers", []error{httpError(502), httpError(503), nil}, 3,
+			[]time.Duration{time.Second, 2 * time.Second}, false},
+		{"gives up", []error{httpError(502), httpError(502), httpError(502), httpError(502)}, 4,
+			[]time.Duration{time.Second, 2 * time.Second, 3 * time.Second}, true},
+		{"permanent failure", []error{httpError(404)}, 1, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			waits = nil
+			calls := 0
+			err := policy.Do(tt.name, func() error {
+				calls++
+				return tt.errs[calls-1]
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Do() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("Do() made %d calls, want %d", calls, tt.wantCalls)
+			}
+			if len(waits) != len(tt.wantWaits) {
+				t.Fatalf("Do() waited %v, want %v", waits, tt.wantWaits)
+			}
+			for n := range waits {
+				if waits[n] != tt.wantWaits[n] {
+					t.Errorf("Do() waited %v, want %v", waits, tt.wantWaits)
+				}
+			}
+		})
+	}
+}
+
+func TestRetryPolicyJitter(t *testing.T) {
+	var waits []time.Duration
+	sleep = func(d time.Duration) { waits = append(waits, d) }
+	defer func() { sleep = time.Sleep }()
+
+	policy := RetryPolicy{Attempts: 20, InitialBackoff: time.Second, MaxBackoff: time.Second, Jitter: 0.5}
+	policy.Do("jitter", func() error { return httpError(500) })
+	for _, wait := range waits {
+		if wait < 500*time.Millisecond || wait > 1500*time.Millisecond {
+			t.Errorf("wait of %s is outside the jitter", wait)
+		}
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// RepositoryRule renames a repository on its way from the source to the target
+type RepositoryRule interface {
+	// Rewrite gives the new name and true if the rule applies to the repository
+	Rewrite(repository string) (string, bool)
+}
+
+// PrefixRule replaces From at the start of a repository name with To,
+// e.g. staging/ to prod/ or library/ to nothing to flatten it
+type PrefixRule struct {
+	From, To string
+}
+
+func (p PrefixRule) Rewrite(repository string) (string, bool) {
+	if !strings.HasPrefix(repository, p.From) {
+		return repository, false
+	}
+	return p.To + strings.TrimPrefix(repository, p.From), true
+}
+
+// RegexRule replaces a repository name matching the whole of the pattern
+// with the replacement, which can use the groups captured like $1 or ${name}
+type RegexRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// NewRegexRule the pattern has to match the whole name
+func NewRegexRule(pattern, replacement string) (RegexRule, error) {
+	compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return RegexRule{}, err
+	}
+	return RegexRule{compiled, replacement}, nil
+}
+
+func (r RegexRule) Rewrite(repository string) (string, bool) {
+	match := r.pattern.FindStringSubmatchIndex(repository)
+	if match == nil {
+		return repository, false
+	}
+	return string(r.pattern.ExpandString(nil, r.replacement, repository, match)), true
+}
+
+// RepositoryRewriter ordered rules, the first one that applies renames the repository
+// and a repository none apply to keeps its name
+type RepositoryRewriter []RepositoryRule
+
+// Rewrite the name of the repository in the target
+func (r RepositoryRewriter) Rewrite(repository string) string {
+	for _, rule := range r {
+		if rewritten, ok := rule.Rewrite(repository); ok {
+			return rewritten
+		}
+	}
+	return repository
+}
+
+// ParseRepositoryRule reads a rule written as prefix:<from>=<to> or regex:<pattern>=<replacement>
+func ParseRepositoryRule(rule string) (RepositoryRule, error) {
+	kind, spec := "", rule
+	if n := strings.Index(rule, ":"); n >= 0 {
+		kind, spec = rule[:n], rule[n+1:]
+	}
+	n := strings.Index(spec, "=")
+	if n < 0 {
+		return nil, fmt.Errorf("rewrite rule %s should look like prefix:<from>=<to> or regex:<pattern>=<replacement>", rule)
+	}
+	from, to := spec[:n], spec[n+1:]
+	switch kind {
+	case "prefix":
+		return PrefixRule{from, to}, nil
+	case "regex":
+		r, err := NewRegexRule(from, to)
+		if err != nil {
+			return nil, fmt.Errorf("bad regular expression in rewrite rule %s : %s", rule, err)
+		}
+		return r, nil
+	}
+	return nil, fmt.Errorf("unknown kind of rewrite rule %s, expected prefix or regex", rule)
+}
+
+// TagRule gives an image whose tag matches the pattern a set of tags in the target.  Each tag
+// is a template, see tagData for what it can use, and after that $1 or ${name} are replaced with
+// the groups the pattern captured, e.g. (.*)-rc\d+ to $1 and promoted-{{.Date}}
+type TagRule struct {
+	pattern   *regexp.Regexp
+	templates []tagTemplate
+}
+
+type tagTemplate struct {
+	*template.Template
+	// stamp changes with the date so isn't expected to be in the target already
+	stamp bool
+	// usesDigest needs the digest of the source image
+	usesDigest bool
+}
+
+// tagData what a tag template can use
+type tagData struct {
+	Repository string
+	Tag        string
+	// Digest of the manifest in the source
+	Digest string
+	// Date of the copy as 2006-01-02
+	Date string
+}
+
+// dateFormat how .Date looks in tag templates
+const dateFormat = "2006-01-02"
+
+// now swapped out by tests
+var now = time.Now
+
+// validTag what the registry accepts as a tag
+var validTag = regexp.MustCompile(`^[\w][\w.-]{0,127}$`)
+
+// NewTagRule the pattern has to match the whole tag.  At least one of the tags can't
+// use the date, as otherwise there would be no way to tell the image was already copied.
+func NewTagRule(pattern string, templates ...string) (TagRule, error) {
+	compiled, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return TagRule{}, err
+	}
+	if len(templates) == 0 {
+		return TagRule{}, fmt.Errorf("tag rule %s gives no tags", pattern)
+	}
+	rule := TagRule{pattern: compiled}
+	stable := false
+	for _, text := range templates {
+		t, err := template.New(text).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return TagRule{}, fmt.Errorf("bad tag template %s : %s", text, err)
+		}
+		sample := tagData{"repo", "tag", "sha256:" + strings.Repeat("1", 64), "2001-01-01"}
+		first, err := render(t, sample)
+		if err != nil {
+			return TagRule{}, fmt.Errorf("bad tag template %s : %s", text, err)
+		}
+		sample.Date = "2002-02-02"
+		otherDate, _ := render(t, sample)
+		sample.Date, sample.Digest = "2001-01-01", "sha256:"+strings.Repeat("2", 64)
+		otherDigest, _ := render(t, sample)
+		tt := tagTemplate{t, first != otherDate, first != otherDigest}
+		stable = stable || !tt.stamp
+		rule.templates = append(rule.templates, tt)
+	}
+	if !stable {
+		return TagRule{}, fmt.Errorf("tag rule %s needs at least one tag without the date in it", pattern)
+	}
+	return rule, nil
+}
+
+func render(t *template.Template, data tagData) (string, error) {
+	var out bytes.Buffer
+	err := t.Execute(&out, data)
+	return out.String(), err
+}
+
+// ImageMapping how images from the source are named in the target
+type ImageMapping struct {
+	Repositories RepositoryRewriter
+	// Tags the first rule matching the tag gives the tags in the target, with no match it is kept
+	Tags []TagRule
+}
+
+// mappedImage the names a source image has in the target
+type mappedImage struct {
+	source     RegistryTarget
+	repository string
+	// tags that should be in the target once the image is copied
+	tags []string
+	// stamps tags that depend on the date the image is copied
+	stamps []string
+	// stampPatterns match the stamps whatever date they were made
+	stampPatterns []*regexp.Regexp
+}
+
+// targets all the images to push, stamps included
+func (m mappedImage) targets() []RegistryTarget {
+	targets := make([]RegistryTarget, 0, len(m.tags)+len(m.stamps))
+	for _, tag := range append(append([]string{}, m.tags...), m.stamps...) {
+		targets = append(targets, RegistryTarget{m.repository, tag})
+	}
+	return targets
+}
+
+// isStamp true if the tag in the target is a stamp of this image
+func (m mappedImage) isStamp(tag string) bool {
+	for _, pattern := range m.stampPatterns {
+		if pattern.MatchString(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveCollisions keeps one of the source images that would have the same name in the target,
+// as otherwise they would overwrite each other and be copied again on every sync.  The image with
+// the highest version wins, or the last one in alphabetical order when the tags aren't versions.
+// The others are given back as left out, in the order they were in.
+func resolveCollisions(mapped []mappedImage) (kept, leftOut []mappedImage) {
+	byPreference := append([]mappedImage{}, mapped...)
+	sort.SliceStable(byPreference, func(i, j int) bool {
+		return preferred(byPreference[i].source, byPreference[j].source)
+	})
+	owners := make(map[RegistryTarget]RegistryTarget)
+	losers := make(map[RegistryTarget]bool)
+	for _, m := range byPreference {
+		collides := false
+		for _, target := range m.targets() {
+			if owner, ok := owners[target]; ok {
+				log.Warnf("Not copying %s:%s as %s:%s is copied to %s:%s too", m.source.Repository, m.source.Tag,
+					owner.Repository, owner.Tag, target.Repository, target.Tag)
+				collides = true
+				break
+			}
+		}
+		if collides {
+			losers[m.source] = true
+			continue
+		}
+		for _, target := range m.targets() {
+			owners[target] = m.source
+		}
+	}
+	kept = make([]mappedImage, 0, len(mapped))
+	for _, m := range mapped {
+		if losers[m.source] {
+			leftOut = append(leftOut, m)
+		} else {
+			kept = append(kept, m)
+		}
+	}
+	return kept, leftOut
+}
+
+// preferred true if image a wins over image b when both have the same name in the target
+func preferred(a, b RegistryTarget) bool {
+	va, errA := ParseVersion(a.Tag)
+	vb, errB := ParseVersion(b.Tag)
+	switch {
+	case errA == nil && errB == nil && va.Compare(vb) != 0:
+		return va.Compare(vb) > 0
+	case (errA == nil) != (errB == nil):
+		return errA == nil
+	case a.Tag != b.Tag:
+		return a.Tag > b.Tag
+	}
+	return a.Repository > b.Repository
+}
+
+// needsDigest true when the digest of the source image is needed to name it in the target
+func (m ImageMapping) needsDigest() bool {
+	for _, rule := range m.Tags {
+		for _, t := range rule.templates {
+			if t.usesDigest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// mapImage names a source image in the target.  dgst is the digest of its manifest in the source,
+// which may be empty if needsDigest is false.
+func (m ImageMapping) mapImage(image RegistryTarget, dgst string) (mappedImage, error) {
+	mapped := mappedImage{source: image, repository: m.Repositories.Rewrite(image.Repository)}
+	for _, rule := range m.Tags {
+		match := rule.pattern.FindStringSubmatchIndex(image.Tag)
+		if match == nil {
+			continue
+		}
+		date := now().Format(dateFormat)
+		data := tagData{image.Repository, image.Tag, dgst, date}
+		for _, t := range rule.templates {
+			rendered, err := render(t.Template, data)
+			if err != nil {
+				return mapped, err
+			}
+			tag := string(rule.pattern.ExpandString(nil, rendered, image.Tag, match))
+			if !validTag.MatchString(tag) {
+				return mapped, fmt.Errorf("%s isn't a valid tag for %s:%s", tag, image.Repository, image.Tag)
+			}
+			if !t.stamp {
+				mapped.tags = append(mapped.tags, tag)
+				continue
+			}
+			mapped.stamps = append(mapped.stamps, tag)
+			// Work out the same tag for any date
+			const marker = "\x00date\x00"
+			data.Date = marker
+			rendered, _ = render(t.Template, data)
+			data.Date = date
+			quoted := regexp.QuoteMeta(string(rule.pattern.ExpandString(nil, rendered, image.Tag, match)))
+			pattern := strings.Replace(quoted, regexp.QuoteMeta(marker), `\d{4}-\d{2}-\d{2}`, -1)
+			mapped.stampPatterns = append(mapped.stampPatterns, regexp.MustCompile("^"+pattern+"$"))
+		}
+		return mapped, nil
+	}
+	mapped.tags = []string{image.Tag}
+	return mapped, nil
+}
+
+// identity true when images keep their names in the target
+func (m ImageMapping) identity() bool {
+	return len(m.Repositories) == 0 && len(m.Tags) == 0
+}
+
+// ParseTagRule reads a rule written as <pattern>=<template>[,<template>...].  The pattern can
+// have = in it as the rule is split at the last one, tags never having one.
+func ParseTagRule(rule string) (TagRule, error) {
+	n := strings.LastIndex(rule, "=")
+	if n < 0 {
+		return TagRule{}, fmt.Errorf("tag rule %s should look like <pattern>=<tag>[,<tag>...]", rule)
+	}
+	return NewTagRule(rule[:n], strings.Split(rule[n+1:], ",")...)
+}
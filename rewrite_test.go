@@ -0,0 +1,314 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+	"github.com/docker/distribution/manifest/schema2"
+)
+
+func TestRepositoryRewriter(t *testing.T) {
+	flatten, _ := NewRegexRule(`library/(.*)`, "$1")
+	teams, _ := NewRegexRule(`staging/(?P<team>[^/]+)/(.*)`, "prod/${team}-$2")
+	rewriter := RepositoryRewriter{
+		PrefixRule{"staging/legacy/", "archive/"},
+		teams,
+		flatten,
+		PrefixRule{"", "mirror/"},
+	}
+	tests := []struct {
+		repository, want string
+	}{
+		{"staging/legacy/app", "archive/app"},
+		{"staging/team1/app", "prod/team1-app"},
+		{"library/alpine", "alpine"},
+		{"other/app", "mirror/other/app"},
+		// the regex has to match the whole name
+		{"mylibrary/alpine", "mirror/mylibrary/alpine"},
+	}
+	for _, tt := range tests {
+		if got := rewriter.Rewrite(tt.repository); got != tt.want {
+			t.Errorf("Rewrite(%s) = %s, want %s", tt.repository, got, tt.want)
+		}
+	}
+}
+
+func TestParseRepositoryRule(t *testing.T) {
+	tests := []struct {
+		rule, repository, want, wantErr string
+	}{
+		{"prefix:staging/=prod/", "staging/app", "prod/app", ""},
+		{"regex:library/(.*)=$1", "library/alpine", "alpine", ""},
+		{"staging/=prod/", "", "", "unknown kind"},
+		{"prefix:staging/", "", "", "should look like"},
+		{"regex:(=x", "", "", "bad regular expression"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			rule, err := ParseRepositoryRule(tt.rule)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ParseRepositoryRule() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseRepositoryRule() error = %v", err)
+			}
+			if got, _ := rule.Rewrite(tt.repository); got != tt.want {
+				t.Errorf("Rewrite(%s) = %s, want %s", tt.repository, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffWithMapping(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	source.addManifest("staging/app", "1.0", schema2.MediaTypeManifest, []byte("one"))
+	source.addManifest("staging/app", "2.0", schema2.MediaTypeManifest, []byte("two"))
+	source.addManifest("staging/app", "3.0", schema2.MediaTypeManifest, []byte("three"))
+	target.addManifest("prod/app", "1.0", schema2.MediaTypeManifest, []byte("one"))
+	target.addManifest("prod/app", "2.0", schema2.MediaTypeManifest, []byte("old two"))
+	target.addManifest("prod/app", "0.9", schema2.MediaTypeManifest, []byte("nine"))
+	// not something the source maps to so left alone
+	target.addManifest("prod/other", "1.0", schema2.MediaTypeManifest, []byte("other"))
+
+	s, _ := source.info().GetRegistry()
+	d, _ := target.info().GetRegistry()
+	mapping := ImageMapping{Repositories: RepositoryRewriter{PrefixRule{"staging/", "prod/"}}}
+	plan, err := Diff(s, d, DockerImageFilter{repoFilter: NewNamespaceFilter("staging"), tagFilter: matchEverything{}}, mapping, true)
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	want := SyncPlan{
+		Missing:  RegistryTargets{{"staging/app", "3.0"}},
+		Outdated: RegistryTargets{{"staging/app", "2.0"}},
+		Extra:    RegistryTargets{{"prod/app", "0.9"}},
+	}
+	if !reflect.DeepEqual(plan, want) {
+		t.Errorf("Diff() = %+v, want %+v", plan, want)
+	}
+}
+
+func TestDiffDoesntPruneWhatCantBeMapped(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	source.addManifest("staging/app", "1.0", schema2.MediaTypeManifest, []byte("one"))
+	source.addManifest("staging/app", "broken", schema2.MediaTypeManifest, []byte("broken"))
+	source.addManifest("staging/web", "1.0", schema2.MediaTypeManifest, []byte("web"))
+	target.addManifest("prod/app", "1.0", schema2.MediaTypeManifest, []byte("one"))
+	target.addManifest("prod/app", "broken", schema2.MediaTypeManifest, []byte("broken"))
+	target.addManifest("prod/web", "1.0", schema2.MediaTypeManifest, []byte("web"))
+	target.addManifest("prod/web", "0.9", schema2.MediaTypeManifest, []byte("nine"))
+
+	s, _ := source.info().GetRegistry()
+	d, _ := target.info().GetRegistry()
+	// broken maps to a tag that isn't valid
+	rule, err := NewTagRule(`broken`, "{{.Tag}}:1")
+	if err != nil {
+		t.Fatalf("NewTagRule() error = %v", err)
+	}
+	mapping := ImageMapping{Repositories: RepositoryRewriter{PrefixRule{"staging/", "prod/"}}, Tags: []TagRule{rule}}
+	plan, err := Diff(s, d, DockerImageFilter{repoFilter: NewNamespaceFilter("staging"), tagFilter: matchEverything{}}, mapping, true)
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	if want := (RegistryTargets{{"prod/web", "0.9"}}); !reflect.DeepEqual(plan.Extra, want) {
+		t.Errorf("Diff() extra = %v, want %v", plan.Extra, want)
+	}
+}
+
+func TestTagRules(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC) }
+	release, err := NewTagRule(`(\d+\.\d+\.\d+)-rc\d+`, "$1", "promoted-{{.Date}}")
+	if err != nil {
+		t.Fatalf("NewTagRule() error = %v", err)
+	}
+	bySha, err := NewTagRule(`latest`, "{{.Tag}}", `sha-{{slice .Digest 7 14}}`)
+	if err != nil {
+		t.Fatalf("NewTagRule() error = %v", err)
+	}
+	mapping := ImageMapping{Tags: []TagRule{release, bySha}}
+	if !mapping.needsDigest() {
+		t.Error("needsDigest() = false with a rule using the digest")
+	}
+	tests := []struct {
+		tag, digest  string
+		tags, stamps []string
+	}{
+		{"1.4.2-rc3", "", []string{"1.4.2"}, []string{"promoted-2026-10-18"}},
+		{"latest", "sha256:0123456789abcdef", []string{"latest", "sha-0123456"}, nil},
+		{"1.4.2", "", []string{"1.4.2"}, nil},
+	}
+	for _, tt := range tests {
+		m, err := mapping.mapImage(RegistryTarget{"team/app", tt.tag}, tt.digest)
+		if err != nil {
+			t.Fatalf("mapImage(%s) error = %v", tt.tag, err)
+		}
+		if !reflect.DeepEqual(m.tags, tt.tags) || !reflect.DeepEqual(m.stamps, tt.stamps) {
+			t.Errorf("mapImage(%s) = %v %v, want %v %v", tt.tag, m.tags, m.stamps, tt.tags, tt.stamps)
+		}
+	}
+	m, _ := mapping.mapImage(RegistryTarget{"team/app", "1.4.2-rc3"}, "")
+	if !m.isStamp("promoted-2025-01-31") || m.isStamp("promoted-latest") {
+		t.Error("isStamp() doesn't match the stamps of other days")
+	}
+}
+
+func TestTagRuleErrors(t *testing.T) {
+	tests := []struct {
+		name      string
+		pattern   string
+		templates []string
+		wantErr   string
+	}{
+		{"only stamps", ".*", []string{"promoted-{{.Date}}"}, "without the date"},
+		{"no tags", ".*", nil, "gives no tags"},
+		{"bad template", ".*", []string{"{{.Tag"}, "bad tag template"},
+		{"unknown field", ".*", []string{"{{.Branch}}"}, "bad tag template"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewTagRule(tt.pattern, tt.templates...)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("NewTagRule() error = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestParseTagRule(t *testing.T) {
+	tests := []struct {
+		rule, tag, want, wantErr string
+	}{
+		{`(\d+\.\d+)-rc\d+=$1`, "1.2-rc3", "1.2", ""},
+		{`([^=]+)-final=$1,stable`, "1.2-final", "1.2", ""},
+		{`latest`, "", "", "should look like"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.rule, func(t *testing.T) {
+			rule, err := ParseTagRule(tt.rule)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("ParseTagRule() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseTagRule() error = %v", err)
+			}
+			m, err := ImageMapping{Tags: []TagRule{rule}}.mapImage(RegistryTarget{"app", tt.tag}, "")
+			if err != nil || m.tags[0] != tt.want {
+				t.Errorf("mapImage(%s) = %v, %v, want %s", tt.tag, m.tags, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveCollisions(t *testing.T) {
+	rule, _ := NewTagRule(`(\d+\.\d+\.\d+)-rc\d+`, "$1")
+	mapping := ImageMapping{Tags: []TagRule{rule}}
+	var mapped []mappedImage
+	for _, tag := range []string{"1.4.2-rc2", "1.4.2-rc3", "1.4.3-rc1", "1.4.2-rc1", "1.4.2"} {
+		m, _ := mapping.mapImage(RegistryTarget{"app", tag}, "")
+		mapped = append(mapped, m)
+	}
+	kept, leftOut := resolveCollisions(mapped)
+	sources := func(images []mappedImage) (tags []string) {
+		for _, m := range images {
+			tags = append(tags, m.source.Tag)
+		}
+		return tags
+	}
+	// 1.4.2 itself is the highest version, it being a release rather than a release candidate
+	if got, want := sources(kept), []string{"1.4.3-rc1", "1.4.2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("kept %v, want %v", got, want)
+	}
+	if got, want := sources(leftOut), []string{"1.4.2-rc2", "1.4.2-rc3", "1.4.2-rc1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("left out %v, want %v", got, want)
+	}
+}
+
+func TestPromoteCollidingTags(t *testing.T) {
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	source.addImage("team/app", "1.4.2-rc1", "one")
+	rc2 := source.addImage("team/app", "1.4.2-rc2", "two")
+
+	handler, err := NewRegistryCopyHandler(source.info(), target.info(), DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyHandler() error = %v", err)
+	}
+	rule, _ := NewTagRule(`(\d+\.\d+\.\d+)-rc\d+`, "$1")
+	handler.mapping = ImageMapping{Tags: []TagRule{rule}}
+	handler.prune = PruneOptions{Enabled: true}
+	if err = handler.RSync(handler.filter); err != nil {
+		t.Fatalf("RSync() error = %v", err)
+	}
+	if m, ok := target.manifest("team/app", "1.4.2"); !ok || digest.FromBytes(m.payload) != rc2 {
+		t.Errorf("1.4.2 in the target isn't the last release candidate")
+	}
+
+	s, _ := source.info().GetRegistry()
+	d, _ := target.info().GetRegistry()
+	plan, err := Diff(s, d, handler.filter, handler.mapping, true)
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	if len(plan.Missing) != 0 || len(plan.Outdated) != 0 || len(plan.Extra) != 0 {
+		t.Errorf("Diff() = %+v, want nothing to do", plan)
+	}
+}
+
+func TestPromoteWithTags(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC) }
+	source := newFakeRegistry()
+	defer source.Close()
+	target := newFakeRegistry()
+	defer target.Close()
+	source.addImage("team/app", "1.4.2-rc3", "base")
+
+	handler, err := NewRegistryCopyHandler(source.info(), target.info(), DockerImageFilter{repoFilter: matchEverything{}, tagFilter: matchEverything{}})
+	if err != nil {
+		t.Fatalf("NewRegistryCopyHandler() error = %v", err)
+	}
+	rule, _ := NewTagRule(`(\d+\.\d+\.\d+)-rc\d+`, "$1", "promoted-{{.Date}}")
+	handler.mapping = ImageMapping{Tags: []TagRule{rule}}
+	handler.prune = PruneOptions{Enabled: true}
+	if err = handler.RSync(handler.filter); err != nil {
+		t.Fatalf("RSync() error = %v", err)
+	}
+	tags := target.tags("team/app")
+	sort.Strings(tags)
+	if want := []string{"1.4.2", "promoted-2026-10-18"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("tags in the target = %v, want %v", tags, want)
+	}
+	if target.uploads != 2 {
+		t.Errorf("expected the config and layer to be uploaded once, got %d uploads", target.uploads)
+	}
+
+	// A day later nothing should be promoted again or pruned
+	now = func() time.Time { return time.Date(2026, 10, 19, 9, 0, 0, 0, time.UTC) }
+	s, _ := source.info().GetRegistry()
+	d, _ := target.info().GetRegistry()
+	plan, err := Diff(s, d, handler.filter, handler.mapping, true)
+	if err != nil {
+		t.Fatalf("Diff() error = %v", err)
+	}
+	if len(plan.Missing) != 0 || len(plan.Outdated) != 0 || len(plan.Extra) != 0 {
+		t.Errorf("Diff() = %+v, want nothing to do", plan)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Version a semantic version parsed from a tag, see semver.org.  A leading v
+// and a missing minor or patch are allowed as tags often look like v2 or 2.3
+type Version struct {
+	Major, Minor, Patch int
+	Prerelease          []string
+}
+
+// ParseVersion parses a tag like 1.2.3, v1.2 or 1.2.3-rc.1+build5, the build is ignored
+func ParseVersion(tag string) (Version, error) {
+	var v Version
+	s := strings.TrimPrefix(tag, "v")
+	if n := strings.Index(s, "+"); n >= 0 {
+		s = s[:n]
+	}
+	if n := strings.Index(s, "-"); n >= 0 {
+		if n == len(s)-1 {
+			return v, fmt.Errorf("%s has an empty prerelease", tag)
+		}
+		v.Prerelease = strings.Split(s[n+1:], ".")
+		s = s[:n]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return v, fmt.Errorf("%s isn't a version", tag)
+	}
+	numbers := []*int{&v.Major, &v.Minor, &v.Patch}
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || (len(part) > 1 && part[0] == '0') {
+			return v, fmt.Errorf("%s isn't a version", tag)
+		}
+		*numbers[i] = n
+	}
+	return v, nil
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if len(v.Prerelease) > 0 {
+		s += "-" + strings.Join(v.Prerelease, ".")
+	}
+	return s
+}
+
+// Compare gives -1, 0 or 1 as v is lower, the same or higher than other
+func (v Version) Compare(other Version) int {
+	for _, d := range []int{v.Major - other.Major, v.Minor - other.Minor, v.Patch - other.Patch} {
+		if d != 0 {
+			return sign(d)
+		}
+	}
+	// A prerelease comes before the release
+	switch {
+	case len(v.Prerelease) == 0 && len(other.Prerelease) == 0:
+		return 0
+	case len(v.Prerelease) == 0:
+		return 1
+	case len(other.Prerelease) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.Prerelease) && i < len(other.Prerelease); i++ {
+		if c := comparePrerelease(v.Prerelease[i], other.Prerelease[i]); c != 0 {
+			return c
+		}
+	}
+	return sign(len(v.Prerelease) - len(other.Prerelease))
+}
+
+// comparePrerelease numbers are compared as numbers and come before words
+func comparePrerelease(a, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+	switch {
+	case aErr == nil && bErr == nil:
+		return sign(an - bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+func sign(n int) int {
+	switch {
+	case n < 0:
+		return -1
+	case n > 0:
+		return 1
+	}
+	return 0
+}
+
+// versionRange versions that satisfy all of a set of comparisons
+type versionRange []comparison
+
+type comparison struct {
+	op      string
+	version Version
+}
+
+func (c comparison) matches(v Version) bool {
+	d := v.Compare(c.version)
+	switch c.op {
+	case "=":
+		return d == 0
+	case "!=":
+		return d != 0
+	case ">":
+		return d > 0
+	case ">=":
+		return d >= 0
+	case "<":
+		return d < 0
+	}
+	return d <= 0
+}
+
+// SemverFilter matches tags that are versions within a constraint like ">=2.3, <3" or "^2.3 || ~1.9".
+//
+// Comparisons separated by commas or spaces must all hold and || separates alternatives.  As well as
+// =, !=, >, >=, < and <= there is ^2.3 for >=2.3.0 <3.0.0, ~2.3 for >=2.3.0 <2.4.0 and wildcards like
+// 2.x or 2.3.*.  Prereleases like 2.4.0-rc.1 only match a range that names a prerelease of the same
+// version, so they aren't promoted by accident.
+type SemverFilter struct {
+	ranges []versionRange
+}
+
+// NewSemverFilter an empty constraint matches every version
+func NewSemverFilter(constraint string) (*SemverFilter, error) {
+	f := &SemverFilter{}
+	for _, alternative := range strings.Split(constraint, "||") {
+		r, err := parseRange(alternative)
+		if err != nil {
+			return nil, fmt.Errorf("bad version constraint %q : %s", constraint, err)
+		}
+		f.ranges = append(f.ranges, r)
+	}
+	return f, nil
+}
+
+func parseRange(text string) (versionRange, error) {
+	fields := strings.Fields(strings.Replace(text, ",", " ", -1))
+	// Join operators written apart from their version, like ">= 2.3"
+	var terms []string
+	for i := 0; i < len(fields); i++ {
+		if strings.Trim(fields[i], "=!<>^~") == "" && i+1 < len(fields) {
+			terms = append(terms, fields[i]+fields[i+1])
+			i++
+			continue
+		}
+		terms = append(terms, fields[i])
+	}
+	r := versionRange{}
+	for _, term := range terms {
+		comparisons, err := parseTerm(term)
+		if err != nil {
+			return nil, err
+		}
+		r = append(r, comparisons...)
+	}
+	return r, nil
+}
+
+func parseTerm(term string) ([]comparison, error) {
+	op := term[:len(term)-len(strings.TrimLeft(term, "=!<>^~"))]
+	text := strings.TrimPrefix(term[len(op):], "v")
+	core, pre := text, ""
+	if n := strings.Index(text, "-"); n >= 0 {
+		core, pre = text[:n], text[n:]
+	}
+	parts := strings.Split(core, ".")
+	if len(parts) > 3 {
+		return nil, fmt.Errorf("%s isn't a version", term)
+	}
+	// How many parts were given before any wildcard, 2.x has 1 and * has 0
+	given := 0
+	for _, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		given++
+	}
+	if given == 0 {
+		if op != "" && op != "=" && op != ">=" {
+			return nil, fmt.Errorf("%s makes no sense", term)
+		}
+		return nil, nil
+	}
+	if pre != "" && given < len(parts) {
+		return nil, fmt.Errorf("%s has both a wildcard and a prerelease", term)
+	}
+	v, err := ParseVersion(strings.Join(parts[:given], ".") + pre)
+	if err != nil {
+		return nil, err
+	}
+	if pre != "" {
+		given = 3
+	}
+	// The lowest version above everything starting with the first parts, e.g. 2.4.0-0 for 2.3
+	above := func(parts int) Version {
+		switch parts {
+		case 1:
+			return Version{Major: v.Major + 1, Prerelease: []string{"0"}}
+		case 2:
+			return Version{Major: v.Major, Minor: v.Minor + 1, Prerelease: []string{"0"}}
+		}
+		return Version{Major: v.Major, Minor: v.Minor, Patch: v.Patch + 1, Prerelease: []string{"0"}}
+	}
+	switch op {
+	case "", "=":
+		if given == 3 {
+			return []comparison{{"=", v}}, nil
+		}
+		return []comparison{{">=", v}, {"<", above(given)}}, nil
+	case "!=":
+		if given < 3 {
+			return nil, fmt.Errorf("%s needs a full version", term)
+		}
+		return []comparison{{"!=", v}}, nil
+	case ">":
+		if given == 3 {
+			return []comparison{{">", v}}, nil
+		}
+		// above anything 2.3.x
+		return []comparison{{">=", above(given)}}, nil
+	case "<=":
+		if given == 3 {
+			return []comparison{{"<=", v}}, nil
+		}
+		return []comparison{{"<", above(given)}}, nil
+	case ">=", "<":
+		return []comparison{{op, v}}, nil
+	case "^":
+		// Anything that doesn't change the left-most non-zero part
+		upto := 1
+		if v.Major == 0 && given > 1 {
+			upto = 2
+			if v.Minor == 0 && given > 2 {
+				upto = 3
+			}
+		}
+		return []comparison{{">=", v}, {"<", above(upto)}}, nil
+	case "~":
+		upto := 2
+		if given == 1 {
+			upto = 1
+		}
+		return []comparison{{">=", v}, {"<", above(upto)}}, nil
+	}
+	return nil, fmt.Errorf("unknown operator %s in %s", op, term)
+}
+
+// Matches true if the tag is a version that satisfies the constraint
+func (f *SemverFilter) Matches(tag string) bool {
+	v, err := ParseVersion(tag)
+	if err != nil {
+		return false
+	}
+	return f.matches(v)
+}
+
+func (f *SemverFilter) matches(v Version) bool {
+	for _, r := range f.ranges {
+		if r.matches(v) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r versionRange) matches(v Version) bool {
+	allowPrerelease := len(v.Prerelease) == 0
+	for _, c := range r {
+		if !c.matches(v) {
+			return false
+		}
+		// the 0 prerelease is only used for the upper bounds worked out above
+		if !allowPrerelease && len(c.version.Prerelease) > 0 && c.version.Prerelease[0] != "0" &&
+			c.version.Major == v.Major && c.version.Minor == v.Minor && c.version.Patch == v.Patch {
+			allowPrerelease = true
+		}
+	}
+	return allowPrerelease
+}
+
+// TagListFilter a filter that has to see all the tags of a repository at once
+// to decide, e.g. to only keep the newest few
+type TagListFilter interface {
+	Filter
+	// FilterTags the tags of the repository that match, in the order given
+	FilterTags(repository string, tags []string) []string
+}
+
+// NewestFilter keeps the highest versions of each repository matching another filter.
+// Tags that aren't versions never match.
+//
+// Looking at a single tag, as for notifications, it can only tell whether the tag matches
+// the other filter, so the limit only applies when whole repositories are synced.
+type NewestFilter struct {
+	filter Filter
+	count  int
+}
+
+// NewNewestFilter keeps the count highest versions that match the filter
+func NewNewestFilter(count int, filter Filter) *NewestFilter {
+	return &NewestFilter{filter, count}
+}
+
+func (n *NewestFilter) Matches(tag string) bool {
+	if _, err := ParseVersion(tag); err != nil {
+		return false
+	}
+	return n.filter.Matches(tag)
+}
+
+func (n *NewestFilter) FilterTags(repository string, tags []string) []string {
+	type versionTag struct {
+		version Version
+		tag     string
+	}
+	var candidates []versionTag
+	for _, tag := range tags {
+		v, err := ParseVersion(tag)
+		if err != nil || !n.filter.Matches(tag) {
+			continue
+		}
+		candidates = append(candidates, versionTag{v, tag})
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].version.Compare(candidates[j].version) > 0
+	})
+	if len(candidates) > n.count {
+		candidates = candidates[:n.count]
+	}
+	keep := make(map[string]bool)
+	for _, c := range candidates {
+		keep[c.tag] = true
+	}
+	matching := make([]string, 0, len(candidates))
+	for _, tag := range tags {
+		if keep[tag] {
+			matching = append(matching, tag)
+		}
+	}
+	return matching
+}
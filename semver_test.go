@@ -0,0 +1,123 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseVersion(t *testing.T) {
+	tests := []struct {
+		tag     string
+		want    string
+		wantErr bool
+	}{
+		{"1.2.3", "1.2.3", false},
+		{"v1.2", "1.2.0", false},
+		{"2", "2.0.0", false},
+		{"1.2.3-rc.1+build5", "1.2.3-rc.1", false},
+		{"latest", "", true},
+		{"1.2.3.4", "", true},
+		{"01.2", "", true},
+		{"1.2-", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseVersion(tt.tag)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseVersion(%s) error = %v, wantErr %v", tt.tag, err, tt.wantErr)
+			continue
+		}
+		if err == nil && got.String() != tt.want {
+			t.Errorf("ParseVersion(%s) = %s, want %s", tt.tag, got, tt.want)
+		}
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	// in ascending order
+	versions := []string{"1.0.0-alpha", "1.0.0-alpha.1", "1.0.0-alpha.beta", "1.0.0-beta",
+		"1.0.0-beta.2", "1.0.0-beta.11", "1.0.0-rc.1", "1.0.0", "1.0.1", "1.2.0", "1.10.0", "2.0.0"}
+	for i, a := range versions {
+		for j, b := range versions {
+			va, _ := ParseVersion(a)
+			vb, _ := ParseVersion(b)
+			if got, want := va.Compare(vb), sign(i-j); got != want {
+				t.Errorf("%s compared to %s = %d, want %d", a, b, got, want)
+			}
+		}
+	}
+}
+
+func TestSemverFilter(t *testing.T) {
+	tests := []struct {
+		constraint string
+		matches    []string
+		notMatches []string
+	}{
+		{">=2.3, <3", []string{"2.3", "2.3.0", "v2.9.1"}, []string{"2.2.9", "3.0.0", "3.0.0-rc1", "latest"}},
+		{">= 2.3 < 3", []string{"2.4.1"}, []string{"3.1"}},
+		{"^2.3", []string{"2.3.0", "2.99.0"}, []string{"2.2.0", "3.0.0"}},
+		{"^0.2.3", []string{"0.2.3", "0.2.9"}, []string{"0.3.0"}},
+		{"~2.3", []string{"2.3.0", "2.3.7"}, []string{"2.4.0", "2.2.9"}},
+		{"2.x", []string{"2.0.0", "2.8.1"}, []string{"1.9.9", "3.0.0"}},
+		{"2.3.*", []string{"2.3.4"}, []string{"2.4.0"}},
+		{"*", []string{"0.0.1", "10.1"}, []string{"1.0.0-beta", "stable"}},
+		{"", []string{"1.0.0"}, []string{"1.0.0-beta"}},
+		{"1.x || >=3.1", []string{"1.2.0", "3.1.0", "4.0.0"}, []string{"2.0.0", "3.0.9"}},
+		{">1.2", []string{"1.3.0"}, []string{"1.2.9"}},
+		{"<=1.2", []string{"1.2.9"}, []string{"1.3.0"}},
+		{"!=1.2.3", []string{"1.2.4"}, []string{"1.2.3"}},
+		{">=2.4.0-rc.1, <2.5", []string{"2.4.0-rc.2", "2.4.0", "2.4.3"}, []string{"2.4.0-beta", "2.4.1-rc.1"}},
+	}
+	for _, tt := range tests {
+		f, err := NewSemverFilter(tt.constraint)
+		if err != nil {
+			t.Errorf("NewSemverFilter(%q) error = %v", tt.constraint, err)
+			continue
+		}
+		for _, tag := range tt.matches {
+			if !f.Matches(tag) {
+				t.Errorf("%q should match %s", tt.constraint, tag)
+			}
+		}
+		for _, tag := range tt.notMatches {
+			if f.Matches(tag) {
+				t.Errorf("%q shouldn't match %s", tt.constraint, tag)
+			}
+		}
+	}
+}
+
+func TestSemverFilterErrors(t *testing.T) {
+	for _, constraint := range []string{"<*", "!=1.2", "1.2.3.4", "2.x-rc1", "=>1.0", "abc"} {
+		if _, err := NewSemverFilter(constraint); err == nil {
+			t.Errorf("NewSemverFilter(%q) should fail", constraint)
+		}
+	}
+}
+
+func TestNewestFilter(t *testing.T) {
+	major2, _ := NewSemverFilter("2.x")
+	tests := []struct {
+		name   string
+		filter *NewestFilter
+		tags   []string
+		want   []string
+	}{
+		{"keeps original order", NewNewestFilter(2, matchEverything{}),
+			[]string{"1.0", "latest", "1.10", "1.9", "1.2"}, []string{"1.10", "1.9"}},
+		{"fewer than count", NewNewestFilter(5, matchEverything{}),
+			[]string{"1.0", "latest"}, []string{"1.0"}},
+		{"within range", NewNewestFilter(1, major2),
+			[]string{"1.0", "2.1", "2.3", "3.0"}, []string{"2.3"}},
+		{"none", NewNewestFilter(1, major2),
+			[]string{"stable"}, []string{}},
+	}
+	for _, tt := range tests {
+		if got := tt.filter.FilterTags("repo", tt.tags); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: FilterTags() = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if f := NewNewestFilter(1, major2); !f.Matches("2.0") || f.Matches("latest") || f.Matches("1.0") {
+		t.Error("NewestFilter should match a single tag in the range")
+	}
+}
@@ -1,28 +1,237 @@
 package main
 
 import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
+
+	log "github.com/Sirupsen/logrus"
 )
 
-// ServerRequest  A server will listen on the given port
+// ServerRequest  A sync job, keeping one or more targets in line with a source by
+// polling and by listening for notifications on the given path
 type ServerRequest struct {
-	source, target                    RegistryInfo
-	namespaceFilter, repositoryFilter string
-	port                              int
-	frequency                         time.Duration
-	resourcePath                      string
+	name    string
+	source  RegistryInfo
+	targets []RegistryInfo
+	// targetLimits the most copies at once to each target by address, the default when missing
+	targetLimits  map[string]int
+	filterOptions FilterOptions
+	engine        string
+	prune         PruneOptions
+	events        EventPolicy
+	webhook       WebhookAuth
+	notify        []OutboundWebhook
+	mapping       ImageMapping
+	frequency     time.Duration
+	resourcePath  string
 }
 
 type server struct {
-	source, target *Registry
-	filter         *DockerImageFilter
-	port           int
+	name      string
+	source    RegistryInfo
+	targets   []RegistryInfo
+	handler   FanOutHandler
+	queue     *EventQueue
+	events    *EventDispatcher
+	guard     *webhookGuard
+	filter    DockerImageFilter
+	frequency time.Duration
+	path      string
+	syncs     *syncStatus
+}
+
+// syncStatus how the syncs of a job have been going
+type syncStatus struct {
+	mu sync.Mutex
+	// since when the job has been running
+	since    time.Time
+	running  bool
+	started  time.Time
+	finished time.Time
+	err      error
+	// stop closed to cancel the sync running
+	stop chan struct{}
+}
+
+// SyncRun how the last sync of a job went, or how the one running is going
+type SyncRun struct {
+	Running   bool      `json:"running"`
+	Started   time.Time `json:"started"`
+	Finished  time.Time `json:"finished"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// start records a sync starting, giving back what is closed to cancel it.  Only one sync
+// of a job runs at a time so it doesn't start when one is already running.
+func (s *syncStatus) start() (stop <-chan struct{}, started bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running {
+		return nil, false
+	}
+	s.running, s.started, s.stop = true, now(), make(chan struct{})
+	return s.stop, true
+}
+
+// finish records a sync finishing, with what went wrong if anything
+func (s *syncStatus) finish(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running, s.finished, s.err = false, now(), err
+}
+
+// cancel tells the sync running to stop, false when there isn't one
+func (s *syncStatus) cancel() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.running {
+		return false
+	}
+	select {
+	case <-s.stop:
+	default:
+		close(s.stop)
+	}
+	return true
+}
+
+// last how the last sync went
+func (s *syncStatus) last() SyncRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run := SyncRun{Running: s.running, Started: s.started, Finished: s.finished}
+	if s.err != nil {
+		run.LastError = s.err.Error()
+	}
+	return run
+}
+
+func (request ServerRequest) filter() (DockerImageFilter, error) {
+	return newImageFilter(request.filterOptions)
 }
 
-func (request ServerRequest) newServer() server {
-	return server{}
+// targetAddresses the addresses of all the targets, for logging
+func (request ServerRequest) targetAddresses() []string {
+	addresses := make([]string, 0, len(request.targets))
+	for _, target := range request.targets {
+		addresses = append(addresses, target.Address())
+	}
+	return addresses
 }
 
-func (s server) start() {
+// newServer connects to the registries of the job, sharing workers with the other jobs.
+// Notifications are queued with the options before they are copied.
+func (request ServerRequest) newServer(workers *Workers, queueOptions QueueOptions) (s server, err error) {
+	filter, err := request.filter()
+	if err != nil {
+		err = fmt.Errorf("job %s has a bad filter : %s", request.name, err)
+		return
+	}
+	guard, err := newWebhookGuard(request.name, request.webhook)
+	if err != nil {
+		err = fmt.Errorf("job %s can't check notifications : %s", request.name, err)
+		return
+	}
+	notifier, err := NewNotifier(request.name, request.notify)
+	if err != nil {
+		err = fmt.Errorf("job %s can't send notifications : %s", request.name, err)
+		return
+	}
+	var handler FanOutHandler
+	switch request.engine {
+	case "", "docker":
+		if len(request.source.platforms) > 0 {
+			err = fmt.Errorf("choosing platforms needs the registry engine, docker only pulls the platform it runs on")
+			break
+		}
+		if request.events.CopyUntagged {
+			err = fmt.Errorf("copying untagged manifests needs the registry engine, docker can't push by digest")
+			break
+		}
+		handler, err = NewDockerCLIFanOut(request.source, request.targets, filter)
+	case "registry":
+		handler, err = NewRegistryCopyFanOut(request.source, request.targets, filter)
+	default:
+		err = fmt.Errorf("unknown copy engine %s, expected docker or registry", request.engine)
+	}
+	if err != nil {
+		err = fmt.Errorf("Couldn't set up job %s between registries %s %s : %s", request.name,
+			request.source.Address(), request.targetAddresses(), err)
+		return
+	}
+	handler.setOptions(request.prune, request.mapping, workers)
+	handler.job = request.name
+	handler.notifier = notifier
+	for target, limit := range request.targetLimits {
+		if limit > 0 {
+			workers.SetTargetLimit(target, limit)
+		}
+	}
+	queue, err := NewEventQueue(request.name, handler, queueOptions)
+	if err != nil {
+		err = fmt.Errorf("Couldn't set up the queue of job %s : %s", request.name, err)
+		return
+	}
+	return server{
+		name:      request.name,
+		source:    request.source,
+		targets:   request.targets,
+		handler:   handler,
+		queue:     queue,
+		events:    NewEventDispatcher(request.name, queue, request.events),
+		guard:     guard,
+		filter:    filter,
+		frequency: request.frequency,
+		path:      request.resourcePath,
+		syncs:     &syncStatus{since: now()},
+	}, nil
+}
+
+// start polls in the background if asked to and listens for notifications on the mux
+func (s server) start(mux *http.ServeMux) {
+	if s.frequency > 0 {
+		log.Infof("Setting up cron job %s for every %s ", s.name, s.frequency.String())
+		go func() {
+			c := time.Tick(s.frequency)
+			for range c {
+				// Note this purposfully runs the function
+				// in the same goroutine so we make sure there is
+				// only ever one. If it might take a long time and
+				// it's safe to have several running just add "go" here.
+				stop, started := s.syncs.start()
+				if !started {
+					log.Infof("Not syncing job %s, the sync asked for through the api is still running", s.name)
+					continue
+				}
+				s.runSync(stop)
+			}
+		}()
+	}
+	s.queue.Start()
+	log.Infof("Listening for notifications for job %s on %s", s.name, s.path)
+	if s.guard.auth.empty() {
+		log.Warnf("Notifications for job %s are accepted from anyone", s.name)
+	}
+	mux.Handle(s.path, s.guard.wrap(registryEventHandler(s.events)))
+	for _, decoder := range PayloadDecoders {
+		mux.Handle(decoderPath(s.path, decoder), s.guard.wrap(payloadHandler(s.events, decoder)))
+	}
+}
+
+// runSync brings the targets in line with the source until stop is closed, the sync having been started
+func (s server) runSync(stop <-chan struct{}) error {
+	err := s.handler.RSyncUntil(s.filter, stop)
+	s.syncs.finish(err)
+	if err != nil {
+		log.Errorf("Failure syncing job %s to %v : %s", s.name, s.handler.Targets(), err)
+	}
+	return err
+}
 
+// decoderPath where a job takes notifications only in the format of the decoder, like /job/harbor
+func decoderPath(path string, decoder PayloadDecoder) string {
+	return strings.TrimSuffix(path, "/") + "/" + decoder.Name()
 }
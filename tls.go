@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// TLSOptions the files the notification listener serves https with.  Without a certificate it
+// serves plain http.
+type TLSOptions struct {
+	Cert string
+	Key  string
+	// ClientCA when given only clients with a certificate signed by one of the CAs in it are let in
+	ClientCA string
+}
+
+func (o TLSOptions) enabled() bool {
+	return o.Cert != "" || o.Key != "" || o.ClientCA != ""
+}
+
+// serverConfig the tls config for the listener, which keeps up with the files as they change
+func (o TLSOptions) serverConfig() (*tls.Config, error) {
+	if o.Cert == "" || o.Key == "" {
+		return nil, fmt.Errorf("serving https needs both a certificate and a key")
+	}
+	r := &certReloader{options: o}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		GetCertificate:     r.getCertificate,
+		GetConfigForClient: r.getConfigForClient,
+	}, nil
+}
+
+// certReloader reads the certificate, key and client CAs again whenever one of the files
+// changes, so renewed certificates are picked up without a restart.  Until the new files
+// load cleanly the old ones are kept.
+type certReloader struct {
+	options TLSOptions
+
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+	config   *tls.Config
+}
+
+// load reads the files into a new config
+func (r *certReloader) load() error {
+	modTimes, err := r.stat()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.options.Cert, r.options.Key)
+	if err != nil {
+		return fmt.Errorf("can't load certificate %s and key %s : %s", r.options.Cert, r.options.Key, err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if r.options.ClientCA != "" {
+		pem, err := ioutil.ReadFile(r.options.ClientCA)
+		if err != nil {
+			return err
+		}
+		config.ClientCAs = x509.NewCertPool()
+		if !config.ClientCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in client CA %s", r.options.ClientCA)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	r.mu.Lock()
+	r.modTimes, r.config = modTimes, config
+	r.mu.Unlock()
+	return nil
+}
+
+// stat the modification time of each file
+func (r *certReloader) stat() (map[string]time.Time, error) {
+	modTimes := make(map[string]time.Time)
+	for _, path := range []string{r.options.Cert, r.options.Key, r.options.ClientCA} {
+		if path == "" {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[path] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// current the config, loading the files again first if any of them changed
+func (r *certReloader) current() *tls.Config {
+	modTimes, err := r.stat()
+	r.mu.Lock()
+	changed := err == nil && !sameModTimes(modTimes, r.modTimes)
+	r.mu.Unlock()
+	if changed {
+		if err = r.load(); err != nil {
+			log.Errorf("Couldn't reload the tls certificate, still using the old one : %s", err)
+			// only try again once the files change again, say when the last of them is written
+			r.mu.Lock()
+			r.modTimes = modTimes
+			r.mu.Unlock()
+		} else {
+			log.Infof("Reloaded tls certificate %s", r.options.Cert)
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.config
+}
+
+func sameModTimes(a, b map[string]time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for path, t := range a {
+		if !t.Equal(b[path]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return &r.current().Certificates[0], nil
+}
+
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return r.current(), nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCert a certificate and key, written to files when needed
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// newTestCert a certificate for localhost signed by the CA, or self signed as a CA when there is none
+func newTestCert(t *testing.T, name string, ca *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	parent, parentKey := template, key
+	if ca == nil {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		parent, parentKey = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert, key, der}
+}
+
+// write saves the certificate and key as pem files, with the modification time given
+func (c *testCert) write(t *testing.T, certPath, keyPath string, modTime time.Time) {
+	keyDER, _ := x509.MarshalECPrivateKey(c.key)
+	for path, block := range map[string]*pem.Block{
+		certPath: {Type: "CERTIFICATE", Bytes: c.der},
+		keyPath:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if path == "" {
+			continue
+		}
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// serveTLS serves ok over https with the options, giving back the address
+func serveTLS(t *testing.T, options TLSOptions) (string, func()) {
+	config, err := options.serverConfig()
+	if err != nil {
+		t.Fatalf("serverConfig() error = %v", err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		TLSConfig: config,
+		Handler:   http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		// the handshakes meant to fail aren't worth logging
+		ErrorLog: log.New(ioutil.Discard, "", 0),
+	}
+	go server.ServeTLS(ln, "", "")
+	return "https://" + ln.Addr().String(), func() { server.Close() }
+}
+
+// getTLS fetches the url over a new connection, giving back the name on the server certificate
+func getTLS(url string, ca *testCert, client *testCert) (string, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: roots}
+	if client != nil {
+		config.Certificates = []tls.Certificate{client.tlsCertificate()}
+	}
+	transport := &http.Transport{TLSClientConfig: config, DisableKeepAlives: true}
+	resp, err := (&http.Client{Transport: transport}).Get(url)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.TLS.PeerCertificates[0].Subject.CommonName, nil
+}
+
+func TestTLSReloadsCertificate(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	ca := newTestCert(t, "ca", nil)
+	start := time.Now().Add(-time.Minute)
+	newTestCert(t, "first", ca).write(t, certPath, keyPath, start)
+
+	url, stop := serveTLS(t, TLSOptions{Cert: certPath, Key: keyPath})
+	defer stop()
+	if name, err := getTLS(url, ca, nil); err != nil || name != "first" {
+		t.Fatalf("got certificate %s error %v, want first", name, err)
+	}
+	newTestCert(t, "renewed", ca).write(t, certPath, keyPath, start.Add(time.Second))
+	if name, err := getTLS(url, ca, nil); err != nil || name != "renewed" {
+		t.Errorf("got certificate %s error %v after renewing, want renewed", name, err)
+	}
+	// a half written certificate keeps the old one in use
+	ioutil.WriteFile(keyPath, []byte("not a key"), 0600)
+	os.Chtimes(keyPath, start.Add(2*time.Second), start.Add(2*time.Second))
+	if name, err := getTLS(url, ca, nil); err != nil || name != "renewed" {
+		t.Errorf("got certificate %s error %v with a broken key, want renewed", name, err)
+	}
+}
+
+func TestTLSClientCA(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	certPath, keyPath, caPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), filepath.Join(dir, "ca.pem")
+	ca := newTestCert(t, "ca", nil)
+	ca.write(t, caPath, "", time.Now())
+	newTestCert(t, "server", ca).write(t, certPath, keyPath, time.Now())
+
+	url, stop := serveTLS(t, TLSOptions{Cert: certPath, Key: keyPath, ClientCA: caPath})
+	defer stop()
+	if _, err := getTLS(url, ca, newTestCert(t, "registry", ca)); err != nil {
+		t.Errorf("client with a certificate from the CA got error %v", err)
+	}
+	if _, err := getTLS(url, ca, nil); err == nil {
+		t.Error("client without a certificate was let in")
+	}
+	other := newTestCert(t, "other", nil)
+	if _, err := getTLS(url, ca, newTestCert(t, "registry", other)); err == nil {
+		t.Error("client with a certificate from another CA was let in")
+	}
+}
+
+func TestTLSOptionsErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "tls")
+	defer os.RemoveAll(dir)
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	newTestCert(t, "server", nil).write(t, certPath, keyPath, time.Now())
+	for _, options := range []TLSOptions{
+		{Cert: certPath},
+		{ClientCA: certPath},
+		{Cert: certPath, Key: filepath.Join(dir, "missing.pem")},
+		{Cert: certPath, Key: keyPath, ClientCA: keyPath},
+	} {
+		if _, err := options.serverConfig(); err == nil {
+			t.Errorf("serverConfig(%+v) should fail", options)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// WebhookAuth how whoever sends a job notifications proves they may.  A bearer token or
+// basic auth, either being enough when both are set, plus the signature and the address
+// when those are set.  With none of them anyone who can reach the port can have images copied.
+type WebhookAuth struct {
+	// Token expected as "Authorization: Bearer <token>", which the registry can send
+	// with the headers of its notification endpoint
+	Token string
+	// User and Password expected as basic auth
+	User     string
+	Password string
+	// Secret the key of an HMAC-SHA256 of the body, sent in hex in the SignatureHeader,
+	// optionally as sha256=<hex>
+	Secret          string `mapstructure:"hmac-secret"`
+	SignatureHeader string `mapstructure:"hmac-header"`
+	// Allow the addresses, like 10.1.2.3, or networks, like 10.0.0.0/8, requests may come from
+	Allow []string
+}
+
+// defaultSignatureHeader where the signature of the body is unless told otherwise
+const defaultSignatureHeader = "X-Signature"
+
+// empty true when nothing is checked
+func (a WebhookAuth) empty() bool {
+	return a.Token == "" && a.User == "" && a.Password == "" && a.Secret == "" && len(a.Allow) == 0
+}
+
+// webhookGuard turns away notifications that don't pass the auth of a job, counting them by reason
+type webhookGuard struct {
+	name     string
+	auth     WebhookAuth
+	networks []*net.IPNet
+	// subject what is turned away, for the logs
+	subject string
+
+	mu       sync.Mutex
+	rejected map[string]int
+}
+
+// newWebhookGuard checks the auth makes sense for the job called name
+func newWebhookGuard(name string, auth WebhookAuth) (*webhookGuard, error) {
+	if (auth.User == "") != (auth.Password == "") {
+		return nil, fmt.Errorf("basic auth for notifications needs both a user and a password")
+	}
+	if auth.SignatureHeader == "" {
+		auth.SignatureHeader = defaultSignatureHeader
+	}
+	g := &webhookGuard{name: name, auth: auth, subject: "notification for job " + name, rejected: make(map[string]int)}
+	for _, allowed := range auth.Allow {
+		network, err := parseNetwork(allowed)
+		if err != nil {
+			return nil, err
+		}
+		g.networks = append(g.networks, network)
+	}
+	return g, nil
+}
+
+// parseNetwork reads a network like 10.0.0.0/8, or a single address
+func parseNetwork(text string) (*net.IPNet, error) {
+	if strings.Contains(text, "/") {
+		_, network, err := net.ParseCIDR(text)
+		if err != nil {
+			return nil, fmt.Errorf("bad network %s to allow notifications from : %s", text, err)
+		}
+		return network, nil
+	}
+	ip := net.ParseIP(text)
+	if ip == nil {
+		return nil, fmt.Errorf("bad address %s to allow notifications from", text)
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		ip, bits = ip.To4(), 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// wrap only passes on the requests that pass every check
+func (g *webhookGuard) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reason := g.check(w, r)
+		if reason == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		n := g.reject(reason)
+		log.Warnf("Rejected %s from %s : %s, %d rejected so far", g.subject, r.RemoteAddr, reason, n)
+		switch reason {
+		case "address not allowed":
+			http.Error(w, reason, http.StatusForbidden)
+		case "body too large":
+			http.Error(w, reason, http.StatusRequestEntityTooLarge)
+		default:
+			http.Error(w, reason, http.StatusUnauthorized)
+		}
+	})
+}
+
+// check gives back why the request isn't allowed, or nothing when it is
+func (g *webhookGuard) check(w http.ResponseWriter, r *http.Request) string {
+	if len(g.networks) > 0 && !g.allowedAddress(r.RemoteAddr) {
+		return "address not allowed"
+	}
+	if g.auth.Token != "" || g.auth.User != "" {
+		if !g.validToken(r) && !g.validUser(r) {
+			return "bad credentials"
+		}
+	}
+	if g.auth.Secret != "" {
+		// the body is read to check it, so put it back for the handler
+		body, err := readNotification(w, r)
+		if tooLarge(err) {
+			return "body too large"
+		}
+		if err != nil {
+			return "unreadable body"
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if !g.validSignature(r.Header.Get(g.auth.SignatureHeader), body) {
+			return "bad signature"
+		}
+	}
+	return ""
+}
+
+func (g *webhookGuard) allowedAddress(remoteAddr string) bool {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range g.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *webhookGuard) validToken(r *http.Request) bool {
+	header := r.Header.Get("Authorization")
+	return g.auth.Token != "" && strings.HasPrefix(header, "Bearer ") &&
+		equalSecrets(strings.TrimPrefix(header, "Bearer "), g.auth.Token)
+}
+
+func (g *webhookGuard) validUser(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	// both compared every time so a wrong user takes as long as a wrong password
+	userOK := equalSecrets(user, g.auth.User)
+	passwordOK := equalSecrets(password, g.auth.Password)
+	return g.auth.User != "" && ok && userOK && passwordOK
+}
+
+func (g *webhookGuard) validSignature(header string, body []byte) bool {
+	signature, err := hex.DecodeString(strings.TrimPrefix(header, "sha256="))
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(g.auth.Secret))
+	mac.Write(body)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
+
+// equalSecrets compares in constant time so the time taken gives nothing away
+func equalSecrets(given, expected string) bool {
+	return subtle.ConstantTimeCompare([]byte(given), []byte(expected)) == 1
+}
+
+// reject counts a rejection, giving back how many there have been
+func (g *webhookGuard) reject(reason string) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.rejected[reason]++
+	total := 0
+	for _, n := range g.rejected {
+		total += n
+	}
+	return total
+}
+
+// Rejected how many notifications have been turned away for each reason
+func (g *webhookGuard) Rejected() map[string]int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	counts := make(map[string]int, len(g.rejected))
+	for reason, n := range g.rejected {
+		counts[reason] = n
+	}
+	return counts
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func hmacSignature(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookGuard(t *testing.T) {
+	const body = `{"events": []}`
+	tests := []struct {
+		name       string
+		auth       WebhookAuth
+		remoteAddr string
+		headers    map[string]string
+		user       string
+		password   string
+		wantStatus int
+	}{
+		{"no auth", WebhookAuth{}, "", nil, "", "", http.StatusOK},
+		{"token", WebhookAuth{Token: "s3cret"}, "", map[string]string{"Authorization": "Bearer s3cret"}, "", "", http.StatusOK},
+		{"wrong token", WebhookAuth{Token: "s3cret"}, "", map[string]string{"Authorization": "Bearer guess"}, "", "", http.StatusUnauthorized},
+		{"missing token", WebhookAuth{Token: "s3cret"}, "", nil, "", "", http.StatusUnauthorized},
+		{"basic auth", WebhookAuth{User: "registry", Password: "pw"}, "", nil, "registry", "pw", http.StatusOK},
+		{"wrong password", WebhookAuth{User: "registry", Password: "pw"}, "", nil, "registry", "guess", http.StatusUnauthorized},
+		{"basic auth instead of token", WebhookAuth{Token: "s3cret", User: "registry", Password: "pw"}, "", nil, "registry", "pw", http.StatusOK},
+		{"signed", WebhookAuth{Secret: "key"}, "", map[string]string{"X-Signature": hmacSignature("key", body)}, "", "", http.StatusOK},
+		{"signed in another header", WebhookAuth{Secret: "key", SignatureHeader: "X-Hub-Signature-256"}, "",
+			map[string]string{"X-Hub-Signature-256": strings.TrimPrefix(hmacSignature("key", body), "sha256=")}, "", "", http.StatusOK},
+		{"signed with another key", WebhookAuth{Secret: "key"}, "", map[string]string{"X-Signature": hmacSignature("other", body)}, "", "", http.StatusUnauthorized},
+		{"unsigned", WebhookAuth{Secret: "key"}, "", nil, "", "", http.StatusUnauthorized},
+		{"allowed network", WebhookAuth{Allow: []string{"10.0.0.0/8"}}, "10.1.2.3:5000", nil, "", "", http.StatusOK},
+		{"allowed address", WebhookAuth{Allow: []string{"192.168.0.1", "10.1.2.3"}}, "10.1.2.3:5000", nil, "", "", http.StatusOK},
+		{"other address", WebhookAuth{Allow: []string{"10.0.0.0/8"}}, "192.168.0.1:5000", nil, "", "", http.StatusForbidden},
+		{"allowed address with wrong token", WebhookAuth{Token: "s3cret", Allow: []string{"10.0.0.0/8"}}, "10.1.2.3:5000",
+			map[string]string{"Authorization": "Bearer guess"}, "", "", http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		guard, err := newWebhookGuard("job", tt.auth)
+		if err != nil {
+			t.Fatalf("%s: newWebhookGuard() error = %v", tt.name, err)
+		}
+		handler := &RecorderHandler{}
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		if tt.remoteAddr != "" {
+			req.RemoteAddr = tt.remoteAddr
+		}
+		for key, value := range tt.headers {
+			req.Header.Set(key, value)
+		}
+		if tt.user != "" {
+			req.SetBasicAuth(tt.user, tt.password)
+		}
+		w := httptest.NewRecorder()
+		guard.wrap(registryEventHandler(handler)).ServeHTTP(w, req)
+		if w.Code != tt.wantStatus {
+			t.Errorf("%s: got status %d, want %d : %s", tt.name, w.Code, tt.wantStatus, w.Body.String())
+		}
+		rejected := len(guard.Rejected()) > 0
+		if rejected != (tt.wantStatus != http.StatusOK) {
+			t.Errorf("%s: rejections counted %v", tt.name, guard.Rejected())
+		}
+	}
+}
+
+func TestNotificationTooLarge(t *testing.T) {
+	body := `{"events": [` + strings.Repeat(" ", maxNotificationBytes) + `]}`
+	guard, err := newWebhookGuard("job", WebhookAuth{Secret: "key"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, handler := range map[string]http.Handler{
+		"unsigned": registryEventHandler(&RecorderHandler{}),
+		"signed":   guard.wrap(registryEventHandler(&RecorderHandler{})),
+	} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+		req.Header.Set("X-Signature", hmacSignature("key", body))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("%s: got status %d, want %d", name, w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
+
+func TestWebhookGuardCountsRejections(t *testing.T) {
+	guard, _ := newWebhookGuard("job", WebhookAuth{Token: "s3cret", Allow: []string{"10.0.0.0/8"}})
+	handler := guard.wrap(registryEventHandler(&RecorderHandler{}))
+	for _, addr := range []string{"192.168.0.1:1", "192.168.0.2:1", "10.0.0.1:1"} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"events": []}`))
+		req.RemoteAddr = addr
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	want := map[string]int{"address not allowed": 2, "bad credentials": 1}
+	if got := guard.Rejected(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Rejected() = %v, want %v", got, want)
+	}
+}
+
+func TestNewWebhookGuardErrors(t *testing.T) {
+	for _, auth := range []WebhookAuth{
+		{User: "registry"},
+		{Password: "pw"},
+		{Allow: []string{"10.0.0.0/33"}},
+		{Allow: []string{"registry.local"}},
+	} {
+		if _, err := newWebhookGuard("job", auth); err == nil {
+			t.Errorf("newWebhookGuard(%+v) should fail", auth)
+		}
+	}
+}
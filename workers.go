@@ -0,0 +1,292 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Workers limits how many copies run at once, overall and for each target
+// registry, and makes sure the same image is never copied to the same target
+// twice at the same time, e.g. by the poller and a webhook.  One Workers
+// should be shared by everything copying images in the process.
+type Workers struct {
+	global    chan struct{}
+	perTarget int
+
+	mu      sync.Mutex
+	limits  map[string]int
+	targets map[string]chan struct{}
+	images  map[string]*imageLock
+	// how the copies are getting on, to tell when they are stuck
+	progress WorkerProgress
+	// copies those waiting and running by when they were asked for
+	copies   map[uint64]*WorkerCopy
+	nextCopy uint64
+}
+
+// WorkerProgress the copies waiting and running and when one last started or finished
+type WorkerProgress struct {
+	Busy       int       `json:"busy"`
+	Waiting    int       `json:"waiting"`
+	Progressed time.Time `json:"progressed"`
+}
+
+// WorkerCopy a copy of an image waiting for a worker or running
+type WorkerCopy struct {
+	Image   RegistryTarget `json:"image"`
+	Targets []string       `json:"targets"`
+	Queued  time.Time      `json:"queued"`
+	// Started zero while it is waiting
+	Started time.Time `json:"started"`
+}
+
+type imageLock struct {
+	sync.Mutex
+	users int
+}
+
+// NewWorkers global is the most copies at once and perTarget the most to any one
+// registry unless overridden with SetTargetLimit.  0 means no limit.
+func NewWorkers(global, perTarget int) *Workers {
+	w := &Workers{
+		perTarget: perTarget,
+		limits:    make(map[string]int),
+		targets:   make(map[string]chan struct{}),
+		images:    make(map[string]*imageLock),
+		copies:    make(map[uint64]*WorkerCopy),
+	}
+	if global > 0 {
+		w.global = make(chan struct{}, global)
+	}
+	return w
+}
+
+// SetTargetLimit overrides the number of copies at once for a single target registry
+func (w *Workers) SetTargetLimit(target string, limit int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.limits[target] = limit
+	delete(w.targets, target)
+}
+
+// Concurrency how many copies to the target may run at once, 0 for no limit
+func (w *Workers) Concurrency(target string) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	limit, ok := w.limits[target]
+	if !ok {
+		limit = w.perTarget
+	}
+	if w.global != nil && (limit == 0 || limit > cap(w.global)) {
+		limit = cap(w.global)
+	}
+	return limit
+}
+
+// Do runs fn once there is a free slot and nothing else is working on the references in the target.
+// refs are the names the image has in the target, see targetRef, as two source images may have the same.
+func (w *Workers) Do(target string, image RegistryTarget, refs []string, fn func() error) error {
+	return w.DoAll([]string{target}, image, refs, fn)
+}
+
+// DoAll like Do but for copying an image to several targets at once, it waits for the references
+// in every target and a slot for each of them.  Everything is taken in the same order so two
+// copies to overlapping targets can't deadlock.
+func (w *Workers) DoAll(targets []string, image RegistryTarget, refs []string, fn func() error) error {
+	targets = append([]string(nil), targets...)
+	sort.Strings(targets)
+	refs = append([]string(nil), refs...)
+	sort.Strings(refs)
+	var id uint64
+	w.track(func(p *WorkerProgress) {
+		if p.Busy == 0 && p.Waiting == 0 {
+			// idle until now, so not stuck
+			p.Progressed = now()
+		}
+		p.Waiting++
+		id = w.nextCopy
+		w.nextCopy++
+		w.copies[id] = &WorkerCopy{Image: image, Targets: targets, Queued: now()}
+	})
+	started := false
+	defer func() {
+		w.track(func(p *WorkerProgress) {
+			if started {
+				p.Busy--
+				p.Progressed = now()
+			} else {
+				p.Waiting--
+			}
+			delete(w.copies, id)
+		})
+	}()
+	for n, ref := range refs {
+		if n > 0 && ref == refs[n-1] {
+			continue
+		}
+		unlock := w.lockImage(ref)
+		defer unlock()
+	}
+	for n, target := range targets {
+		if n > 0 && target == targets[n-1] {
+			continue
+		}
+		slots := w.targetSlots(target)
+		if slots != nil {
+			slots <- struct{}{}
+			defer func() { <-slots }()
+		}
+	}
+	if w.global != nil {
+		w.global <- struct{}{}
+		defer func() { <-w.global }()
+	}
+	started = true
+	w.track(func(p *WorkerProgress) {
+		p.Waiting--
+		p.Busy++
+		p.Progressed = now()
+		w.copies[id].Started = p.Progressed
+	})
+	return fn()
+}
+
+// track changes the progress with the lock held
+func (w *Workers) track(change func(p *WorkerProgress)) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	change(&w.progress)
+}
+
+// Progress how the copies are getting on
+func (w *Workers) Progress() WorkerProgress {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.progress
+}
+
+// Copies the copies waiting and running, in the order they were asked for
+func (w *Workers) Copies() []WorkerCopy {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	ids := make([]uint64, 0, len(w.copies))
+	for id := range w.copies {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	copies := make([]WorkerCopy, 0, len(ids))
+	for _, id := range ids {
+		copies = append(copies, *w.copies[id])
+	}
+	return copies
+}
+
+func (w *Workers) targetSlots(target string) chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	slots, ok := w.targets[target]
+	if !ok {
+		limit, set := w.limits[target]
+		if !set {
+			limit = w.perTarget
+		}
+		if limit > 0 {
+			slots = make(chan struct{}, limit)
+		}
+		w.targets[target] = slots
+	}
+	return slots
+}
+
+// targetRef the key locking the image in the target
+func targetRef(target string, image RegistryTarget) string {
+	return target + "/" + image.Repository + ":" + image.Tag
+}
+
+func (w *Workers) lockImage(key string) func() {
+	w.mu.Lock()
+	l, ok := w.images[key]
+	if !ok {
+		l = &imageLock{}
+		w.images[key] = l
+	}
+	l.users++
+	w.mu.Unlock()
+
+	if ok {
+		log.Debugf("Waiting for another copy of %s to finish", key)
+	}
+	l.Lock()
+	return func() {
+		l.Unlock()
+		w.mu.Lock()
+		l.users--
+		if l.users == 0 {
+			delete(w.images, key)
+		}
+		w.mu.Unlock()
+	}
+}
+
+// batchHandler handlers that can work on many events at once
+type batchHandler interface {
+	HandleAll(events []RegistryEvent) error
+}
+
+// handleAll gives the events to the handler all together if it can take them,
+// otherwise one after the other
+func handleAll(handler RegistryEventHandler, events []RegistryEvent) error {
+	if batch, ok := handler.(batchHandler); ok {
+		return batch.HandleAll(events)
+	}
+	failed := 0
+	for _, evt := range events {
+		if err := handler.Handle(evt); err != nil {
+			log.Warnf("Couldn't handle %+v : %s", evt, err)
+			failed++
+		}
+	}
+	return failures(failed, len(events))
+}
+
+// runAll handles the events on up to concurrency goroutines, waiting for them all to finish
+func runAll(handler RegistryEventHandler, events []RegistryEvent, concurrency int) error {
+	if concurrency <= 0 || concurrency > len(events) {
+		concurrency = len(events)
+	}
+	queue := make(chan RegistryEvent)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failed := 0
+	for n := 0; n < concurrency; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for evt := range queue {
+				if err := handler.Handle(evt); err != nil {
+					log.Warnf("Couldn't handle %+v : %s", evt, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, evt := range events {
+		queue <- evt
+	}
+	close(queue)
+	wg.Wait()
+	return failures(failed, len(events))
+}
+
+func failures(failed, total int) error {
+	if failed == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d of %d images failed", failed, total)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/distribution/digest"
+)
+
+// concurrencyCounter records how many functions ran at the same time
+type concurrencyCounter struct {
+	mu           sync.Mutex
+	running, max int
+	calls        int
+}
+
+func (c *concurrencyCounter) run() error {
+	c.mu.Lock()
+	c.running++
+	c.calls++
+	if c.running > c.max {
+		c.max = c.running
+	}
+	c.mu.Unlock()
+	time.Sleep(10 * time.Millisecond)
+	c.mu.Lock()
+	c.running--
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *concurrencyCounter) Handle(evt RegistryEvent) error {
+	return c.run()
+}
+
+func TestWorkersLimits(t *testing.T) {
+	tests := []struct {
+		name              string
+		global, perTarget int
+		targets           []string
+		sameImage         bool
+		wantMax           int
+	}{
+		{"global limit", 2, 0, []string{"reg1"}, false, 2},
+		{"per target limit", 0, 1, []string{"reg1", "reg2"}, false, 2},
+		{"global limit across targets", 3, 2, []string{"reg1", "reg2", "reg3"}, false, 3},
+		{"same image never at once", 0, 0, []string{"reg1"}, true, 1},
+		{"same image in different targets", 0, 0, []string{"reg1", "reg2"}, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			workers := NewWorkers(tt.global, tt.perTarget)
+			counter := &concurrencyCounter{}
+			var wg sync.WaitGroup
+			for n := 0; n < 6; n++ {
+				for _, target := range tt.targets {
+					image := RegistryTarget{"team/app", fmt.Sprint(n)}
+					if tt.sameImage {
+						image.Tag = "latest"
+					}
+					wg.Add(1)
+					go func(target string, image RegistryTarget) {
+						defer wg.Done()
+						workers.Do(target, image, []string{targetRef(target, image)}, counter.run)
+					}(target, image)
+				}
+			}
+			wg.Wait()
+			if counter.max != tt.wantMax {
+				t.Errorf("at most %d ran at once, want %d", counter.max, tt.wantMax)
+			}
+			if len(workers.images) != 0 {
+				t.Errorf("image locks left behind %v", workers.images)
+			}
+		})
+	}
+}
+
+func TestWorkersConcurrency(t *testing.T) {
+	workers := NewWorkers(4, 2)
+	workers.SetTargetLimit("big", 8)
+	workers.SetTargetLimit("small", 1)
+	for target, want := range map[string]int{"other": 2, "big": 4, "small": 1} {
+		if got := workers.Concurrency(target); got != want {
+			t.Errorf("Concurrency(%s) = %d, want %d", target, got, want)
+		}
+	}
+}
+
+func TestRunAll(t *testing.T) {
+	counter := &concurrencyCounter{}
+	events := make([]RegistryEvent, 10)
+	runAll(counter, events, 3)
+	if counter.calls != 10 || counter.max != 3 {
+		t.Errorf("handled %d events with %d at once, want 10 with 3", counter.calls, counter.max)
+	}
+}
+
+func TestTargetRefs(t *testing.T) {
+	rule, _ := NewTagRule(`(\d+\.\d+\.\d+)-rc\d+`, "$1", "promoted-{{.Date}}")
+	bySha, _ := NewTagRule(`latest`, `sha-{{slice .Digest 7 14}}`)
+	target := RegistryInfo{address: "prod:5000"}
+	handler := ImageHandler{
+		target:  regTarget{nil, target},
+		mapping: ImageMapping{Repositories: RepositoryRewriter{PrefixRule{"staging/", "prod/"}}, Tags: []TagRule{rule, bySha}},
+	}
+	dgst := digest.Digest("sha256:" + strings.Repeat("1", 64))
+	tests := []struct {
+		evt  RegistryEvent
+		want []string
+	}{
+		// release candidates promoted to the same tag wait for each other, the stamps being left out
+		{RegistryEvent{Action: "push", Target: RegistryTarget{"staging/app", "1.4.2-rc1"}}, []string{"prod:5000/prod/app:1.4.2"}},
+		{RegistryEvent{Action: "push", Target: RegistryTarget{"staging/app", "1.4.2-rc2"}}, []string{"prod:5000/prod/app:1.4.2"}},
+		{RegistryEvent{Action: "push", Target: RegistryTarget{"staging/app", "latest"}, Digest: dgst}, []string{"prod:5000/prod/app:sha-1111111"}},
+		{RegistryEvent{Action: "push", Target: RegistryTarget{"staging/app", "latest"}}, []string{"prod:5000/prod/app:latest"}},
+		{RegistryEvent{Action: "delete", Target: RegistryTarget{"prod/app", "1.0"}, Reason: pruneReason}, []string{"prod:5000/prod/app:1.0"}},
+	}
+	for _, tt := range tests {
+		if got := handler.targetRefs(tt.evt); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("targetRefs(%s) = %v, want %v", tt.evt, got, tt.want)
+		}
+	}
+}